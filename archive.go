@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// How many days to keep raw feeds for. 0 keeps them forever
+var archiveRetentionDays int
+
+type FeedSnapshot struct {
+	Id            int
+	Hash          string
+	Source        string
+	FetchedAt     time.Time
+	LastFetchedAt time.Time
+	FetchCount    int
+	Size          int
+	Body          []byte // Uncompressed
+}
+
+// Stores the raw feed so it can be reprocessed later. A feed we've already got just has its fetch details updated
+func ArchiveFeed(data []byte, source string, fetchedAt time.Time) (FeedSnapshot, error) {
+	h := sha1.New()
+	h.Write(data)
+
+	s := FeedSnapshot{
+		Hash:      fmt.Sprintf("%x", h.Sum(nil)),
+		Source:    source,
+		FetchedAt: fetchedAt,
+		Size:      len(data),
+		Body:      data,
+	}
+
+	err := s.Insert()
+	if err != nil {
+		return s, err
+	}
+
+	if archiveRetentionDays > 0 {
+		_, err = PruneFeedSnapshots(time.Now().AddDate(0, 0, -archiveRetentionDays))
+		if err != nil {
+			return s, err
+		}
+	}
+
+	return s, nil
+}
+
+// Inserts the snapshot, or if we have its hash already, records that it was fetched again.
+// Snapshots can be archived out of order, e.g. when backfilling, so fetched_at is the earliest fetch
+func (s *FeedSnapshot) Insert() error {
+	body, err := gzipBytes(s.Body)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := db.Prepare(`INSERT INTO feed_snapshots(hash, source, fetched_at, last_fetched_at, size, body)
+    VALUES($1, $2, $3, $3, $4, $5)
+    ON CONFLICT (hash) DO UPDATE SET fetched_at = LEAST(feed_snapshots.fetched_at, EXCLUDED.fetched_at),
+      last_fetched_at = GREATEST(feed_snapshots.last_fetched_at, EXCLUDED.last_fetched_at), fetch_count = feed_snapshots.fetch_count + 1
+    RETURNING id, fetched_at, last_fetched_at, fetch_count`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	err = stmt.QueryRow(s.Hash, s.Source, s.FetchedAt.UTC().Format(time.RFC3339), s.Size, body).Scan(&s.Id, &s.FetchedAt, &s.LastFetchedAt, &s.FetchCount)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Deletes snapshots that haven't been fetched since before
+func PruneFeedSnapshots(before time.Time) (int64, error) {
+	stmt, err := db.Prepare(`DELETE FROM feed_snapshots WHERE last_fetched_at < $1`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(before.UTC().Format(time.RFC3339))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+
+	w := gzip.NewWriter(&b)
+	_, err := w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+func gunzipBytes(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+// Fetches the IDs of snapshots fetched within a range, oldest first. Zero times leave that end of the range open
+func GetFeedSnapshotIds(from, to time.Time) ([]int, error) {
+	ids := []int{}
+
+	q := `SELECT id FROM feed_snapshots WHERE ($1::timestamptz IS NULL OR fetched_at >= $1) AND ($2::timestamptz IS NULL OR fetched_at <= $2) ORDER BY fetched_at`
+	rows, err := db.Query(q, nullTime(from), nullTime(to))
+	if err != nil {
+		return ids, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// Fetches a snapshot, including its uncompressed body
+func GetFeedSnapshot(id int) (FeedSnapshot, error) {
+	s := FeedSnapshot{}
+
+	stmt, err := db.Prepare(`SELECT id, hash, source, fetched_at, last_fetched_at, fetch_count, size, body FROM feed_snapshots WHERE id = $1`)
+	if err != nil {
+		return s, err
+	}
+	defer stmt.Close()
+
+	var body []byte
+	err = stmt.QueryRow(id).Scan(&s.Id, &s.Hash, &s.Source, &s.FetchedAt, &s.LastFetchedAt, &s.FetchCount, &s.Size, &body)
+	if err != nil {
+		return s, err
+	}
+
+	s.Body, err = gunzipBytes(body)
+	if err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// A zero time becomes NULL, for optional range bounds in queries
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGzipRoundTrip(t *testing.T) {
+	data := []byte(`{"type":"FeatureCollection","features":[]}`)
+
+	compressed, err := gzipBytes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uncompressed, err := gunzipBytes(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, uncompressed) {
+		t.Errorf("Expected %s, got %s", data, uncompressed)
+	}
+}
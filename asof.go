@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/paulmach/go.geojson"
+	"io"
+	"time"
+)
+
+// A report with the RFS id of its incident
+type IncidentReport struct {
+	RFSId  int
+	Report Report
+}
+
+// Scans extra columns after those scanned by another function, e.g. scanReport
+type extraColumns struct {
+	row   rowScanner
+	extra []interface{}
+}
+
+func (e extraColumns) Scan(dest ...interface{}) error {
+	return e.row.Scan(append(dest, e.extra...)...)
+}
+
+// Selects the latest report published by $1 of each incident that was current at $1, with the incident's RFS id.
+// $2 is the type of event incidents are resolved with.
+// An incident was current between its first report and either its next report or it being resolved, unless it
+// was reopened since. Incidents resolved before resolutions were recorded as events were current until their last report
+const reportsAsOfQuery = `SELECT latest.*, i.rfs_id
+  FROM (
+    SELECT DISTINCT ON (incident_uuid) * FROM reports
+    WHERE pubdate <= $1
+    ORDER BY incident_uuid, pubdate DESC, created_at DESC
+  ) latest
+  JOIN incidents i ON i.uuid = latest.incident_uuid
+  WHERE COALESCE((
+      SELECT e.type FROM incident_events e
+      WHERE e.incident_uuid = latest.incident_uuid AND e.type IN ($2, '` + eventIncidentReopened + `')
+        AND e.occurred_at > latest.pubdate AND e.occurred_at <= $1
+      ORDER BY e.occurred_at DESC, e.id DESC
+      LIMIT 1
+    ), '') <> $2
+    AND (
+      EXISTS (SELECT 1 FROM reports later WHERE later.incident_uuid = latest.incident_uuid AND later.pubdate > $1)
+      OR EXISTS (SELECT 1 FROM incident_events e WHERE e.incident_uuid = latest.incident_uuid AND e.type = $2 AND e.occurred_at > $1)
+      OR i.current
+    )`
+
+// Selects the latest report of each current incident, with the incident's RFS id, in the same columns as
+// reportsAsOfQuery. Current incidents don't need the event log replayed
+const currentReportsQuery = `SELECT latest.*, i.rfs_id
+  FROM incidents i
+  JOIN LATERAL (
+    SELECT * FROM reports WHERE reports.incident_uuid = i.uuid
+    ORDER BY pubdate DESC, created_at DESC
+    LIMIT 1
+  ) latest ON true
+  WHERE i.current`
+
+// The query selecting the latest report of each incident current at a time, or now when it's zero, and its arguments.
+// Arguments for the rest of a statement follow them
+func reportsAtQuery(at time.Time) (string, []interface{}) {
+	if at.IsZero() {
+		return currentReportsQuery, []interface{}{}
+	}
+	return reportsAsOfQuery, []interface{}{at.UTC().Format(time.RFC3339), eventIncidentResolved}
+}
+
+// Fetches the incidents that were current at a time, or now when it's zero, each with the latest report published by then
+func GetIncidentsAsOf(at time.Time) ([]IncidentReport, error) {
+	incidents := []IncidentReport{}
+
+	// Aliased as reports so reportColumns can select from them
+	query, args := reportsAtQuery(at)
+	rows, err := db.Query(`WITH asof AS (`+query+`)
+    SELECT `+reportColumns+`, reports.rfs_id FROM asof reports ORDER BY reports.pubdate DESC`, args...)
+	if err != nil {
+		return incidents, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		i := IncidentReport{}
+		i.Report, err = scanReport(extraColumns{rows, []interface{}{&i.RFSId}})
+		if err != nil {
+			return incidents, err
+		}
+		incidents = append(incidents, i)
+	}
+
+	return incidents, rows.Err()
+}
+
+// The report as a feature, with the fields most people want as its properties
+func reportFeature(rfsId int, r Report) *geojson.Feature {
+	f := geojson.NewFeature(r.Geometry)
+	f.SetProperty("rfs_id", rfsId)
+	f.SetProperty("incident_uuid", r.IncidentUUID)
+	f.SetProperty("report_uuid", r.UUID)
+	f.SetProperty("guid", r.Guid)
+	f.SetProperty("title", r.Title)
+	f.SetProperty("link", r.Link)
+	f.SetProperty("category", r.Category)
+	f.SetProperty("pubdate", r.Pubdate.UTC().Format(time.RFC3339))
+	f.SetProperty("updated", r.Updated.UTC().Format(time.RFC3339))
+	f.SetProperty("alert_level", r.AlertLevel)
+	f.SetProperty("location", r.Location)
+	f.SetProperty("council_area", r.CouncilArea)
+	f.SetProperty("status", r.Status)
+	f.SetProperty("fire_type", r.FireType)
+	f.SetProperty("fire", r.Fire)
+	f.SetProperty("size", r.Size)
+	f.SetProperty("responsible_agency", r.ResponsibleAgency)
+	return f
+}
+
+// The incidents as features of their reports
+func incidentsFeatureCollection(incidents []IncidentReport) *geojson.FeatureCollection {
+	fc := geojson.NewFeatureCollection()
+	for _, i := range incidents {
+		fc.AddFeature(reportFeature(i.RFSId, i.Report))
+	}
+	return fc
+}
+
+// Writes the incidents that were current at a time as GeoJSON
+func WriteIncidentsAsOf(w io.Writer, at time.Time) error {
+	incidents, err := GetIncidentsAsOf(at)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(incidentsFeatureCollection(incidents))
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeRow []interface{}
+
+func (f fakeRow) Scan(dest ...interface{}) error {
+	for i, d := range dest {
+		switch d := d.(type) {
+		case *string:
+			*d = f[i].(string)
+		case *int:
+			*d = f[i].(int)
+		}
+	}
+	return nil
+}
+
+func TestExtraColumns(t *testing.T) {
+	var uuid string
+	var rfsId int
+	err := extraColumns{fakeRow{"a", 123456}, []interface{}{&rfsId}}.Scan(&uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uuid != "a" || rfsId != 123456 {
+		t.Errorf("Expected the extra column after the others, got %q and %d", uuid, rfsId)
+	}
+}
+
+func TestReportFeature(t *testing.T) {
+	r := Report{UUID: "b", IncidentUUID: "i", Title: "Wambelong", AlertLevel: "Advice", Pubdate: time.Date(2015, 12, 1, 10, 31, 0, 0, time.UTC)}
+	f := reportFeature(123456, r)
+
+	if f.Properties["rfs_id"] != 123456 || f.Properties["report_uuid"] != "b" || f.Properties["alert_level"] != "Advice" {
+		t.Errorf("Feature doesn't have the report's properties %v", f.Properties)
+	}
+	if f.Properties["pubdate"] != "2015-12-01T10:31:00Z" {
+		t.Errorf("Expected the pubdate in UTC, got %v", f.Properties["pubdate"])
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/paulmach/go.geojson"
+	"io"
+	"strings"
+)
+
+// How many of the nearest assets in each layer a report is annotated with
+const assetsNearestPerLayer = 3
+
+// Assets further than this, in metres, from a report aren't worth mentioning
+const assetsMaxDistanceM = 100000
+
+type ReportAsset struct {
+	ReportUUID string
+	AssetId    int
+	Layer      string
+	Name       string
+	DistanceM  float64
+	Rank       int
+}
+
+// Replaces a layer of assets with a collection of features.
+// Each asset is named with the nameProperty of its feature. Returns the number of assets loaded
+func LoadAssets(layer string, fc *geojson.FeatureCollection, nameProperty string) (int, error) {
+	// The layer's replaced all at once, or not at all
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM assets WHERE layer = $1`, layer)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt, err := tx.Prepare(`INSERT INTO assets(layer, name, properties, geometry) VALUES($1, $2, $3::jsonb, ST_SetSRID(ST_GeomFromGeoJSON($4), 4326))`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	count := 0
+	for i, f := range fc.Features {
+		if f.Geometry == nil {
+			continue
+		}
+		name, _ := f.PropertyString(nameProperty)
+		if name == "" {
+			name = fmt.Sprintf("%s %d", layer, i+1)
+		}
+		props, err := json.Marshal(f.Properties)
+		if err != nil {
+			return 0, err
+		}
+		geom, err := mergeNestedGeometryCollections(f.Geometry).MarshalJSON()
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = stmt.Exec(layer, name, string(props), string(geom))
+		if err != nil {
+			return 0, err
+		}
+		count++
+	}
+
+	return count, tx.Commit()
+}
+
+// Annotates reports with nearest, which stores the assets near a report and returns how many there were, then marks
+// them as annotated with mark. Reports with no assets nearby are marked too, so they aren't looked at again, but only
+// reports that got assets are counted
+func annotateReports(reports []Report, nearest func(reportUUID string) (int64, error), mark func(reportUUID string) error) (int, error) {
+	count := 0
+	for _, r := range reports {
+		if r.UUID == "" {
+			continue
+		}
+		n, err := nearest(r.UUID)
+		if err != nil {
+			return count, err
+		}
+		err = mark(r.UUID)
+		if err != nil {
+			return count, err
+		}
+		if n > 0 {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Annotates reports with the assets nearest to their geometry in each layer. Returns how many reports got assets.
+// Until assets are loaded reports are left unannotated, so assets annotate picks them up afterwards
+func AnnotateReportsWithAssets(reports []Report) (int, error) {
+	var loaded bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM assets)`).Scan(&loaded)
+	if err != nil || !loaded {
+		return 0, err
+	}
+
+	stmt, err := db.Prepare(`INSERT INTO report_assets(report_uuid, asset_id, layer, name, distance_m, rank)
+    SELECT uuid, id, layer, name, distance_m, rank FROM (
+      SELECT r.uuid, a.id, a.layer, a.name, ST_Distance(a.geometry::geography, r.geometry::geography) AS distance_m,
+        row_number() OVER (PARTITION BY a.layer ORDER BY ST_Distance(a.geometry::geography, r.geometry::geography)) AS rank
+      FROM reports r
+      JOIN LATERAL (SELECT DISTINCT layer FROM assets) l ON true
+      JOIN LATERAL (
+        -- The index orders by planar distance, so take a few extra candidates before measuring properly
+        SELECT * FROM assets WHERE assets.layer = l.layer ORDER BY assets.geometry <-> r.geometry LIMIT $2
+      ) a ON true
+      WHERE r.uuid = $1 AND r.geometry IS NOT NULL
+    ) nearest
+    WHERE rank <= $3 AND distance_m <= $4`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	markStmt, err := db.Prepare(`UPDATE reports SET assets_annotated_at = NOW() WHERE uuid = $1`)
+	if err != nil {
+		return 0, err
+	}
+	defer markStmt.Close()
+
+	nearest := func(reportUUID string) (int64, error) {
+		res, err := stmt.Exec(reportUUID, assetsNearestPerLayer*4, assetsNearestPerLayer, assetsMaxDistanceM)
+		if err != nil {
+			return 0, err
+		}
+		return res.RowsAffected()
+	}
+	mark := func(reportUUID string) error {
+		_, err := markStmt.Exec(reportUUID)
+		return err
+	}
+	return annotateReports(reports, nearest, mark)
+}
+
+// Annotates reports that haven't been yet, e.g. after loading assets for the first time. Returns how many got assets
+func AnnotateUnannotatedReports() (int, error) {
+	rows, err := db.Query(`SELECT uuid FROM reports WHERE assets_annotated_at IS NULL`)
+	if err != nil {
+		return 0, err
+	}
+
+	reports := []Report{}
+	for rows.Next() {
+		r := Report{}
+		err = rows.Scan(&r.UUID)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		reports = append(reports, r)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	return AnnotateReportsWithAssets(reports)
+}
+
+// Fetches the assets a report was annotated with, nearest first
+func GetReportAssets(reportUUID string) ([]ReportAsset, error) {
+	assets := []ReportAsset{}
+
+	rows, err := db.Query(`SELECT report_uuid, COALESCE(asset_id, 0), layer, name, distance_m, rank FROM report_assets
+    WHERE report_uuid = $1 ORDER BY distance_m, layer`, reportUUID)
+	if err != nil {
+		return assets, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		a := ReportAsset{}
+		err = rows.Scan(&a.ReportUUID, &a.AssetId, &a.Layer, &a.Name, &a.DistanceM, &a.Rank)
+		if err != nil {
+			return assets, err
+		}
+		assets = append(assets, a)
+	}
+
+	return assets, rows.Err()
+}
+
+// Describes how close a report is to assets, e.g. "Wambelong is 4.2 km from Coonabarabran (towns)"
+func proximitySummary(r Report, assets []ReportAsset) []string {
+	lines := []string{}
+	for _, a := range assets {
+		if a.DistanceM == 0 {
+			lines = append(lines, fmt.Sprintf("%s is at %s (%s)", r.Title, a.Name, a.Layer))
+		} else {
+			lines = append(lines, fmt.Sprintf("%s is %.1f km from %s (%s)", r.Title, a.DistanceM/1000, a.Name, a.Layer))
+		}
+	}
+	return lines
+}
+
+// Writes how close an incident's latest report is to assets
+func PrintIncidentProximity(w io.Writer, rfsId int) error {
+	uuid, err := GetIncidentUUIDForRFSId(rfsId)
+	if err != nil {
+		return err
+	}
+	r, err := GetLatestIncidentReport(uuid)
+	if err != nil {
+		return err
+	}
+	assets, err := GetReportAssets(r.UUID)
+	if err != nil {
+		return err
+	}
+
+	if len(assets) == 0 {
+		fmt.Fprintf(w, "%s isn't near any assets\n", r.Title)
+		return nil
+	}
+	fmt.Fprintln(w, strings.Join(proximitySummary(r, assets), "\n"))
+	return nil
+}
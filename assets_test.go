@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProximitySummary(t *testing.T) {
+	r := Report{Title: "Wambelong"}
+	assets := []ReportAsset{
+		{Layer: "towns", Name: "Coonabarabran", DistanceM: 4240},
+		{Layer: "parks", Name: "Warrumbungle National Park", DistanceM: 0},
+	}
+
+	expected := []string{
+		"Wambelong is 4.2 km from Coonabarabran (towns)",
+		"Wambelong is at Warrumbungle National Park (parks)",
+	}
+	if got := proximitySummary(r, assets); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
+
+func TestAnnotateReports(t *testing.T) {
+	reports := []Report{{UUID: "near"}, {UUID: "far"}, {}}
+	nearest := func(reportUUID string) (int64, error) {
+		if reportUUID == "near" {
+			return 3, nil
+		}
+		return 0, nil
+	}
+	marked := []string{}
+	mark := func(reportUUID string) error {
+		marked = append(marked, reportUUID)
+		return nil
+	}
+
+	count, err := annotateReports(reports, nearest, mark)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A report with no assets nearby isn't counted, but is marked so it isn't looked at again
+	if count != 1 {
+		t.Errorf("Expected only the report near assets to be counted, got %d", count)
+	}
+	if !reflect.DeepEqual(marked, []string{"near", "far"}) {
+		t.Errorf("Expected both reports to be marked as annotated, got %v", marked)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/paulmach/go.geojson"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Kinds of boundary
+const (
+	boundaryLGA    = "lga"
+	boundarySuburb = "suburb"
+	boundaryState  = "state"
+)
+
+var boundaryKinds = []string{boundaryLGA, boundarySuburb, boundaryState}
+
+type SpatialEnrichment struct {
+	ReportUUID          string
+	CouncilArea         string
+	Suburb              string
+	State               string
+	CouncilAreaMismatch bool
+}
+
+// Replaces the boundaries of a kind with a collection of features.
+// Each boundary is named with the nameProperty of its feature. Returns the number of boundaries loaded
+func LoadBoundaries(kind string, fc *geojson.FeatureCollection, nameProperty string) (int, error) {
+	if !containsFold(boundaryKinds, kind) {
+		return 0, fmt.Errorf("Unknown kind of boundary %s, it should be one of %s", kind, strings.Join(boundaryKinds, ", "))
+	}
+	kind = strings.ToLower(kind)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM boundaries WHERE kind = $1`, kind)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt, err := tx.Prepare(`INSERT INTO boundaries(kind, name, properties, geometry) VALUES($1, $2, $3::jsonb, ST_SetSRID(ST_GeomFromGeoJSON($4), 4326))`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	count := 0
+	for _, f := range fc.Features {
+		if f.Geometry == nil {
+			continue
+		}
+		// Unlike assets, an unnamed boundary isn't any use
+		name, _ := f.PropertyString(nameProperty)
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		props, err := json.Marshal(f.Properties)
+		if err != nil {
+			return 0, err
+		}
+		geom, err := mergeNestedGeometryCollections(f.Geometry).MarshalJSON()
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = stmt.Exec(kind, name, string(props), string(geom))
+		if err != nil {
+			return 0, err
+		}
+		count++
+	}
+
+	return count, tx.Commit()
+}
+
+var councilAreaNoise = regexp.MustCompile(`\b(city|shire|municipal|regional|council|of|the|area)\b`)
+var councilAreaPunctuation = regexp.MustCompile(`[^a-z0-9 ]+`)
+
+// Reduces a council area's name to the part that identifies it, e.g. "City of Blue Mountains Council" to "blue mountains"
+func normaliseCouncilArea(s string) string {
+	s = strings.ToLower(s)
+	s = strings.Replace(s, "&", " and ", -1)
+	s = councilAreaPunctuation.ReplaceAllString(s, " ")
+	s = councilAreaNoise.ReplaceAllString(s, " ")
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// Whether the feed's COUNCIL AREA agrees with the council area the report's geometry is in.
+// The feed's free text is spelt all sorts of ways, and sometimes lists more than one council area
+func councilAreasMatch(feed, spatial string) bool {
+	spatial = normaliseCouncilArea(spatial)
+	if spatial == "" {
+		return true
+	}
+
+	for _, area := range splitList(feed) {
+		area = normaliseCouncilArea(area)
+		if area == "" {
+			continue
+		}
+		if area == spatial || strings.Contains(area, spatial) || strings.Contains(spatial, area) {
+			return true
+		}
+	}
+	return false
+}
+
+// Finds the name of the boundary of a kind a report's in. Fires crossing boundaries are put in
+// the one containing their centre
+func GetReportBoundaryName(reportUUID, kind string) (string, error) {
+	stmt, err := db.Prepare(`SELECT b.name FROM boundaries b
+    JOIN reports r ON r.uuid = $1
+    WHERE b.kind = $2 AND ST_Intersects(b.geometry, r.geometry)
+    ORDER BY ST_Contains(b.geometry, ST_PointOnSurface(r.geometry)) DESC, b.id
+    LIMIT 1`)
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+
+	var name string
+	err = stmt.QueryRow(reportUUID, kind).Scan(&name)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return name, err
+}
+
+// Lists the kinds of boundary that have been loaded
+func GetLoadedBoundaryKinds() ([]string, error) {
+	kinds := []string{}
+
+	rows, err := db.Query(`SELECT DISTINCT kind FROM boundaries ORDER BY kind`)
+	if err != nil {
+		return kinds, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var kind string
+		err = rows.Scan(&kind)
+		if err != nil {
+			return kinds, err
+		}
+		kinds = append(kinds, kind)
+	}
+
+	return kinds, rows.Err()
+}
+
+// Works out where a report is from the kinds of boundary that have been loaded, with name finding the boundary of a
+// kind it's in. False when no boundaries have been loaded, as there's nothing to go on yet
+func enrichReport(r Report, kinds []string, name func(reportUUID, kind string) (string, error)) (SpatialEnrichment, bool, error) {
+	e := SpatialEnrichment{ReportUUID: r.UUID}
+	if len(kinds) == 0 {
+		return e, false, nil
+	}
+
+	names := make(map[string]string)
+	for _, kind := range kinds {
+		n, err := name(r.UUID, kind)
+		if err != nil {
+			return e, false, err
+		}
+		names[kind] = n
+	}
+	e.CouncilArea = names[boundaryLGA]
+	e.Suburb = names[boundarySuburb]
+	e.State = names[boundaryState]
+	e.CouncilAreaMismatch = !councilAreasMatch(r.CouncilArea, e.CouncilArea)
+
+	return e, true, nil
+}
+
+// Works out the council area, suburb and state reports are in from the boundaries, flagging reports whose
+// COUNCIL AREA disagrees. Reports without a geometry, or outside every boundary, are left blank.
+// Until boundaries are loaded reports are left unenriched, so boundaries enrich picks them up afterwards
+func EnrichReports(reports []Report) ([]SpatialEnrichment, error) {
+	enrichments := []SpatialEnrichment{}
+
+	kinds, err := GetLoadedBoundaryKinds()
+	if err != nil || len(kinds) == 0 {
+		return enrichments, err
+	}
+
+	stmt, err := db.Prepare(`UPDATE reports
+    SET spatial_council_area = NULLIF($2, ''), spatial_suburb = NULLIF($3, ''), spatial_state = NULLIF($4, ''),
+      council_area_mismatch = $5, spatially_enriched_at = $6, updated_at = (NOW() AT TIME ZONE 'UTC')
+    WHERE uuid = $1`)
+	if err != nil {
+		return enrichments, err
+	}
+	defer stmt.Close()
+
+	for _, r := range reports {
+		if r.UUID == "" {
+			continue
+		}
+
+		e, ok, err := enrichReport(r, kinds, GetReportBoundaryName)
+		if err != nil {
+			return enrichments, err
+		}
+		if !ok {
+			continue
+		}
+
+		_, err = stmt.Exec(e.ReportUUID, e.CouncilArea, e.Suburb, e.State, e.CouncilAreaMismatch, time.Now().UTC().Format(time.RFC3339))
+		if err != nil {
+			return enrichments, err
+		}
+		enrichments = append(enrichments, e)
+	}
+
+	return enrichments, nil
+}
+
+// Enriches reports that haven't been yet, or all of them, e.g. after loading boundaries. Returns how many were enriched
+func EnrichUnenrichedReports(all bool) (int, error) {
+	rows, err := db.Query(`SELECT uuid, COALESCE(council_area, '') FROM reports WHERE spatially_enriched_at IS NULL OR $1 = true`, all)
+	if err != nil {
+		return 0, err
+	}
+
+	reports := []Report{}
+	for rows.Next() {
+		r := Report{}
+		err = rows.Scan(&r.UUID, &r.CouncilArea)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		reports = append(reports, r)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	enrichments, err := EnrichReports(reports)
+	return len(enrichments), err
+}
+
+// How many reports' COUNCIL AREA disagrees with their boundaries
+func GetNumCouncilAreaMismatches() (int, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM reports WHERE council_area_mismatch = true`).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCouncilAreasMatch(t *testing.T) {
+	cases := []struct {
+		feed, spatial string
+		expected      bool
+	}{
+		{"Blue Mountains", "Blue Mountains City Council", true},
+		{"Warrumbungle", "Warrumbungle Shire Council", true},
+		{"City of Parramatta", "Parramatta", true},
+		{"Hawkesbury, Blue Mountains", "Blue Mountains", true},
+		{"Mid-Coast", "Mid Coast", true},
+		{"Hawkesbury", "Blue Mountains", false},
+		{"", "Blue Mountains", false},
+		{"Blue Mountains", "", true}, // Outside every boundary, so nothing to disagree with
+	}
+
+	for _, c := range cases {
+		if got := councilAreasMatch(c.feed, c.spatial); got != c.expected {
+			t.Errorf("Expected %q and %q matching to be %t", c.feed, c.spatial, c.expected)
+		}
+	}
+}
+
+func TestEnrichReport(t *testing.T) {
+	r := Report{UUID: "r", CouncilArea: "Hawkesbury"}
+	lookups := []string{}
+	name := func(reportUUID, kind string) (string, error) {
+		lookups = append(lookups, kind)
+		if kind == boundaryLGA {
+			return "Blue Mountains City Council", nil
+		}
+		return "", nil
+	}
+
+	// Without boundaries there's nothing to enrich with, so the report is left for later
+	if _, ok, err := enrichReport(r, []string{}, name); ok || err != nil || len(lookups) != 0 {
+		t.Errorf("Expected no enrichment without boundaries, got %t %v %v", ok, err, lookups)
+	}
+
+	e, ok, err := enrichReport(r, []string{boundaryLGA}, name)
+	if !ok || err != nil {
+		t.Fatalf("Expected an enrichment, got %t %v", ok, err)
+	}
+	if e.CouncilArea != "Blue Mountains City Council" || e.Suburb != "" || !e.CouncilAreaMismatch || len(lookups) != 1 {
+		t.Errorf("Unexpected enrichment %+v after looking up %v", e, lookups)
+	}
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Identifies us as the sender of CAP messages
+var capSender = "incidentworker"
+
+// Where the worker writes CAP messages after each import. Empty doesn't write any
+var capDir string
+
+// CAP's time format, which doesn't allow Z for UTC
+const capTimeFormat = "2006-01-02T15:04:05-07:00"
+
+// Events that can be CAP messages: an incident's first report, its alert level changing, and it being resolved
+var capEventTypes = []string{eventReportInserted, eventAlertLevelEscalated, eventAlertLevelDeescalated, eventIncidentResolved}
+
+// CAP urgency and severity of each alert level. Other levels are Unknown
+var capAlertLevels = map[string][2]string{
+	"emergency warning": {"Immediate", "Extreme"},
+	"watch and act":     {"Expected", "Severe"},
+	"advice":            {"Future", "Moderate"},
+}
+
+type capParameter struct {
+	ValueName string `xml:"valueName"`
+	Value     string `xml:"value"`
+}
+
+type capArea struct {
+	AreaDesc string   `xml:"areaDesc"`
+	Polygons []string `xml:"polygon"`
+	Circles  []string `xml:"circle"`
+}
+
+type capInfo struct {
+	Language     string         `xml:"language"`
+	Category     string         `xml:"category"`
+	Event        string         `xml:"event"`
+	ResponseType string         `xml:"responseType,omitempty"`
+	Urgency      string         `xml:"urgency"`
+	Severity     string         `xml:"severity"`
+	Certainty    string         `xml:"certainty"`
+	Effective    string         `xml:"effective"`
+	SenderName   string         `xml:"senderName"`
+	Headline     string         `xml:"headline"`
+	Description  string         `xml:"description,omitempty"`
+	Web          string         `xml:"web,omitempty"`
+	Parameters   []capParameter `xml:"parameter"`
+	Areas        []capArea      `xml:"area"`
+}
+
+// A CAP 1.2 alert message
+type capAlert struct {
+	XMLName    xml.Name `xml:"urn:oasis:names:tc:emergency:cap:1.2 alert"`
+	Identifier string   `xml:"identifier"`
+	Sender     string   `xml:"sender"`
+	Sent       string   `xml:"sent"`
+	Status     string   `xml:"status"`
+	MsgType    string   `xml:"msgType"`
+	Scope      string   `xml:"scope"`
+	References string   `xml:"references,omitempty"`
+	Incidents  string   `xml:"incidents"`
+	Info       capInfo  `xml:"info"`
+	eventId    int      // Of the event it's the message for
+}
+
+// The identifier of the event's CAP message
+func capIdentifier(e IncidentEvent) string {
+	return fmt.Sprintf("incidentworker-%d", e.Id)
+}
+
+// An event's CAP message, and the earlier messages it refers to
+type capMessage struct {
+	Event      IncidentEvent
+	MsgType    string
+	References []IncidentEvent
+}
+
+// Works out which of an incident's events, in the order they were recorded, are CAP messages. Its first report, or
+// failing that its first alert level change, is an Alert. Later changes Update it, and it's Cancelled when the incident's
+// resolved. If the incident's reopened, its next report or change is a new Alert
+func capMessages(events []IncidentEvent) []capMessage {
+	messages := []capMessage{}
+	var active []IncidentEvent // Messages since the last Alert, none when there isn't one to update
+
+	for _, e := range events {
+		m := capMessage{Event: e, References: append([]IncidentEvent{}, active...)}
+		switch {
+		case len(active) == 0 && e.Type == eventIncidentResolved:
+			continue
+		case len(active) == 0:
+			m.MsgType = "Alert"
+		case e.Type == eventReportInserted:
+			// Later reports are only messages when they change the alert level
+			continue
+		case e.Type == eventIncidentResolved:
+			m.MsgType = "Cancel"
+		default:
+			m.MsgType = "Update"
+		}
+
+		messages = append(messages, m)
+		if m.MsgType == "Cancel" {
+			active = nil
+		} else {
+			active = append(active, e)
+		}
+	}
+
+	return messages
+}
+
+// CAP polygons, "lat,lon lat,lon ...", of the outer rings of the geometry's polygons, and circles of its points
+func capPolygonsAndCircles(r Report) ([]string, []string) {
+	coordinate := func(p []float64) string {
+		return strconv.FormatFloat(p[1], 'f', -1, 64) + "," + strconv.FormatFloat(p[0], 'f', -1, 64)
+	}
+
+	points, polygons := geometryPointsAndPolygons(r.Geometry)
+	capPolygons, capCircles := []string{}, []string{}
+	for _, polygon := range polygons {
+		// CAP wants closed rings of at least 4 points
+		if len(polygon) == 0 || len(polygon[0]) < 4 {
+			continue
+		}
+		coordinates := []string{}
+		for _, p := range polygon[0] {
+			coordinates = append(coordinates, coordinate(p))
+		}
+		capPolygons = append(capPolygons, strings.Join(coordinates, " "))
+	}
+	for _, p := range points {
+		capCircles = append(capCircles, coordinate(p)+" 0")
+	}
+	return capPolygons, capCircles
+}
+
+// The description as plain text, one KEY: value pair per line
+func capDescription(description string) string {
+	for _, br := range []string{"<br />", "<br/>", "<br>"} {
+		description = strings.Replace(description, br, "\n", -1)
+	}
+	return strings.TrimSpace(description)
+}
+
+// Builds a CAP message, given the report its event relates to
+func newCAPAlert(m capMessage, r Report) capAlert {
+	e, msgType := m.Event, m.MsgType
+	sent := e.OccurredAt.In(feedLocation).Format(capTimeFormat)
+	a := capAlert{
+		Identifier: capIdentifier(e),
+		eventId:    e.Id,
+		Sender:     capSender,
+		Sent:       sent,
+		Status:     "Actual",
+		MsgType:    msgType,
+		Scope:      "Public",
+		Incidents:  strconv.Itoa(e.RFSId),
+	}
+	references := []string{}
+	for _, previous := range m.References {
+		references = append(references, strings.Join([]string{capSender, capIdentifier(previous), previous.OccurredAt.In(feedLocation).Format(capTimeFormat)}, ","))
+	}
+	a.References = strings.Join(references, " ")
+
+	urgency, severity := "Unknown", "Unknown"
+	if v, ok := capAlertLevels[strings.ToLower(strings.TrimSpace(r.AlertLevel))]; ok {
+		urgency, severity = v[0], v[1]
+	}
+
+	category := "Other"
+	if r.Fire {
+		category = "Fire"
+	}
+	event := r.FireType
+	if event == "" {
+		event = "Incident"
+	}
+	alertLevel := r.AlertLevel
+	if alertLevel == "" {
+		alertLevel = "Not Applicable"
+	}
+
+	a.Info = capInfo{
+		Language:    "en-AU",
+		Category:    category,
+		Event:       event,
+		Urgency:     urgency,
+		Severity:    severity,
+		Certainty:   "Observed",
+		Effective:   sent,
+		SenderName:  "NSW Rural Fire Service",
+		Headline:    alertLevel + ": " + r.Title,
+		Description: capDescription(r.Description),
+		Web:         r.Link,
+		Parameters: []capParameter{
+			{"AlertLevel", alertLevel},
+			{"Status", r.Status},
+			{"Size", r.Size},
+			{"CouncilArea", r.CouncilArea},
+		},
+	}
+	if msgType == "Cancel" {
+		// It's no longer in the feed, so there's nothing to do
+		a.Info.ResponseType = "AllClear"
+		a.Info.Urgency = "Past"
+		a.Info.Severity = "Minor"
+		a.Info.Headline = "Resolved: " + r.Title
+	}
+
+	areaDesc := r.Location
+	if areaDesc == "" {
+		areaDesc = r.CouncilArea
+	}
+	polygons, circles := capPolygonsAndCircles(r)
+	a.Info.Areas = []capArea{{AreaDesc: areaDesc, Polygons: polygons, Circles: circles}}
+
+	return a
+}
+
+func writeCAPAlert(w io.Writer, a capAlert) error {
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(a)
+}
+
+// Fetches an event by its id
+func GetIncidentEvent(id int) (IncidentEvent, error) {
+	events, err := GetIncidentEvents(EventQuery{Since: id - 1, Limit: 1})
+	if err != nil {
+		return IncidentEvent{}, err
+	}
+	if len(events) == 0 || events[0].Id != id {
+		return IncidentEvent{}, sql.ErrNoRows
+	}
+	return events[0], nil
+}
+
+// Fetches an incident's events that can be CAP messages, up to and including an event id
+func getCAPEventHistory(rfsId, upTo int) ([]IncidentEvent, error) {
+	events := []IncidentEvent{}
+	q := EventQuery{Types: capEventTypes, RFSId: rfsId, Limit: 500}
+	for {
+		page, err := GetIncidentEvents(q)
+		if err != nil {
+			return events, err
+		}
+		for _, e := range page {
+			if e.Id <= upTo {
+				events = append(events, e)
+			}
+		}
+		if len(page) < q.Limit || page[len(page)-1].Id >= upTo {
+			return events, nil
+		}
+		q.Since = page[len(page)-1].Id
+	}
+}
+
+// Works out which events are CAP messages. Whether one is depends on what happened to its incident before, so each
+// incident's history is fetched once, up to the latest of its events. Returns the messages by event id
+func getCAPMessages(events []IncidentEvent) (map[int]capMessage, error) {
+	upTo := make(map[int]int) // RFS id -> latest event
+	for _, e := range events {
+		if e.Id > upTo[e.RFSId] {
+			upTo[e.RFSId] = e.Id
+		}
+	}
+
+	messages := make(map[int]capMessage)
+	for rfsId, id := range upTo {
+		history, err := getCAPEventHistory(rfsId, id)
+		if err != nil {
+			return messages, err
+		}
+		for _, m := range capMessages(history) {
+			messages[m.Event.Id] = m
+		}
+	}
+	return messages, nil
+}
+
+// Builds the CAP messages for events, in the same order, leaving out events that aren't messages
+func GetCAPAlerts(events []IncidentEvent) ([]capAlert, error) {
+	alerts := []capAlert{}
+
+	messages, err := getCAPMessages(events)
+	if err != nil {
+		return alerts, err
+	}
+
+	for _, e := range events {
+		m, ok := messages[e.Id]
+		if !ok {
+			continue
+		}
+
+		// Resolutions don't have a report, so they're about the incident's latest
+		var r Report
+		if e.ReportUUID != "" {
+			r, err = GetReport(e.ReportUUID)
+		} else {
+			r, err = GetLatestIncidentReport(e.IncidentUUID)
+		}
+		if err != nil {
+			return alerts, err
+		}
+		alerts = append(alerts, newCAPAlert(m, r))
+	}
+
+	return alerts, nil
+}
+
+// Builds the CAP message for an event. False when the event isn't one
+func GetCAPAlert(e IncidentEvent) (capAlert, bool, error) {
+	alerts, err := GetCAPAlerts([]IncidentEvent{e})
+	if err != nil || len(alerts) == 0 {
+		return capAlert{}, false, err
+	}
+	return alerts[0], true, nil
+}
+
+// Writes a file of each CAP message for events after an event id to a directory, named by its identifier. Returns how
+// many were written
+func WriteCAPFiles(dir string, since int) (int, error) {
+	events := []IncidentEvent{}
+	for {
+		page, err := GetIncidentEvents(EventQuery{Since: since, Types: capEventTypes, Limit: 500})
+		if err != nil {
+			return 0, err
+		}
+		if len(page) == 0 {
+			break
+		}
+		events = append(events, page...)
+		since = page[len(page)-1].Id
+	}
+
+	alerts, err := GetCAPAlerts(events)
+	if err != nil {
+		return 0, err
+	}
+	for i, a := range alerts {
+		if err = writeCAPFile(dir, a); err != nil {
+			return i, err
+		}
+	}
+	return len(alerts), nil
+}
+
+// Writes to a temporary file first, so nothing picking files up from the directory reads half of one
+func writeCAPFile(dir string, a capAlert) error {
+	f, err := ioutil.TempFile(dir, ".cap")
+	if err != nil {
+		return err
+	}
+	err = writeCAPAlert(f, a)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(dir, a.Identifier+".xml"))
+}
+
+// An Atom index of the CAP messages, linking to each one
+func capIndexFeed(base, self string, alerts []capAlert) atomFeed {
+	feed := atomFeedOf("CAP alerts", self, nil, false)
+	feed.Updated = time.Now().UTC().Format(time.RFC3339)
+
+	for _, a := range alerts {
+		e := atomEntry{
+			Title:     a.Info.Headline,
+			Id:        a.Sender + "," + a.Identifier + "," + a.Sent,
+			Links:     []atomLink{{Href: fmt.Sprintf("%s/cap/%d.xml", base, a.eventId), Rel: "alternate", Type: "application/cap+xml"}},
+			Published: a.Sent,
+			Updated:   a.Sent,
+			Summary:   &atomText{Type: "text", Body: a.MsgType + ": " + a.Info.Severity + ", " + a.Info.Urgency},
+		}
+		feed.Entries = append(feed.Entries, e)
+		feed.Updated = a.Sent
+	}
+
+	return feed
+}
+
+// GET /cap?since=<event id>&incident=<rfs_id>&limit=<n>
+// An Atom index of CAP messages, in the order their events were recorded
+// GET /cap/<event id>.xml
+// The CAP 1.2 message for an incident's first report, an alert level change or a resolution
+func handleCAP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/cap/") {
+		id, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/cap/"), ".xml"))
+		if err != nil || !strings.HasSuffix(r.URL.Path, ".xml") {
+			writeError(w, http.StatusNotFound, fmt.Errorf("Expected a CAP message as /cap/{id}.xml, got %s", r.URL.Path))
+			return
+		}
+
+		e, err := GetIncidentEvent(id)
+		if err == sql.ErrNoRows || (err == nil && !containsFold(capEventTypes, e.Type)) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("There isn't a CAP message %d", id))
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		a, ok, err := GetCAPAlert(e)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("There isn't a CAP message %d", id))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/cap+xml; charset=utf-8")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if err = writeCAPAlert(w, a); err != nil {
+			log.Printf("Error writing CAP message %v\n", err)
+		}
+		return
+	}
+
+	q := EventQuery{Types: capEventTypes}
+	var err error
+	if q.Since, err = queryInt(r, "since", 0); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if q.RFSId, err = queryInt(r, "incident", 0); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if q.Limit, err = queryInt(r, "limit", 100); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if q.Limit > 1000 {
+		q.Limit = 1000
+	}
+
+	events, err := GetIncidentEvents(q)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	alerts, err := GetCAPAlerts(events)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	err = writeAtomFeed(w, capIndexFeed(baseURL(r), baseURL(r)+r.URL.RequestURI(), alerts))
+	if err != nil {
+		log.Printf("Error writing CAP index %v\n", err)
+	}
+}
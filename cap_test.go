@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"github.com/paulmach/go.geojson"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCAPMessages(t *testing.T) {
+	events := []IncidentEvent{
+		{Id: 1, Type: eventReportInserted},
+		{Id: 2, Type: eventReportInserted},
+		{Id: 3, Type: eventAlertLevelEscalated},
+		{Id: 4, Type: eventIncidentResolved},
+		{Id: 5, Type: eventIncidentResolved},
+		{Id: 6, Type: eventAlertLevelDeescalated},
+		{Id: 7, Type: eventReportInserted},
+	}
+
+	messages := capMessages(events)
+
+	summary := []string{}
+	for _, m := range messages {
+		refs := []string{}
+		for _, r := range m.References {
+			refs = append(refs, capIdentifier(r))
+		}
+		summary = append(summary, capIdentifier(m.Event)+" "+m.MsgType+" "+strings.Join(refs, ","))
+	}
+	expected := []string{
+		"incidentworker-1 Alert ",
+		"incidentworker-3 Update incidentworker-1",
+		"incidentworker-4 Cancel incidentworker-1,incidentworker-3",
+		"incidentworker-6 Alert ",
+	}
+	if strings.Join(summary, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(summary, "\n"))
+	}
+}
+
+func TestNewCAPAlert(t *testing.T) {
+	sydney, _ := time.LoadLocation("Australia/Sydney")
+	feedLocation = sydney
+	defer SetFeedTimezone("")
+
+	r := Report{
+		Title:       "Cobbitty Rd, Cobbitty",
+		Link:        "http://www.rfs.nsw.gov.au/fire-information/fires-near-me",
+		AlertLevel:  "Watch and Act",
+		Location:    "Cobbitty Rd, Cobbitty",
+		CouncilArea: "Camden",
+		Status:      "out of control",
+		FireType:    "Bush Fire",
+		Fire:        true,
+		Size:        "120 ha",
+		Description: "ALERT LEVEL: Watch and Act<br />STATUS: out of control",
+		Geometry: geojson.NewCollectionGeometry(
+			geojson.NewPolygonGeometry([][][]float64{{{150.6, -34}, {150.7, -34}, {150.7, -34.1}, {150.6, -34}}}),
+			geojson.NewPointGeometry([]float64{150.65, -34.05}),
+		),
+	}
+	alert := IncidentEvent{Id: 1, RFSId: 123456, Type: eventReportInserted, OccurredAt: time.Date(2015, 12, 1, 10, 31, 0, 0, time.UTC)}
+	update := IncidentEvent{Id: 3, RFSId: 123456, Type: eventAlertLevelEscalated, OccurredAt: time.Date(2015, 12, 1, 11, 0, 0, 0, time.UTC)}
+
+	a := newCAPAlert(capMessage{Event: update, MsgType: "Update", References: []IncidentEvent{alert}}, r)
+	if a.Sent != "2015-12-01T22:00:00+11:00" {
+		t.Errorf("Expected the time in the feed's timezone, got %s", a.Sent)
+	}
+	if a.References != "incidentworker,incidentworker-1,2015-12-01T21:31:00+11:00" {
+		t.Errorf("Unexpected references %s", a.References)
+	}
+	if a.Info.Urgency != "Expected" || a.Info.Severity != "Severe" || a.Info.Category != "Fire" {
+		t.Errorf("Unexpected urgency, severity or category %+v", a.Info)
+	}
+	area := a.Info.Areas[0]
+	if len(area.Polygons) != 1 || area.Polygons[0] != "-34,150.6 -34,150.7 -34.1,150.7 -34,150.6" {
+		t.Errorf("Unexpected polygons %v", area.Polygons)
+	}
+	if len(area.Circles) != 1 || area.Circles[0] != "-34.05,150.65 0" {
+		t.Errorf("Unexpected circles %v", area.Circles)
+	}
+
+	var b bytes.Buffer
+	if err := writeCAPAlert(&b, a); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		`<alert xmlns="urn:oasis:names:tc:emergency:cap:1.2">`,
+		`<msgType>Update</msgType>`,
+		`<incidents>123456</incidents>`,
+		`<description>ALERT LEVEL: Watch and Act&#xA;STATUS: out of control</description>`,
+	} {
+		if !strings.Contains(b.String(), s) {
+			t.Errorf("Expected the message to contain %s, got %s", s, b.String())
+		}
+	}
+
+	cancel := newCAPAlert(capMessage{Event: IncidentEvent{Id: 4, Type: eventIncidentResolved}, MsgType: "Cancel"}, r)
+	if cancel.Info.ResponseType != "AllClear" || cancel.Info.Urgency != "Past" {
+		t.Errorf("Expected a cancel to be all clear, got %+v", cancel.Info)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+// The area field isn't a column, it's calculated from the geometry in hectares
+const changeAreaField = "area_ha"
+
+type ReportChange struct {
+	Id                 int
+	IncidentUUID       string
+	ReportUUID         string
+	PreviousReportUUID string
+	Field              string
+	From               string
+	To                 string
+	CreatedAt          time.Time
+}
+
+// Works out what changed between an incident's previous report and this one
+func reportChanges(prev, r Report) []ReportChange {
+	changes := []ReportChange{}
+
+	add := func(field, from, to string) {
+		if from != to {
+			changes = append(changes, ReportChange{
+				IncidentUUID:       r.IncidentUUID,
+				ReportUUID:         r.UUID,
+				PreviousReportUUID: prev.UUID,
+				Field:              field,
+				From:               from,
+				To:                 to,
+			})
+		}
+	}
+
+	add("alert_level", prev.AlertLevel, r.AlertLevel)
+	add("status", prev.Status, r.Status)
+	add("size", prev.Size, r.Size)
+	add("responsible_agency", prev.ResponsibleAgency, r.ResponsibleAgency)
+
+	return changes
+}
+
+// Records what changed since the incident's previous report. Nothing's recorded for an incident's first report
+func (r *Report) RecordChanges(q dbQueryer) ([]ReportChange, error) {
+	prev, err := GetPreviousReport(q, r)
+	if err == sql.ErrNoRows {
+		return []ReportChange{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	changes := reportChanges(prev, *r)
+
+	prevArea, area, err := GetReportAreas(q, prev.UUID, r.UUID)
+	if err != nil {
+		return changes, err
+	}
+	// Rounded to avoid recording floating point noise as growth
+	if math.Abs(area-prevArea) >= 0.01 {
+		changes = append(changes, ReportChange{
+			IncidentUUID:       r.IncidentUUID,
+			ReportUUID:         r.UUID,
+			PreviousReportUUID: prev.UUID,
+			Field:              changeAreaField,
+			From:               strconv.FormatFloat(prevArea, 'f', 2, 64),
+			To:                 strconv.FormatFloat(area, 'f', 2, 64),
+		})
+	}
+
+	for i := range changes {
+		err = changes[i].Insert(q)
+		if err != nil {
+			return changes, err
+		}
+	}
+
+	return changes, nil
+}
+
+// Inserts the change into the database
+func (c *ReportChange) Insert(q dbQueryer) error {
+	stmt, err := q.Prepare(`INSERT INTO report_changes(incident_uuid, report_uuid, previous_report_uuid, field, old_value, new_value)
+    VALUES($1, $2, $3, $4, $5, $6)
+    RETURNING id, created_at`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	return stmt.QueryRow(c.IncidentUUID, c.ReportUUID, c.PreviousReportUUID, c.Field, c.From, c.To).Scan(&c.Id, &c.CreatedAt)
+}
+
+// Fetches the report published before this one for the same incident
+func GetPreviousReport(q dbQueryer, r *Report) (Report, error) {
+	stmt, err := q.Prepare(`SELECT ` + reportColumns + ` FROM reports
+    WHERE incident_uuid = $1 AND uuid <> $2 AND pubdate <= $3
+    ORDER BY pubdate DESC, created_at DESC
+    LIMIT 1`)
+	if err != nil {
+		return Report{}, err
+	}
+	defer stmt.Close()
+
+	return scanReport(stmt.QueryRow(r.IncidentUUID, r.UUID, r.Pubdate.UTC().Format(time.RFC3339)))
+}
+
+// The areas, in hectares, of two reports' geometries. Points don't have any area
+func GetReportAreas(q dbQueryer, aUUID, bUUID string) (float64, float64, error) {
+	stmt, err := q.Prepare(`SELECT COALESCE(ST_Area(a.geometry::geography), 0) / 10000, COALESCE(ST_Area(b.geometry::geography), 0) / 10000
+    FROM reports a, reports b
+    WHERE a.uuid = $1 AND b.uuid = $2`)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer stmt.Close()
+
+	var a, b float64
+	err = stmt.QueryRow(aUUID, bUUID).Scan(&a, &b)
+	return a, b, err
+}
+
+// Fetches the changes recorded for an incident, keyed by the report they were recorded against
+func GetIncidentChanges(incidentUUID string) (map[string][]ReportChange, error) {
+	changes := make(map[string][]ReportChange)
+
+	rows, err := db.Query(`SELECT id, incident_uuid, report_uuid, previous_report_uuid, field, COALESCE(old_value, ''), COALESCE(new_value, ''), created_at
+    FROM report_changes WHERE incident_uuid = $1 ORDER BY id`, incidentUUID)
+	if err != nil {
+		return changes, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		c := ReportChange{}
+		err = rows.Scan(&c.Id, &c.IncidentUUID, &c.ReportUUID, &c.PreviousReportUUID, &c.Field, &c.From, &c.To, &c.CreatedAt)
+		if err != nil {
+			return changes, err
+		}
+		changes[c.ReportUUID] = append(changes[c.ReportUUID], c)
+	}
+
+	return changes, rows.Err()
+}
+
+// Fetches an incident's reports, oldest first
+func GetIncidentReports(incidentUUID string) ([]Report, error) {
+	reports := []Report{}
+
+	rows, err := db.Query(`SELECT `+reportColumns+` FROM reports WHERE incident_uuid = $1 ORDER BY pubdate, created_at`, incidentUUID)
+	if err != nil {
+		return reports, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		r, err := scanReport(rows)
+		if err != nil {
+			return reports, err
+		}
+		reports = append(reports, r)
+	}
+
+	return reports, rows.Err()
+}
+
+// Fetches an incident's most recently published report
+func GetLatestIncidentReport(incidentUUID string) (Report, error) {
+	stmt, err := db.Prepare(`SELECT ` + reportColumns + ` FROM reports WHERE incident_uuid = $1 ORDER BY pubdate DESC, created_at DESC LIMIT 1`)
+	if err != nil {
+		return Report{}, err
+	}
+	defer stmt.Close()
+
+	return scanReport(stmt.QueryRow(incidentUUID))
+}
+
+// Writes an incident's reports and what changed in each of them
+func PrintIncidentHistory(w io.Writer, rfsId int) error {
+	uuid, err := GetIncidentUUIDForRFSId(rfsId)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("No incident with RFS id %d", rfsId)
+	}
+	if err != nil {
+		return err
+	}
+
+	reports, err := GetIncidentReports(uuid)
+	if err != nil {
+		return err
+	}
+	changes, err := GetIncidentChanges(uuid)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "Incident %d (%s), %d reports\n", rfsId, uuid, len(reports))
+	for _, r := range reports {
+		fmt.Fprintf(w, "\n%s  %s\n", r.Pubdate.In(feedLocation).Format("2006-01-02 15:04"), r.Title)
+		fmt.Fprintf(w, "  %s, %s, %s, %s\n", r.AlertLevel, r.Status, r.Size, r.ResponsibleAgency)
+		for _, c := range changes[r.UUID] {
+			fmt.Fprintf(w, "  %s: %s -> %s\n", c.Field, c.From, c.To)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestReportChanges(t *testing.T) {
+	prev := Report{UUID: "a", AlertLevel: "Advice", Status: "Out of control", Size: "10 ha", ResponsibleAgency: "Rural Fire Service"}
+	r := Report{UUID: "b", IncidentUUID: "i", AlertLevel: "Watch and Act", Status: "Out of control", Size: "250 ha", ResponsibleAgency: "Rural Fire Service"}
+
+	changes := reportChanges(prev, r)
+	if len(changes) != 2 {
+		t.Fatalf("Expected 2 changes, got %v", changes)
+	}
+
+	c := changes[0]
+	if c.Field != "alert_level" || c.From != "Advice" || c.To != "Watch and Act" {
+		t.Errorf("Unexpected alert level change %v", c)
+	}
+	if c.ReportUUID != "b" || c.PreviousReportUUID != "a" || c.IncidentUUID != "i" {
+		t.Errorf("Change isn't linked to the right reports %v", c)
+	}
+	if changes[1].Field != "size" {
+		t.Errorf("Expected a size change, got %v", changes[1])
+	}
+}
@@ -0,0 +1,630 @@
+package main
+
+import (
+	"fmt"
+	"github.com/codegangsta/cli"
+	"github.com/paulmach/go.geojson"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parses an optional time flag. An empty flag is a zero time
+func timeFlag(c *cli.Context, name string) time.Time {
+	if len(c.String(name)) == 0 {
+		return time.Time{}
+	}
+	t, err := parseCLITime(c.String(name))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return t
+}
+
+func reprocessCommand() cli.Command {
+	return cli.Command{
+		Name:  "reprocess",
+		Usage: "rebuild reports from archived raw data",
+		Description: `Re-runs report parsing against archived feeds (or the raw properties stored with each report)
+   and updates reports in place, keeping their UUIDs. Prints a summary of what changed.`,
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "source", Value: reprocessFromFeeds, Usage: "where to read raw data from, feeds or reports"},
+			cli.StringFlag{Name: "from", Value: "", Usage: "only reprocess feeds fetched (or reports published) from this time, YYYY-MM-DD or RFC3339"},
+			cli.StringFlag{Name: "to", Value: "", Usage: "only reprocess feeds fetched (or reports published) up to this time, YYYY-MM-DD or RFC3339"},
+			cli.IntFlag{Name: "incident", Value: 0, Usage: "only reprocess reports for the incident with this RFS id"},
+			cli.BoolFlag{Name: "dry-run", Usage: "show what would change without saving it"},
+		},
+		Action: func(c *cli.Context) {
+			o := ReprocessOptions{
+				Source: c.String("source"),
+				From:   timeFlag(c, "from"),
+				To:     timeFlag(c, "to"),
+				RFSId:  c.Int("incident"),
+				DryRun: c.Bool("dry-run"),
+			}
+
+			log.Printf("Reprocessing from %s\n", o.Source)
+
+			s, err := Reprocess(o)
+			if err != nil {
+				log.Fatal(err)
+			}
+			s.Print(os.Stdout)
+		},
+	}
+}
+
+func rehashCommand() cli.Command {
+	return cli.Command{
+		Name:  "rehash",
+		Usage: "move reports with older hashes to the current hash version",
+		Action: func(c *cli.Context) {
+			log.Printf("Rehashing reports to hash version %d\n", reportHashVersion)
+
+			count, collisions, err := RehashReports()
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, c := range collisions {
+				if c.Existing != "" {
+					log.Printf("Reports %s would have the same hash as %s, %s. Left with their old hashes\n", strings.Join(c.UUIDs, ", "), c.Existing, c.Hash)
+				} else {
+					log.Printf("Reports %s would have the same hash %s. Left with their old hashes\n", strings.Join(c.UUIDs, ", "), c.Hash)
+				}
+			}
+			log.Printf("Rehashed %d reports, %d collisions left\n", count, len(collisions))
+		},
+	}
+}
+
+func incidentCommand() cli.Command {
+	return cli.Command{
+		Name:  "incident",
+		Usage: "look at an incident, e.g. incident history <rfs_id>",
+		Description: `history <rfs_id>	list an incident's reports and what changed between them
+   nearby <rfs_id>	list the assets nearest to an incident's latest report
+   growth <rfs_id>	list how an incident's perimeter grew between its reports
+   backfill-growth <rfs_id>	record growth for an incident's reports imported before growth was tracked
+   footprint <rfs_id>	write the union of an incident's perimeters as GeoJSON`,
+		Flags: []cli.Flag{
+			cli.BoolFlag{Name: "geojson", Usage: "write growth as GeoJSON of the newly burnt areas"},
+		},
+		Action: func(c *cli.Context) {
+			if len(c.Args()) < 2 {
+				log.Fatal("Specify what to look at and an RFS id, e.g. incident history 123456")
+			}
+			rfsId, err := strconv.Atoi(c.Args()[1])
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			switch c.Args()[0] {
+			case "history":
+				err = PrintIncidentHistory(os.Stdout, rfsId)
+			case "nearby":
+				err = PrintIncidentProximity(os.Stdout, rfsId)
+			case "growth":
+				err = PrintIncidentGrowth(os.Stdout, rfsId, c.Bool("geojson"))
+			case "backfill-growth":
+				var count int
+				count, err = BackfillIncidentGrowth(rfsId)
+				if err == nil {
+					log.Printf("Recorded growth for %d reports\n", count)
+				}
+			case "footprint":
+				err = WriteIncidentFootprint(os.Stdout, rfsId)
+			default:
+				err = fmt.Errorf("Unknown incident command %s", c.Args()[0])
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+}
+
+func eventsCommand() cli.Command {
+	return cli.Command{
+		Name:  "events",
+		Usage: "list incident events, such as alert level and status transitions",
+		Flags: []cli.Flag{
+			cli.IntFlag{Name: "since", Value: 0, Usage: "only list events after this event id"},
+			cli.StringFlag{Name: "type", Value: "", Usage: "only list events of these types, comma separated"},
+			cli.IntFlag{Name: "incident", Value: 0, Usage: "only list events for the incident with this RFS id"},
+			cli.IntFlag{Name: "limit", Value: 100, Usage: "maximum number of events to list"},
+		},
+		Action: func(c *cli.Context) {
+			q := EventQuery{
+				Since: c.Int("since"),
+				RFSId: c.Int("incident"),
+				Limit: c.Int("limit"),
+			}
+			if len(c.String("type")) > 0 {
+				q.Types = strings.Split(c.String("type"), ",")
+			}
+
+			events, err := GetIncidentEvents(q)
+			if err != nil {
+				log.Fatal(err)
+			}
+			PrintIncidentEvents(os.Stdout, events)
+		},
+	}
+}
+
+func serveCommand() cli.Command {
+	return cli.Command{
+		Name:  "serve",
+		Usage: "serve the HTTP API",
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "port", Value: "", Usage: "port to listen on (defaults to $PORT or 8080)"},
+		},
+		Action: func(c *cli.Context) {
+			port := c.String("port")
+			if len(port) == 0 {
+				port = os.Getenv("PORT")
+			}
+			if len(port) == 0 {
+				port = "8080"
+			}
+
+			log.Fatal(Serve(":" + port))
+		},
+	}
+}
+
+func webhooksCommand() cli.Command {
+	return cli.Command{
+		Name:  "webhooks",
+		Usage: "manage webhooks, e.g. webhooks add <url>, webhooks list, webhooks remove <id>, webhooks deliver",
+		Description: `add <url>	send events to url, using the filter options
+   list		list webhooks
+   remove <id>	stop sending events to a webhook
+   deliver	queue and attempt deliveries that are due`,
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "secret", Value: "", Usage: "key used to sign payloads (HMAC-SHA256)"},
+			cli.StringFlag{Name: "events", Value: "", Usage: "only send these event types, comma separated"},
+			cli.StringFlag{Name: "alert-level", Value: "", Usage: "only send events for reports with these alert levels, comma separated"},
+			cli.StringFlag{Name: "council-area", Value: "", Usage: "only send events for reports in these council areas, comma separated"},
+			cli.BoolFlag{Name: "fire-only", Usage: "only send events for reports that are fires"},
+		},
+		Action: func(c *cli.Context) {
+			if len(c.Args()) == 0 {
+				log.Fatal("Specify add, list, remove or deliver")
+			}
+
+			var err error
+			switch c.Args()[0] {
+			case "add":
+				if len(c.Args()) < 2 || len(c.String("secret")) == 0 {
+					log.Fatal("Specify a URL and a --secret")
+				}
+				h := Webhook{
+					URL:          c.Args()[1],
+					Secret:       c.String("secret"),
+					EventTypes:   splitList(c.String("events")),
+					AlertLevels:  splitList(c.String("alert-level")),
+					CouncilAreas: splitList(c.String("council-area")),
+					FireOnly:     c.Bool("fire-only"),
+				}
+				err = h.Insert()
+				if err == nil {
+					log.Printf("Added webhook %d\n", h.Id)
+				}
+			case "list":
+				var hooks []Webhook
+				hooks, err = GetWebhooks(false)
+				PrintWebhooks(os.Stdout, hooks)
+			case "remove":
+				if len(c.Args()) < 2 {
+					log.Fatal("Specify the id of the webhook to remove")
+				}
+				var id int
+				id, err = strconv.Atoi(c.Args()[1])
+				if err == nil {
+					err = DeleteWebhook(id)
+				}
+			case "deliver":
+				queueWebhooks()
+				deliverWebhooks()
+			default:
+				err = fmt.Errorf("Unknown webhooks command %s", c.Args()[0])
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+}
+
+func geofencesCommand() cli.Command {
+	return cli.Command{
+		Name:  "geofences",
+		Usage: "manage geofences, e.g. geofences add <name>, geofences list, geofences remove <id>, geofences events",
+		Description: `add <name>	add a geofence around a --point or the geometry in a --geojson file
+   list		list geofences
+   remove <id>	remove a geofence
+   events	list incidents entering and leaving geofences, most recent first`,
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "point", Value: "", Usage: "the geofence is a point, lon,lat"},
+			cli.StringFlag{Name: "geojson", Value: "", Usage: "path to a GeoJSON file with the geofence's geometry"},
+			cli.Float64Flag{Name: "buffer-km", Value: 0, Usage: "how close incidents need to be to be inside the geofence, in km"},
+			cli.IntFlag{Name: "geofence", Value: 0, Usage: "only list events for this geofence id"},
+			cli.IntFlag{Name: "limit", Value: 50, Usage: "maximum number of events to list"},
+		},
+		Action: func(c *cli.Context) {
+			if len(c.Args()) == 0 {
+				log.Fatal("Specify add, list, remove or events")
+			}
+
+			var err error
+			switch c.Args()[0] {
+			case "add":
+				if len(c.Args()) < 2 {
+					log.Fatal("Specify a name for the geofence")
+				}
+				g := Geofence{Name: c.Args()[1], BufferM: c.Float64("buffer-km") * 1000}
+				if len(c.String("point")) > 0 {
+					g.Geometry, err = parsePoint(c.String("point"))
+				} else if len(c.String("geojson")) > 0 {
+					var data []byte
+					data, err = ioutil.ReadFile(c.String("geojson"))
+					if err == nil {
+						g.Geometry, err = geometryFromGeoJSON(data)
+					}
+				} else {
+					log.Fatal("Specify a --point or --geojson file")
+				}
+				if err == nil {
+					err = g.Insert()
+				}
+				if err == nil {
+					log.Printf("Added geofence %d\n", g.Id)
+				}
+			case "list":
+				var geofences []Geofence
+				geofences, err = GetGeofences()
+				PrintGeofences(os.Stdout, geofences)
+			case "remove":
+				if len(c.Args()) < 2 {
+					log.Fatal("Specify the id of the geofence to remove")
+				}
+				var id int
+				id, err = strconv.Atoi(c.Args()[1])
+				if err == nil {
+					err = DeleteGeofence(id)
+				}
+			case "events":
+				var events []GeofenceEvent
+				events, err = GetGeofenceEvents(c.Int("geofence"), c.Int("limit"))
+				PrintGeofenceEvents(os.Stdout, events)
+			default:
+				err = fmt.Errorf("Unknown geofences command %s", c.Args()[0])
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+}
+
+func assetsCommand() cli.Command {
+	return cli.Command{
+		Name:  "assets",
+		Usage: "manage assets reports are compared to, e.g. assets load <layer> <path>, assets annotate",
+		Description: `load <layer> <path>	replace a layer of assets (e.g. towns) with the features in a GeoJSON file or shapefile
+   annotate		find the nearest assets for reports that haven't been annotated yet`,
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "name-property", Value: "name", Usage: "the feature property assets are named with"},
+		},
+		Action: func(c *cli.Context) {
+			if len(c.Args()) == 0 {
+				log.Fatal("Specify load or annotate")
+			}
+
+			var err error
+			switch c.Args()[0] {
+			case "load":
+				if len(c.Args()) < 3 {
+					log.Fatal("Specify a layer and the path of a GeoJSON file")
+				}
+				var fc *geojson.FeatureCollection
+				fc, err = readFeatures(c.Args()[2])
+				if err == nil {
+					var count int
+					count, err = LoadAssets(c.Args()[1], fc, c.String("name-property"))
+					log.Printf("Loaded %d assets into %s\n", count, c.Args()[1])
+				}
+			case "annotate":
+				var count int
+				count, err = AnnotateUnannotatedReports()
+				log.Printf("Found assets near %d reports\n", count)
+			default:
+				err = fmt.Errorf("Unknown assets command %s", c.Args()[0])
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+}
+
+func boundariesCommand() cli.Command {
+	return cli.Command{
+		Name:  "boundaries",
+		Usage: "manage the boundaries reports are placed in, e.g. boundaries load <kind> <path>, boundaries enrich",
+		Description: `load <kind> <path>	replace the boundaries of a kind (lga, suburb or state) with the features in a GeoJSON file or shapefile
+   enrich		work out the council area, suburb and state of reports that haven't been enriched yet`,
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "name-property", Value: "name", Usage: "the feature property boundaries are named with"},
+			cli.BoolFlag{Name: "all", Usage: "enrich every report, not just those that haven't been"},
+		},
+		Action: func(c *cli.Context) {
+			if len(c.Args()) == 0 {
+				log.Fatal("Specify load or enrich")
+			}
+
+			var err error
+			switch c.Args()[0] {
+			case "load":
+				if len(c.Args()) < 3 {
+					log.Fatal("Specify a kind and the path of a GeoJSON file or shapefile")
+				}
+				var fc *geojson.FeatureCollection
+				fc, err = readFeatures(c.Args()[2])
+				if err == nil {
+					var count int
+					count, err = LoadBoundaries(c.Args()[1], fc, c.String("name-property"))
+					log.Printf("Loaded %d %s boundaries\n", count, c.Args()[1])
+				}
+			case "enrich":
+				var count int
+				count, err = EnrichUnenrichedReports(c.Bool("all"))
+				log.Printf("Enriched %d reports\n", count)
+				if err == nil {
+					var mismatches int
+					mismatches, err = GetNumCouncilAreaMismatches()
+					log.Printf("%d reports have a COUNCIL AREA that doesn't match their boundaries\n", mismatches)
+				}
+			default:
+				err = fmt.Errorf("Unknown boundaries command %s", c.Args()[0])
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+}
+
+func footprintsCommand() cli.Command {
+	return cli.Command{
+		Name:  "footprints",
+		Usage: "look at the burnt area of fire seasons, e.g. footprints export 2015-16",
+		Description: `list			list the fire seasons and their burnt area
+   export [season]	write a season's footprint as GeoJSON, the current season if it isn't given
+   rebuild		rebuild every incident's and season's footprint from the reports`,
+		Action: func(c *cli.Context) {
+			if len(c.Args()) == 0 {
+				log.Fatal("Specify list, export or rebuild")
+			}
+
+			var err error
+			switch c.Args()[0] {
+			case "list":
+				var footprints []Footprint
+				footprints, err = GetSeasonFootprints()
+				PrintSeasonFootprints(os.Stdout, footprints)
+			case "export":
+				season := fireSeason(time.Now())
+				if len(c.Args()) > 1 {
+					season = c.Args()[1]
+				}
+				err = WriteSeasonFootprint(os.Stdout, season)
+			case "rebuild":
+				var count int
+				count, err = RebuildFootprints()
+				log.Printf("Rebuilt footprints from %d reports\n", count)
+			default:
+				err = fmt.Errorf("Unknown footprints command %s", c.Args()[0])
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+}
+
+func asofCommand() cli.Command {
+	return cli.Command{
+		Name:  "asof",
+		Usage: "write the incidents that were current at a time as GeoJSON, e.g. asof \"2015-12-01 21:30\"",
+		Action: func(c *cli.Context) {
+			if len(c.Args()) == 0 {
+				log.Fatal("Specify a time, as YYYY-MM-DD, YYYY-MM-DD HH:MM or RFC3339")
+			}
+			at, err := parseCLITime(c.Args()[0])
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			err = WriteIncidentsAsOf(os.Stdout, at)
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+}
+
+func timelineCommand() cli.Command {
+	return cli.Command{
+		Name:  "timeline",
+		Usage: "write every report published between two times with when each was current, for animated maps",
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "from", Value: "", Usage: "reports published from this time, YYYY-MM-DD, YYYY-MM-DD HH:MM or RFC3339"},
+			cli.StringFlag{Name: "to", Value: "", Usage: "reports published up to this time (defaults to now)"},
+			cli.StringFlag{Name: "format", Value: timelineGeoJSON, Usage: "geojson, with start, end and times properties, or czml"},
+		},
+		Action: func(c *cli.Context) {
+			from, to := timeFlag(c, "from"), timeFlag(c, "to")
+			if from.IsZero() {
+				log.Fatal("Specify a time to start from with --from")
+			}
+			if to.IsZero() {
+				to = time.Now()
+			}
+
+			err := WriteTimeline(os.Stdout, from, to, c.String("format"))
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+}
+
+func outboxCommand() cli.Command {
+	return cli.Command{
+		Name:  "outbox",
+		Usage: "dispatch outbox messages to the --outbox-sinks, e.g. outbox dispatch, outbox status",
+		Description: `dispatch	queue and publish the messages that are due to each sink
+   status	show how far each sink's got and what's pending`,
+		Action: func(c *cli.Context) {
+			if len(c.Args()) == 0 {
+				log.Fatal("Specify dispatch or status")
+			}
+
+			var err error
+			switch c.Args()[0] {
+			case "dispatch":
+				if len(outboxSinks) == 0 {
+					log.Fatal("Specify --outbox-sinks or $OUTBOX_SINKS")
+				}
+				dispatchOutbox()
+			case "status":
+				var statuses []OutboxSinkStatus
+				statuses, err = GetOutboxStatus()
+				PrintOutboxStatus(os.Stdout, statuses)
+			default:
+				err = fmt.Errorf("Unknown outbox command %s", c.Args()[0])
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+}
+
+func capCommand() cli.Command {
+	return cli.Command{
+		Name:  "cap",
+		Usage: "CAP 1.2 messages for alert level changes, e.g. cap show <event id>, cap write <dir>",
+		Description: `show <event id>	write the event's CAP message to stdout
+   write <dir>		write a file of each CAP message to dir, e.g. to catch up on those before --cap-dir was set`,
+		Flags: []cli.Flag{
+			cli.IntFlag{Name: "since", Value: 0, Usage: "only write messages for events after this event id"},
+		},
+		Action: func(c *cli.Context) {
+			if len(c.Args()) < 2 {
+				log.Fatal("Specify show <event id> or write <dir>")
+			}
+
+			var err error
+			switch c.Args()[0] {
+			case "show":
+				var id int
+				var e IncidentEvent
+				if id, err = strconv.Atoi(c.Args()[1]); err != nil {
+					log.Fatal(err)
+				}
+				if e, err = GetIncidentEvent(id); err != nil {
+					log.Fatal(err)
+				}
+				a, ok, err := GetCAPAlert(e)
+				if err == nil && !ok {
+					err = fmt.Errorf("Event %d isn't a CAP message", id)
+				}
+				if err == nil {
+					err = writeCAPAlert(os.Stdout, a)
+				}
+				if err != nil {
+					log.Fatal(err)
+				}
+			case "write":
+				var count int
+				count, err = WriteCAPFiles(c.Args()[1], c.Int("since"))
+				log.Printf("Wrote %d CAP messages to %s\n", count, c.Args()[1])
+			default:
+				err = fmt.Errorf("Unknown cap command %s", c.Args()[0])
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+}
+
+func exportCommand() cli.Command {
+	return cli.Command{
+		Name:  "export",
+		Usage: "write incidents with reports published between two times, and their history, as KML or a GeoPackage, e.g. export --from 2015-12-01 incidents.kml",
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "from", Value: "", Usage: "incidents with reports published from this time, YYYY-MM-DD, YYYY-MM-DD HH:MM or RFC3339"},
+			cli.StringFlag{Name: "to", Value: "", Usage: "incidents with reports published up to this time (defaults to now)"},
+			cli.StringFlag{Name: "format", Value: "", Usage: "kml or gpkg (defaults to the file's extension)"},
+		},
+		Action: func(c *cli.Context) {
+			if len(c.Args()) == 0 {
+				log.Fatal("Specify a file to write to")
+			}
+			path := c.Args()[0]
+			format, err := exportFormat(path, c.String("format"))
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			from, to := timeFlag(c, "from"), timeFlag(c, "to")
+			if from.IsZero() {
+				log.Fatal("Specify a time to start from with --from")
+			}
+			if to.IsZero() {
+				to = time.Now()
+			}
+
+			f, err := os.Create(path)
+			if err != nil {
+				log.Fatal(err)
+			}
+			err = WriteExport(f, from, to, format)
+			if err == nil {
+				err = f.Close()
+			} else {
+				f.Close()
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+}
+
+func sitrepCommand() cli.Command {
+	return cli.Command{
+		Name:  "sitrep",
+		Usage: "write a summary of the current situation as Markdown or HTML, e.g. sitrep --format html > sitrep.html",
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "format", Value: sitrepMarkdown, Usage: "markdown or html"},
+			cli.IntFlag{Name: "hours", Value: 24, Usage: "list incidents that were new or resolved in this many hours"},
+			cli.IntFlag{Name: "top", Value: 10, Usage: "list this many of the largest fires"},
+		},
+		Action: func(c *cli.Context) {
+			if c.Int("hours") < 1 || c.Int("top") < 0 {
+				log.Fatal("--hours must be at least 1 and --top can't be negative")
+			}
+			if err := WriteSitrep(os.Stdout, c.Int("hours"), c.Int("top"), c.String("format")); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	_ "time/tzdata" // Embed the zoneinfo database so we don't depend on the host having it
+)
+
+// RFS publish times as wall clock times in NSW
+const defaultFeedTimezone = "Australia/Sydney"
+
+// The timezone the feed's times are interpreted in
+var feedLocation = mustLoadLocation(defaultFeedTimezone)
+
+// Formats pubDate has been published in, most recent first
+var pubdateFormats = []string{
+	"2/1/2006 3:04:00 PM",           // "1/12/2015 9:31:00 PM"
+	"2/1/2006 3:04:05 PM",           // "1/12/2015 9:31:27 PM"
+	"Mon, 02 Jan 2006 15:04:05 MST", // From the GeoRSS feed, "Wed, 05 Feb 2014 08:58:00 GMT"
+}
+
+// Formats the description's UPDATED value has been published in, most recent first
+var updatedFormats = []string{
+	"2 Jan 2006 15:04",  // "5 Feb 2014 08:58"
+	"02 Jan 2006 15:04", // "05 Feb 2014 08:58"
+	"2/1/2006 15:04",    // "5/02/2014 08:58"
+}
+
+func mustLoadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return loc
+}
+
+// Sets the timezone feed times are interpreted in. Falls back to $FEED_TIMEZONE, then Australia/Sydney
+func SetFeedTimezone(name string) error {
+	if len(name) == 0 {
+		name = os.Getenv("FEED_TIMEZONE")
+	}
+	if len(name) == 0 {
+		name = defaultFeedTimezone
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return fmt.Errorf("Unknown feed timezone %s: %v", name, err)
+	}
+	feedLocation = loc
+
+	return nil
+}
+
+// Parses a pubDate from the feed. Also returns the format that matched
+func parsePubdate(value string) (time.Time, string, error) {
+	return parseFeedTime(value, pubdateFormats, feedLocation)
+}
+
+// Parses the UPDATED value from a report's description. Also returns the format that matched
+func parseUpdated(value string) (time.Time, string, error) {
+	return parseFeedTime(value, updatedFormats, feedLocation)
+}
+
+// Tries each format in turn. Formats with a zone are taken at their word, otherwise the time is a wall clock time in loc
+func parseFeedTime(value string, formats []string, loc *time.Location) (time.Time, string, error) {
+	value = strings.TrimSpace(value)
+
+	for _, format := range formats {
+		t, err := time.Parse(format, value)
+		if err != nil {
+			continue
+		}
+		if formatHasZone(format) {
+			return t, format, nil
+		}
+		return wallClockIn(t, loc), format, nil
+	}
+
+	return time.Time{}, "", fmt.Errorf("Unable to parse time %q", value)
+}
+
+func formatHasZone(format string) bool {
+	return strings.Contains(format, "MST") || strings.Contains(format, "-07") || strings.Contains(format, "Z07")
+}
+
+// Takes the wall clock fields of t and finds the instant they refer to in loc.
+// Around daylight saving transitions time.Date doesn't promise which offset it'll pick, so we decide:
+//   - an ambiguous time (the repeated hour when clocks go back) is the earlier of the two instants
+//   - a time that doesn't exist (the skipped hour when clocks go forward) is moved forward by the gap
+func wallClockIn(t time.Time, loc *time.Location) time.Time {
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+
+	// Offsets either side of the wall time, far enough away to be clear of any transition
+	_, before := wall.Add(-24 * time.Hour).In(loc).Zone()
+	_, after := wall.Add(24 * time.Hour).In(loc).Zone()
+
+	early := wall.Add(-time.Duration(before) * time.Second)
+	late := wall.Add(-time.Duration(after) * time.Second)
+
+	earlyValid := offsetAt(early, loc) == before
+	lateValid := offsetAt(late, loc) == after
+
+	switch {
+	case earlyValid && lateValid:
+		// Ambiguous, or just no transition at all. Pick the earlier instant
+		if late.Before(early) {
+			return late.In(loc)
+		}
+		return early.In(loc)
+	case earlyValid:
+		return early.In(loc)
+	case lateValid:
+		return late.In(loc)
+	default:
+		// In the gap. Using the offset from before the transition lands us after it
+		return early.In(loc)
+	}
+}
+
+func offsetAt(t time.Time, loc *time.Location) int {
+	_, offset := t.In(loc).Zone()
+	return offset
+}
+
+// Parses a time given on the command line, either RFC3339 or a date (with an optional time) in the feed's timezone
+func parseCLITime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, feedLocation); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Unable to parse %q, use YYYY-MM-DD, YYYY-MM-DD HH:MM or RFC3339", value)
+}
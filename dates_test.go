@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParsePubdateInFeedTimezone(t *testing.T) {
+	p, format, err := parsePubdate("1/12/2015 9:31:00 PM")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != pubdateFormats[0] {
+		t.Errorf("Expected the first format to match, got %s", format)
+	}
+	// Sydney is on daylight saving time (UTC+11) in December
+	expected := time.Date(2015, 12, 1, 10, 31, 0, 0, time.UTC)
+	if !p.Equal(expected) {
+		t.Errorf("Expected %v, got %v", expected, p.UTC())
+	}
+}
+
+func TestParsePubdateWithZone(t *testing.T) {
+	p, _, err := parsePubdate("Wed, 05 Feb 2014 08:58:00 GMT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := time.Date(2014, 2, 5, 8, 58, 0, 0, time.UTC)
+	if !p.Equal(expected) {
+		t.Errorf("Expected %v, got %v", expected, p.UTC())
+	}
+}
+
+func TestParseUpdatedFormats(t *testing.T) {
+	for _, v := range []string{"5 Feb 2014 08:58", "05 Feb 2014 08:58", " 5 Feb 2014 08:58 "} {
+		u, _, err := parseUpdated(v)
+		if err != nil {
+			t.Errorf("Unable to parse %q: %v", v, err)
+			continue
+		}
+		expected := time.Date(2014, 2, 4, 21, 58, 0, 0, time.UTC)
+		if !u.Equal(expected) {
+			t.Errorf("Expected %v for %q, got %v", expected, v, u.UTC())
+		}
+	}
+
+	if _, _, err := parseUpdated("yesterday"); err == nil {
+		t.Error("Expected an error parsing nonsense")
+	}
+}
+
+func TestWallClockInAmbiguousHour(t *testing.T) {
+	// Clocks went back from 3am AEDT to 2am AEST on 5 April 2015, so 2:30am happened twice
+	wall := time.Date(2015, 4, 5, 2, 30, 0, 0, time.UTC)
+	got := wallClockIn(wall, feedLocation)
+
+	expected := time.Date(2015, 4, 4, 15, 30, 0, 0, time.UTC) // The earlier, daylight saving, instant
+	if !got.Equal(expected) {
+		t.Errorf("Expected %v, got %v", expected, got.UTC())
+	}
+}
+
+func TestWallClockInSkippedHour(t *testing.T) {
+	// Clocks went forward from 2am AEST to 3am AEDT on 4 October 2015, so 2:30am didn't happen
+	wall := time.Date(2015, 10, 4, 2, 30, 0, 0, time.UTC)
+	got := wallClockIn(wall, feedLocation)
+
+	expected := time.Date(2015, 10, 3, 16, 30, 0, 0, time.UTC) // 3:30am AEDT
+	if !got.Equal(expected) {
+		t.Errorf("Expected %v, got %v", expected, got.UTC())
+	}
+}
+
+func TestParseCLITime(t *testing.T) {
+	cases := map[string]time.Time{
+		"2015-12-01T10:31:00Z": time.Date(2015, 12, 1, 10, 31, 0, 0, time.UTC),
+		"2015-12-01 21:31":     time.Date(2015, 12, 1, 10, 31, 0, 0, time.UTC), // AEDT
+		"2015-12-01T21:31":     time.Date(2015, 12, 1, 10, 31, 0, 0, time.UTC),
+		"2015-12-01":           time.Date(2015, 11, 30, 13, 0, 0, 0, time.UTC),
+	}
+
+	for v, expected := range cases {
+		got, err := parseCLITime(v)
+		if err != nil {
+			t.Errorf("Error parsing %q %v", v, err)
+			continue
+		}
+		if !got.Equal(expected) {
+			t.Errorf("Expected %v for %q, got %v", expected, v, got.UTC())
+		}
+	}
+
+	if _, err := parseCLITime("last tuesday"); err == nil {
+		t.Error("Expected an error parsing nonsense")
+	}
+}
@@ -0,0 +1,13 @@
+-- +goose Up
+ALTER TABLE reports ADD COLUMN properties jsonb; -- Every property of the feed's feature
+ALTER TABLE reports ADD COLUMN details jsonb;    -- Every KEY: value pair parsed from the description
+
+CREATE INDEX report_properties_index ON reports USING GIN (properties);
+CREATE INDEX report_details_index ON reports USING GIN (details);
+
+-- +goose Down
+DROP INDEX report_properties_index;
+DROP INDEX report_details_index;
+
+ALTER TABLE reports DROP COLUMN properties;
+ALTER TABLE reports DROP COLUMN details;
@@ -0,0 +1,27 @@
+-- +goose Up
+-- The property names, description keys, geometry shapes and date formats we've seen in the feed
+CREATE TABLE feed_schema (
+  kind text NOT NULL,
+  name text NOT NULL,
+  missing boolean DEFAULT false NOT NULL, -- True when it was absent from the latest import
+  first_seen timestamp with time zone DEFAULT timezone('UTC', NOW()) NOT NULL,
+  last_seen timestamp with time zone DEFAULT timezone('UTC', NOW()) NOT NULL,
+  PRIMARY KEY (kind, name)
+);
+-- A log of the times the feed didn't look like it used to
+CREATE TABLE schema_drift_events (
+  id serial PRIMARY KEY,
+  kind text NOT NULL,
+  name text NOT NULL,
+  change text NOT NULL, -- new, missing or unparsable
+  sample text,
+  created_at timestamp with time zone DEFAULT timezone('UTC', NOW()) NOT NULL
+);
+
+CREATE INDEX schema_drift_events_created_at_index ON schema_drift_events (created_at);
+
+-- +goose Down
+DROP INDEX schema_drift_events_created_at_index;
+
+DROP TABLE schema_drift_events;
+DROP TABLE feed_schema;
@@ -0,0 +1,22 @@
+-- +goose Up
+-- The raw feeds we've imported, gzipped. One row per distinct feed body
+CREATE TABLE feed_snapshots (
+  id serial PRIMARY KEY,
+  hash text NOT NULL UNIQUE, -- SHA1 of the uncompressed body
+  source text NOT NULL,      -- URL or path the feed was fetched from
+  fetched_at timestamp with time zone NOT NULL,
+  last_fetched_at timestamp with time zone NOT NULL,
+  fetch_count integer DEFAULT 1 NOT NULL,
+  size integer NOT NULL,     -- Uncompressed size in bytes
+  body bytea NOT NULL,
+  created_at timestamp with time zone DEFAULT timezone('UTC', NOW()) NOT NULL
+);
+
+CREATE INDEX feed_snapshots_fetched_at_index ON feed_snapshots (fetched_at);
+CREATE INDEX feed_snapshots_last_fetched_at_index ON feed_snapshots (last_fetched_at);
+
+-- +goose Down
+DROP INDEX feed_snapshots_fetched_at_index;
+DROP INDEX feed_snapshots_last_fetched_at_index;
+
+DROP TABLE feed_snapshots;
@@ -0,0 +1,21 @@
+-- +goose Up
+-- What changed between a report and the incident's previous report. One row per changed field
+CREATE TABLE report_changes (
+  id serial PRIMARY KEY,
+  incident_uuid uuid REFERENCES incidents (uuid) ON DELETE RESTRICT NOT NULL,
+  report_uuid uuid REFERENCES reports (uuid) ON DELETE CASCADE NOT NULL,
+  previous_report_uuid uuid REFERENCES reports (uuid) ON DELETE CASCADE NOT NULL,
+  field text NOT NULL,
+  old_value text,
+  new_value text,
+  created_at timestamp with time zone DEFAULT timezone('UTC', NOW()) NOT NULL
+);
+
+CREATE INDEX report_changes_incident_uuid_index ON report_changes (incident_uuid);
+CREATE INDEX report_changes_report_uuid_index ON report_changes (report_uuid);
+
+-- +goose Down
+DROP INDEX report_changes_incident_uuid_index;
+DROP INDEX report_changes_report_uuid_index;
+
+DROP TABLE report_changes;
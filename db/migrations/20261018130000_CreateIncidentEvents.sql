@@ -0,0 +1,23 @@
+-- +goose Up
+-- Things that happened to incidents, such as alert level and status transitions
+CREATE TABLE incident_events (
+  id serial PRIMARY KEY, -- Also the position of the event in the stream
+  incident_uuid uuid REFERENCES incidents (uuid) ON DELETE RESTRICT NOT NULL,
+  report_uuid uuid REFERENCES reports (uuid) ON DELETE CASCADE,
+  type text NOT NULL,
+  from_value text,
+  to_value text,
+  occurred_at timestamp with time zone NOT NULL,
+  created_at timestamp with time zone DEFAULT timezone('UTC', NOW()) NOT NULL
+);
+
+CREATE INDEX incident_events_incident_uuid_index ON incident_events (incident_uuid);
+CREATE INDEX incident_events_type_index ON incident_events (type);
+CREATE INDEX incident_events_occurred_at_index ON incident_events (occurred_at);
+
+-- +goose Down
+DROP INDEX incident_events_incident_uuid_index;
+DROP INDEX incident_events_type_index;
+DROP INDEX incident_events_occurred_at_index;
+
+DROP TABLE incident_events;
@@ -0,0 +1,38 @@
+-- +goose Up
+-- Endpoints that are sent incident events
+CREATE TABLE webhooks (
+  id serial PRIMARY KEY,
+  url text NOT NULL,
+  secret text NOT NULL,               -- Key for the HMAC-SHA256 signature of each payload
+  event_types text DEFAULT '' NOT NULL,   -- Comma separated, empty for all
+  alert_levels text DEFAULT '' NOT NULL,  -- Comma separated, empty for all
+  council_areas text DEFAULT '' NOT NULL, -- Comma separated, empty for all
+  fire_only boolean DEFAULT false NOT NULL,
+  active boolean DEFAULT true NOT NULL,
+  last_event_id integer DEFAULT 0 NOT NULL, -- The last event considered for this webhook
+  created_at timestamp with time zone DEFAULT timezone('UTC', NOW()) NOT NULL,
+  updated_at timestamp with time zone DEFAULT timezone('UTC', NOW()) NOT NULL
+);
+-- The queue of payloads to send to webhooks
+CREATE TABLE webhook_deliveries (
+  id serial PRIMARY KEY,
+  webhook_id integer REFERENCES webhooks (id) ON DELETE CASCADE NOT NULL,
+  event_id integer REFERENCES incident_events (id) ON DELETE CASCADE NOT NULL,
+  payload jsonb NOT NULL,
+  status text DEFAULT 'pending' NOT NULL, -- pending, delivered or failed
+  attempts integer DEFAULT 0 NOT NULL,
+  next_attempt_at timestamp with time zone DEFAULT timezone('UTC', NOW()) NOT NULL,
+  last_status_code integer,
+  last_error text,
+  delivered_at timestamp with time zone,
+  created_at timestamp with time zone DEFAULT timezone('UTC', NOW()) NOT NULL,
+  UNIQUE (webhook_id, event_id)
+);
+
+CREATE INDEX webhook_deliveries_pending_index ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+
+-- +goose Down
+DROP INDEX webhook_deliveries_pending_index;
+
+DROP TABLE webhook_deliveries;
+DROP TABLE webhooks;
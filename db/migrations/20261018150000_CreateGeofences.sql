@@ -0,0 +1,39 @@
+-- +goose Up
+-- Places people care about. An incident is inside a geofence when a report's geometry is within buffer_m of it
+CREATE TABLE geofences (
+  id serial PRIMARY KEY,
+  name text NOT NULL,
+  geometry geometry(Geometry,4326) NOT NULL,
+  buffer_m double precision DEFAULT 0 NOT NULL,
+  created_at timestamp with time zone DEFAULT timezone('UTC', NOW()) NOT NULL
+);
+-- Whether each incident was last seen inside each geofence
+CREATE TABLE geofence_incidents (
+  geofence_id integer REFERENCES geofences (id) ON DELETE CASCADE NOT NULL,
+  incident_uuid uuid REFERENCES incidents (uuid) ON DELETE CASCADE NOT NULL,
+  inside boolean NOT NULL,
+  updated_at timestamp with time zone DEFAULT timezone('UTC', NOW()) NOT NULL,
+  PRIMARY KEY (geofence_id, incident_uuid)
+);
+-- Incidents entering and leaving geofences
+CREATE TABLE geofence_events (
+  id serial PRIMARY KEY,
+  geofence_id integer REFERENCES geofences (id) ON DELETE CASCADE NOT NULL,
+  incident_uuid uuid REFERENCES incidents (uuid) ON DELETE CASCADE NOT NULL,
+  report_uuid uuid REFERENCES reports (uuid) ON DELETE CASCADE NOT NULL,
+  type text NOT NULL, -- enter or exit
+  distance_m double precision NOT NULL,
+  occurred_at timestamp with time zone NOT NULL,
+  created_at timestamp with time zone DEFAULT timezone('UTC', NOW()) NOT NULL
+);
+
+CREATE INDEX geofence_geography_index ON geofences USING gist ((geometry::geography));
+CREATE INDEX geofence_events_geofence_id_index ON geofence_events (geofence_id);
+
+-- +goose Down
+DROP INDEX geofence_geography_index;
+DROP INDEX geofence_events_geofence_id_index;
+
+DROP TABLE geofence_events;
+DROP TABLE geofence_incidents;
+DROP TABLE geofences;
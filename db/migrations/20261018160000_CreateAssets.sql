@@ -0,0 +1,32 @@
+-- +goose Up
+-- Points of interest (towns, schools, hospitals...) loaded from GeoJSON files, grouped into layers
+CREATE TABLE assets (
+  id serial PRIMARY KEY,
+  layer text NOT NULL,
+  name text NOT NULL,
+  properties jsonb,
+  geometry geometry(Geometry,4326) NOT NULL,
+  created_at timestamp with time zone DEFAULT timezone('UTC', NOW()) NOT NULL
+);
+-- The assets nearest to each report's geometry, per layer
+CREATE TABLE report_assets (
+  report_uuid uuid REFERENCES reports (uuid) ON DELETE CASCADE NOT NULL,
+  asset_id integer REFERENCES assets (id) ON DELETE SET NULL, -- Reloading a layer keeps the annotations
+  layer text NOT NULL,
+  name text NOT NULL,
+  distance_m double precision NOT NULL, -- To the report's geometry, 0 when inside it
+  rank integer NOT NULL,                -- 1 is the nearest in its layer
+  created_at timestamp with time zone DEFAULT timezone('UTC', NOW()) NOT NULL
+);
+
+CREATE INDEX asset_layer_index ON assets (layer);
+CREATE INDEX asset_geometry_index ON assets USING gist (geometry);
+CREATE INDEX report_assets_report_uuid_index ON report_assets (report_uuid);
+
+-- +goose Down
+DROP INDEX asset_layer_index;
+DROP INDEX asset_geometry_index;
+DROP INDEX report_assets_report_uuid_index;
+
+DROP TABLE report_assets;
+DROP TABLE assets;
@@ -0,0 +1,36 @@
+-- +goose Up
+-- Administrative boundaries (LGAs, suburbs and states) loaded from local data
+CREATE TABLE boundaries (
+  id serial PRIMARY KEY,
+  kind text NOT NULL, -- lga, suburb or state
+  name text NOT NULL,
+  properties jsonb,
+  geometry geometry(Geometry,4326) NOT NULL,
+  created_at timestamp with time zone DEFAULT timezone('UTC', NOW()) NOT NULL
+);
+
+CREATE INDEX boundary_kind_index ON boundaries (kind);
+CREATE INDEX boundary_geometry_index ON boundaries USING gist (geometry);
+
+-- Where each report is according to the boundaries, rather than the feed
+ALTER TABLE reports ADD COLUMN spatial_council_area text;
+ALTER TABLE reports ADD COLUMN spatial_suburb text;
+ALTER TABLE reports ADD COLUMN spatial_state text;
+ALTER TABLE reports ADD COLUMN council_area_mismatch boolean; -- The feed's COUNCIL AREA doesn't match spatial_council_area
+ALTER TABLE reports ADD COLUMN spatially_enriched_at timestamp with time zone;
+
+CREATE INDEX report_council_area_mismatch_index ON reports (council_area_mismatch) WHERE council_area_mismatch = true;
+
+-- +goose Down
+DROP INDEX report_council_area_mismatch_index;
+
+ALTER TABLE reports DROP COLUMN spatial_council_area;
+ALTER TABLE reports DROP COLUMN spatial_suburb;
+ALTER TABLE reports DROP COLUMN spatial_state;
+ALTER TABLE reports DROP COLUMN council_area_mismatch;
+ALTER TABLE reports DROP COLUMN spatially_enriched_at;
+
+DROP INDEX boundary_kind_index;
+DROP INDEX boundary_geometry_index;
+
+DROP TABLE boundaries;
@@ -0,0 +1,25 @@
+-- +goose Up
+-- How a report's perimeter grew from the incident's previous perimeter. Reports without a polygon don't have a row
+CREATE TABLE perimeter_growth (
+  report_uuid uuid PRIMARY KEY REFERENCES reports (uuid) ON DELETE CASCADE,
+  incident_uuid uuid REFERENCES incidents (uuid) ON DELETE RESTRICT NOT NULL,
+  previous_report_uuid uuid REFERENCES reports (uuid) ON DELETE CASCADE NOT NULL,
+  area_ha double precision NOT NULL,
+  previous_area_ha double precision NOT NULL,
+  growth_ha double precision NOT NULL,
+  hours double precision NOT NULL, -- Between the reports' pubdates
+  growth_ha_per_hour double precision, -- NULL when both reports were published at the same time
+  new_area geometry(Geometry,4326), -- Burnt since the previous perimeter
+  new_area_ha double precision NOT NULL,
+  spread_m double precision NOT NULL, -- How far the perimeter's centroid moved
+  spread_bearing double precision, -- Degrees clockwise from north the centroid moved in
+  spread_direction text,
+  created_at timestamp with time zone DEFAULT timezone('UTC', NOW()) NOT NULL
+);
+
+CREATE INDEX perimeter_growth_incident_uuid_index ON perimeter_growth (incident_uuid);
+
+-- +goose Down
+DROP INDEX perimeter_growth_incident_uuid_index;
+
+DROP TABLE perimeter_growth;
@@ -0,0 +1,24 @@
+-- +goose Up
+-- The union of every perimeter of an incident, its maximum extent
+CREATE TABLE incident_footprints (
+  incident_uuid uuid PRIMARY KEY REFERENCES incidents (uuid) ON DELETE CASCADE,
+  geometry geometry(Geometry,4326) NOT NULL,
+  created_at timestamp with time zone DEFAULT timezone('UTC', NOW()) NOT NULL,
+  updated_at timestamp with time zone DEFAULT timezone('UTC', NOW()) NOT NULL
+);
+
+-- The union of every perimeter of a fire season, e.g. 2015-16 from July to June
+CREATE TABLE season_footprints (
+  season text PRIMARY KEY,
+  geometry geometry(Geometry,4326) NOT NULL,
+  created_at timestamp with time zone DEFAULT timezone('UTC', NOW()) NOT NULL,
+  updated_at timestamp with time zone DEFAULT timezone('UTC', NOW()) NOT NULL
+);
+
+CREATE INDEX incident_footprint_geometry_index ON incident_footprints USING gist (geometry);
+
+-- +goose Down
+DROP INDEX incident_footprint_geometry_index;
+
+DROP TABLE season_footprints;
+DROP TABLE incident_footprints;
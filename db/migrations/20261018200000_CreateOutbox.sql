@@ -0,0 +1,69 @@
+-- +goose Up
+-- Incident events, written by a trigger in the same transaction as the event
+CREATE TABLE outbox (
+  id bigserial PRIMARY KEY,
+  incident_uuid uuid NOT NULL,
+  type text NOT NULL, -- The incident event's type
+  payload jsonb NOT NULL,
+  created_at timestamp with time zone DEFAULT timezone('UTC', NOW()) NOT NULL
+);
+
+-- How far each sink has queued deliveries from the outbox
+CREATE TABLE outbox_sinks (
+  name text PRIMARY KEY,
+  first_outbox_id bigint DEFAULT 0 NOT NULL, -- Messages up to this were written before the sink was added
+  last_outbox_id bigint DEFAULT 0 NOT NULL,
+  created_at timestamp with time zone DEFAULT timezone('UTC', NOW()) NOT NULL,
+  updated_at timestamp with time zone DEFAULT timezone('UTC', NOW()) NOT NULL
+);
+
+CREATE TABLE outbox_deliveries (
+  sink text REFERENCES outbox_sinks (name) ON DELETE CASCADE NOT NULL,
+  outbox_id bigint REFERENCES outbox (id) ON DELETE CASCADE NOT NULL,
+  incident_uuid uuid NOT NULL,
+  status text DEFAULT 'pending' NOT NULL, -- pending or delivered
+  attempts integer DEFAULT 0 NOT NULL,
+  last_error text,
+  next_attempt_at timestamp with time zone DEFAULT timezone('UTC', NOW()) NOT NULL,
+  delivered_at timestamp with time zone,
+  PRIMARY KEY (sink, outbox_id)
+);
+
+CREATE INDEX outbox_delivery_pending_index ON outbox_deliveries (sink, incident_uuid, outbox_id) WHERE status = 'pending';
+
+-- Every incident event is written to the outbox as it's recorded, so the outbox and incident_events always agree
+-- +goose StatementBegin
+CREATE FUNCTION outbox_incident_event() RETURNS trigger AS $$
+DECLARE
+  payload jsonb;
+  report jsonb;
+BEGIN
+  payload := jsonb_build_object('id', NEW.id, 'incident_uuid', NEW.incident_uuid,
+    'rfs_id', (SELECT rfs_id FROM incidents WHERE uuid = NEW.incident_uuid), 'type', NEW.type,
+    'from', COALESCE(NEW.from_value, ''), 'to', COALESCE(NEW.to_value, ''), 'occurred_at', NEW.occurred_at, 'created_at', NEW.created_at);
+
+  IF NEW.report_uuid IS NOT NULL THEN
+    SELECT jsonb_build_object('uuid', uuid, 'title', title, 'pubdate', pubdate, 'alert_level', alert_level, 'status', status,
+        'council_area', council_area, 'fire', fire, 'size', size)
+      INTO report FROM reports WHERE uuid = NEW.report_uuid;
+    payload := payload || jsonb_build_object('report_uuid', NEW.report_uuid, 'report', report);
+  END IF;
+
+  INSERT INTO outbox(incident_uuid, type, payload) VALUES(NEW.incident_uuid, NEW.type, payload);
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE TRIGGER outbox_incident_event_inserted AFTER INSERT ON incident_events FOR EACH ROW EXECUTE PROCEDURE outbox_incident_event();
+
+-- +goose Down
+DROP TRIGGER outbox_incident_event_inserted ON incident_events;
+
+DROP FUNCTION outbox_incident_event();
+
+DROP INDEX outbox_delivery_pending_index;
+
+DROP TABLE outbox_deliveries;
+DROP TABLE outbox_sinks;
+DROP TABLE outbox;
@@ -0,0 +1,21 @@
+-- +goose Up
+-- Reports imported before feed times were parsed in the feed's timezone had their pubdate stored as though the
+-- feed's wall clock time were UTC. They're the reports without raw properties, which were added in the same release.
+-- The RFS feed is in Australia/Sydney
+UPDATE reports SET pubdate = (pubdate AT TIME ZONE 'UTC') AT TIME ZONE 'Australia/Sydney'
+  WHERE properties IS NULL;
+
+-- Incidents are current from their first report to their last
+UPDATE incidents SET current_from = tstzrange(r.first, r.last, '[]')
+  FROM (SELECT incident_uuid, MIN(pubdate) AS first, MAX(pubdate) AS last FROM reports GROUP BY incident_uuid) r
+  WHERE incidents.uuid = r.incident_uuid
+    AND EXISTS (SELECT 1 FROM reports WHERE reports.incident_uuid = incidents.uuid AND reports.properties IS NULL);
+
+-- +goose Down
+UPDATE reports SET pubdate = (pubdate AT TIME ZONE 'Australia/Sydney') AT TIME ZONE 'UTC'
+  WHERE properties IS NULL;
+
+UPDATE incidents SET current_from = tstzrange(r.first, r.last, '[]')
+  FROM (SELECT incident_uuid, MIN(pubdate) AS first, MAX(pubdate) AS last FROM reports GROUP BY incident_uuid) r
+  WHERE incidents.uuid = r.incident_uuid
+    AND EXISTS (SELECT 1 FROM reports WHERE reports.incident_uuid = incidents.uuid AND reports.properties IS NULL);
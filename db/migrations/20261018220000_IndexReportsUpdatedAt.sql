@@ -0,0 +1,6 @@
+-- +goose Up
+-- Tiles are versioned by the latest change to a report in place
+CREATE INDEX report_updated_at_index ON reports (updated_at);
+
+-- +goose Down
+DROP INDEX report_updated_at_index;
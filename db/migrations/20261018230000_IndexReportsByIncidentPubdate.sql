@@ -0,0 +1,6 @@
+-- +goose Up
+-- Finds each incident's latest report, for the current incidents and those current at a time
+CREATE INDEX reports_incident_uuid_pubdate_index ON reports (incident_uuid, pubdate DESC, created_at DESC);
+
+-- +goose Down
+DROP INDEX reports_incident_uuid_pubdate_index;
@@ -0,0 +1,10 @@
+-- +goose Up
+-- When a report was annotated with its nearest assets, whether or not any were near it
+ALTER TABLE reports ADD COLUMN assets_annotated_at timestamp with time zone;
+
+UPDATE reports SET assets_annotated_at = ra.created_at
+  FROM (SELECT report_uuid, MIN(created_at) AS created_at FROM report_assets GROUP BY report_uuid) ra
+  WHERE reports.uuid = ra.report_uuid;
+
+-- +goose Down
+ALTER TABLE reports DROP COLUMN assets_annotated_at;
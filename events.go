@@ -0,0 +1,228 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Types of incident event
+const (
+	eventIncidentCreated       = "incident_created"
+	eventReportInserted        = "report_inserted"
+	eventIncidentResolved      = "incident_resolved" // No longer in the feed
+	eventIncidentReopened      = "incident_reopened" // Back in the feed after being resolved
+	eventAlertLevelEscalated   = "alert_level_escalated"
+	eventAlertLevelDeescalated = "alert_level_deescalated"
+	eventStatusChanged         = "status_changed"
+)
+
+// RFS alert levels, least to most severe
+var alertLevels = []string{"Not Applicable", "Advice", "Watch and Act", "Emergency Warning"}
+
+type IncidentEvent struct {
+	Id           int       `json:"id"`
+	IncidentUUID string    `json:"incident_uuid"`
+	RFSId        int       `json:"rfs_id"`
+	ReportUUID   string    `json:"report_uuid,omitempty"`
+	Type         string    `json:"type"`
+	From         string    `json:"from"`
+	To           string    `json:"to"`
+	OccurredAt   time.Time `json:"occurred_at"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// How severe an alert level is. Unknown and missing levels are as severe as Not Applicable
+func alertLevelRank(level string) int {
+	for i, l := range alertLevels {
+		if strings.EqualFold(l, strings.TrimSpace(level)) {
+			return i
+		}
+	}
+	return 0
+}
+
+// Turns alert level and status changes into transition events. They occurred when the report was published
+func transitionEvents(changes []ReportChange, r Report) []IncidentEvent {
+	events := []IncidentEvent{}
+
+	for _, c := range changes {
+		e := IncidentEvent{
+			IncidentUUID: r.IncidentUUID,
+			ReportUUID:   r.UUID,
+			From:         c.From,
+			To:           c.To,
+			OccurredAt:   r.Pubdate,
+		}
+
+		switch c.Field {
+		case "alert_level":
+			from, to := alertLevelRank(c.From), alertLevelRank(c.To)
+			if to > from {
+				e.Type = eventAlertLevelEscalated
+			} else if to < from {
+				e.Type = eventAlertLevelDeescalated
+			} else {
+				// Just a change in spelling
+				continue
+			}
+		case "status":
+			if strings.EqualFold(strings.TrimSpace(c.From), strings.TrimSpace(c.To)) {
+				// Just a change in spelling
+				continue
+			}
+			e.Type = eventStatusChanged
+		default:
+			continue
+		}
+
+		events = append(events, e)
+	}
+
+	return events
+}
+
+// Stores the alert level and status transitions among a report's changes
+func RecordTransitions(q dbQueryer, changes []ReportChange, r Report) ([]IncidentEvent, error) {
+	events := transitionEvents(changes, r)
+
+	for i := range events {
+		err := events[i].Insert(q)
+		if err != nil {
+			return events, err
+		}
+	}
+
+	return events, nil
+}
+
+// Inserts the event into the database, or with the change it's about in a transaction
+func (e *IncidentEvent) Insert(q dbQueryer) error {
+	stmt, err := q.Prepare(`INSERT INTO incident_events(incident_uuid, report_uuid, type, from_value, to_value, occurred_at)
+    VALUES($1, NULLIF($2, '')::uuid, $3, $4, $5, $6)
+    RETURNING id, created_at`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	return stmt.QueryRow(e.IncidentUUID, e.ReportUUID, e.Type, e.From, e.To, e.OccurredAt.UTC().Format(time.RFC3339)).Scan(&e.Id, &e.CreatedAt)
+}
+
+// Which events to fetch
+type EventQuery struct {
+	Since int      // Only events after this id
+	Types []string // Only events of these types, empty for all
+	RFSId int      // Only events for this incident, 0 for all
+	Limit int
+}
+
+// The id of the most recently recorded event, 0 when there aren't any
+func GetLatestEventId() (int, error) {
+	var id int
+	err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM incident_events`).Scan(&id)
+	return id, err
+}
+
+// Fetches events in the order they were recorded
+func GetIncidentEvents(q EventQuery) ([]IncidentEvent, error) {
+	events := []IncidentEvent{}
+
+	if q.Limit <= 0 {
+		q.Limit = 100
+	}
+
+	rows, err := db.Query(`SELECT e.id, e.incident_uuid, i.rfs_id, COALESCE(e.report_uuid::text, ''), e.type, COALESCE(e.from_value, ''), COALESCE(e.to_value, ''), e.occurred_at, e.created_at
+    FROM incident_events e JOIN incidents i ON i.uuid = e.incident_uuid
+    WHERE e.id > $1 AND ($2 = '' OR e.type = ANY(string_to_array($2, ','))) AND ($3 = 0 OR i.rfs_id = $3)
+    ORDER BY e.id
+    LIMIT $4`, q.Since, strings.Join(q.Types, ","), q.RFSId, q.Limit)
+	if err != nil {
+		return events, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e := IncidentEvent{}
+		err = rows.Scan(&e.Id, &e.IncidentUUID, &e.RFSId, &e.ReportUUID, &e.Type, &e.From, &e.To, &e.OccurredAt, &e.CreatedAt)
+		if err != nil {
+			return events, err
+		}
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+// An event along with the report it relates to, as sent to anyone following events
+type EventPayload struct {
+	Event  IncidentEvent  `json:"event"`
+	Report *ReportSummary `json:"report"`
+}
+
+// The interesting parts of a report
+type ReportSummary struct {
+	UUID              string    `json:"uuid"`
+	Guid              string    `json:"guid"`
+	Title             string    `json:"title"`
+	Link              string    `json:"link"`
+	Pubdate           time.Time `json:"pubdate"`
+	AlertLevel        string    `json:"alert_level"`
+	Location          string    `json:"location"`
+	CouncilArea       string    `json:"council_area"`
+	Status            string    `json:"status"`
+	FireType          string    `json:"fire_type"`
+	Fire              bool      `json:"fire"`
+	Size              string    `json:"size"`
+	ResponsibleAgency string    `json:"responsible_agency"`
+}
+
+func reportSummary(r Report) *ReportSummary {
+	return &ReportSummary{
+		UUID:              r.UUID,
+		Guid:              r.Guid,
+		Title:             r.Title,
+		Link:              r.Link,
+		Pubdate:           r.Pubdate,
+		AlertLevel:        r.AlertLevel,
+		Location:          r.Location,
+		CouncilArea:       r.CouncilArea,
+		Status:            r.Status,
+		FireType:          r.FireType,
+		Fire:              r.Fire,
+		Size:              r.Size,
+		ResponsibleAgency: r.ResponsibleAgency,
+	}
+}
+
+// Builds the payload for an event. Events without a report (e.g. an incident being resolved) get the incident's latest report
+func GetEventPayload(e IncidentEvent) (EventPayload, error) {
+	p := EventPayload{Event: e}
+
+	var r Report
+	var err error
+	if e.ReportUUID != "" {
+		r, err = GetReport(e.ReportUUID)
+	} else {
+		r, err = GetLatestIncidentReport(e.IncidentUUID)
+	}
+	if err == sql.ErrNoRows {
+		// The incident was created, but its first report hasn't been inserted yet
+		return p, nil
+	}
+	if err != nil {
+		return p, err
+	}
+
+	p.Report = reportSummary(r)
+	return p, nil
+}
+
+// Writes events for a human
+func PrintIncidentEvents(w io.Writer, events []IncidentEvent) {
+	for _, e := range events {
+		fmt.Fprintf(w, "%d  %s  %d  %s: %s -> %s\n", e.Id, e.OccurredAt.In(feedLocation).Format("2006-01-02 15:04"), e.RFSId, e.Type, e.From, e.To)
+	}
+}
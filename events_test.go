@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTransitionEvents(t *testing.T) {
+	r := Report{UUID: "b", IncidentUUID: "i", Pubdate: time.Date(2015, 12, 1, 10, 31, 0, 0, time.UTC)}
+	changes := []ReportChange{
+		{Field: "alert_level", From: "Advice", To: "Watch and Act"},
+		{Field: "status", From: "Out of control", To: "Being controlled"},
+		{Field: "size", From: "10 ha", To: "20 ha"},
+		{Field: "alert_level", From: "Emergency Warning", To: "advice"},
+		{Field: "alert_level", From: "Advice", To: "ADVICE"},
+		{Field: "status", From: "Being controlled", To: " being Controlled "},
+	}
+
+	events := transitionEvents(changes, r)
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events, got %v", events)
+	}
+
+	expected := []string{eventAlertLevelEscalated, eventStatusChanged, eventAlertLevelDeescalated}
+	for i, e := range events {
+		if e.Type != expected[i] {
+			t.Errorf("Expected event %d to be %s, got %s", i, expected[i], e.Type)
+		}
+		if !e.OccurredAt.Equal(r.Pubdate) || e.ReportUUID != "b" || e.IncidentUUID != "i" {
+			t.Errorf("Event isn't from the report %v", e)
+		}
+	}
+}
+
+func TestAlertLevelRank(t *testing.T) {
+	if alertLevelRank("Emergency Warning") <= alertLevelRank("Watch and Act") {
+		t.Error("Expected Emergency Warning to be more severe than Watch and Act")
+	}
+	if alertLevelRank("") != alertLevelRank("Not Applicable") {
+		t.Error("Expected a missing alert level to be as severe as Not Applicable")
+	}
+}
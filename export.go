@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Export formats
+const (
+	exportKML        = "kml"
+	exportGeoPackage = "gpkg"
+)
+
+// An incident's reports in a timeline, in the order they were published
+type incidentTimeline struct {
+	RFSId   int
+	Entries []TimelineEntry
+}
+
+func (i incidentTimeline) Latest() TimelineEntry {
+	return i.Entries[len(i.Entries)-1]
+}
+
+// Groups a timeline's reports by incident, in the order the incidents first appear
+func groupTimeline(entries []TimelineEntry) []incidentTimeline {
+	incidents := []incidentTimeline{}
+	index := make(map[string]int)
+	for _, e := range entries {
+		i, ok := index[e.Report.IncidentUUID]
+		if !ok {
+			i = len(incidents)
+			index[e.Report.IncidentUUID] = i
+			incidents = append(incidents, incidentTimeline{RFSId: e.RFSId})
+		}
+		incidents[i].Entries = append(incidents[i].Entries, e)
+	}
+	return incidents
+}
+
+// The format to export to: the one given, or the one the path's extension says
+func exportFormat(path, format string) (string, error) {
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	}
+	switch format {
+	case exportKML, exportGeoPackage:
+		return format, nil
+	case "geopackage":
+		return exportGeoPackage, nil
+	}
+	return "", fmt.Errorf("Unknown export format %q, use kml or gpkg", format)
+}
+
+// Writes the incidents with reports published between two times, and the history of those reports
+func WriteExport(w io.Writer, from, to time.Time, format string) error {
+	entries, err := GetTimeline(from, to)
+	if err != nil {
+		return err
+	}
+	incidents := groupTimeline(entries)
+
+	switch format {
+	case exportKML:
+		return writeKML(w, fmt.Sprintf("Incidents %s to %s", from.In(feedLocation).Format("2006-01-02 15:04"), to.In(feedLocation).Format("2006-01-02 15:04")), incidents)
+	case exportGeoPackage:
+		return writeGeoPackage(w, incidents)
+	}
+	return fmt.Errorf("Unknown export format %q, use kml or gpkg", format)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/paulmach/go.geojson"
+	"io"
+	"time"
+)
+
+// Fire seasons run from July to June, so summer isn't split in two
+const fireSeasonStartMonth = time.July
+
+type Footprint struct {
+	Season       string // Empty for an incident's footprint
+	IncidentUUID string // Empty for a season's footprint
+	Geometry     *geojson.Geometry
+	AreaHa       float64
+	UpdatedAt    time.Time
+}
+
+// The fire season a time's in, e.g. "2015-16" for December 2015 or February 2016
+func fireSeason(t time.Time) string {
+	t = t.In(feedLocation)
+	start := t.Year()
+	if t.Month() < fireSeasonStartMonth {
+		start--
+	}
+	return fmt.Sprintf("%d-%02d", start, (start+1)%100)
+}
+
+// Adds the perimeters of fires' reports to their incident's and season's footprints.
+// Reports that aren't fires, or don't have a polygon, don't change anything
+func UpdateFootprints(q dbQueryer, reports []Report) error {
+	// Only the polygons of a report's geometry are burnt, the point's where it started
+	incidentStmt, err := q.Prepare(`INSERT INTO incident_footprints(incident_uuid, geometry)
+    SELECT incident_uuid, ST_MakeValid(ST_CollectionExtract(geometry, 3)) FROM reports
+    WHERE uuid = $1 AND fire = true AND NOT ST_IsEmpty(ST_CollectionExtract(geometry, 3))
+    ON CONFLICT (incident_uuid) DO UPDATE SET geometry = ST_Union(incident_footprints.geometry, EXCLUDED.geometry),
+      updated_at = (NOW() AT TIME ZONE 'UTC')`)
+	if err != nil {
+		return err
+	}
+	defer incidentStmt.Close()
+
+	seasonStmt, err := q.Prepare(`INSERT INTO season_footprints(season, geometry)
+    SELECT $2, ST_MakeValid(ST_CollectionExtract(geometry, 3)) FROM reports
+    WHERE uuid = $1 AND fire = true AND NOT ST_IsEmpty(ST_CollectionExtract(geometry, 3))
+    ON CONFLICT (season) DO UPDATE SET geometry = ST_Union(season_footprints.geometry, EXCLUDED.geometry),
+      updated_at = (NOW() AT TIME ZONE 'UTC')`)
+	if err != nil {
+		return err
+	}
+	defer seasonStmt.Close()
+
+	for _, r := range reports {
+		if r.UUID == "" {
+			continue
+		}
+		_, err = incidentStmt.Exec(r.UUID)
+		if err != nil {
+			return err
+		}
+		_, err = seasonStmt.Exec(r.UUID, fireSeason(r.Pubdate))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Rebuilds every footprint from the reports, e.g. after reprocessing them. Returns how many reports were added.
+// It's one transaction, so footprints are never seen empty or half built
+func RebuildFootprints() (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT uuid, pubdate FROM reports
+    WHERE fire = true AND NOT ST_IsEmpty(ST_CollectionExtract(geometry, 3))
+    ORDER BY pubdate, created_at`)
+	if err != nil {
+		return 0, err
+	}
+
+	reports := []Report{}
+	for rows.Next() {
+		r := Report{}
+		err = rows.Scan(&r.UUID, &r.Pubdate)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		reports = append(reports, r)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// Unions only ever grow, so start again
+	_, err = tx.Exec(`DELETE FROM incident_footprints`)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(`DELETE FROM season_footprints`)
+	if err != nil {
+		return 0, err
+	}
+
+	err = UpdateFootprints(tx, reports)
+	if err != nil {
+		return 0, err
+	}
+	return len(reports), tx.Commit()
+}
+
+func scanFootprint(row rowScanner) (Footprint, error) {
+	f := Footprint{}
+	var geom string
+	err := row.Scan(&f.Season, &f.IncidentUUID, &geom, &f.AreaHa, &f.UpdatedAt)
+	if err != nil {
+		return f, err
+	}
+	f.Geometry, err = geojson.UnmarshalGeometry([]byte(geom))
+	return f, err
+}
+
+// Fetches a fire season's footprint
+func GetSeasonFootprint(season string) (Footprint, error) {
+	stmt, err := db.Prepare(`SELECT season, '', ST_AsGeoJSON(geometry), ST_Area(geometry::geography) / 10000, updated_at
+    FROM season_footprints WHERE season = $1`)
+	if err != nil {
+		return Footprint{}, err
+	}
+	defer stmt.Close()
+
+	return scanFootprint(stmt.QueryRow(season))
+}
+
+// Fetches an incident's footprint
+func GetIncidentFootprint(incidentUUID string) (Footprint, error) {
+	stmt, err := db.Prepare(`SELECT '', incident_uuid, ST_AsGeoJSON(geometry), ST_Area(geometry::geography) / 10000, updated_at
+    FROM incident_footprints WHERE incident_uuid = $1`)
+	if err != nil {
+		return Footprint{}, err
+	}
+	defer stmt.Close()
+
+	return scanFootprint(stmt.QueryRow(incidentUUID))
+}
+
+// Fetches the footprint of every season, without their geometries, most recent first
+func GetSeasonFootprints() ([]Footprint, error) {
+	footprints := []Footprint{}
+
+	rows, err := db.Query(`SELECT season, ST_Area(geometry::geography) / 10000, updated_at FROM season_footprints ORDER BY season DESC`)
+	if err != nil {
+		return footprints, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		f := Footprint{}
+		err = rows.Scan(&f.Season, &f.AreaHa, &f.UpdatedAt)
+		if err != nil {
+			return footprints, err
+		}
+		footprints = append(footprints, f)
+	}
+
+	return footprints, rows.Err()
+}
+
+// The footprint as a feature collection of one feature
+func (f *Footprint) FeatureCollection() *geojson.FeatureCollection {
+	feature := geojson.NewFeature(f.Geometry)
+	if f.Season != "" {
+		feature.SetProperty("season", f.Season)
+	}
+	if f.IncidentUUID != "" {
+		feature.SetProperty("incident_uuid", f.IncidentUUID)
+	}
+	feature.SetProperty("area_ha", f.AreaHa)
+	feature.SetProperty("updated_at", f.UpdatedAt.UTC().Format(time.RFC3339))
+
+	fc := geojson.NewFeatureCollection()
+	fc.AddFeature(feature)
+	return fc
+}
+
+// Writes a fire season's footprint as GeoJSON
+func WriteSeasonFootprint(w io.Writer, season string) error {
+	f, err := GetSeasonFootprint(season)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("No footprint for the %s season", season)
+	}
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(f.FeatureCollection())
+}
+
+// Writes an incident's footprint as GeoJSON
+func WriteIncidentFootprint(w io.Writer, rfsId int) error {
+	uuid, err := GetIncidentUUIDForRFSId(rfsId)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("No incident with RFS id %d", rfsId)
+	}
+	if err != nil {
+		return err
+	}
+
+	f, err := GetIncidentFootprint(uuid)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("Incident %d doesn't have any perimeters", rfsId)
+	}
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(f.FeatureCollection())
+}
+
+// Writes the seasons' footprints for a human
+func PrintSeasonFootprints(w io.Writer, footprints []Footprint) {
+	for _, f := range footprints {
+		fmt.Fprintf(w, "%s  %.1f ha  updated %s\n", f.Season, f.AreaHa, f.UpdatedAt.In(feedLocation).Format("2006-01-02 15:04"))
+	}
+}
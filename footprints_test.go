@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFireSeason(t *testing.T) {
+	cases := []struct {
+		t        time.Time
+		expected string
+	}{
+		{time.Date(2015, 12, 25, 12, 0, 0, 0, time.UTC), "2015-16"},
+		{time.Date(2016, 2, 1, 12, 0, 0, 0, time.UTC), "2015-16"},
+		{time.Date(2016, 7, 1, 12, 0, 0, 0, time.UTC), "2016-17"},
+		{time.Date(1999, 8, 1, 12, 0, 0, 0, time.UTC), "1999-00"},
+		// It's already July in Sydney
+		{time.Date(2016, 6, 30, 20, 0, 0, 0, time.UTC), "2016-17"},
+	}
+
+	for _, c := range cases {
+		if got := fireSeason(c.t); got != c.expected {
+			t.Errorf("Expected %v to be in the %s season, got %s", c.t, c.expected, got)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"fmt"
+	"github.com/paulmach/go.geojson"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Types of geofence event
+const (
+	geofenceEnter = "enter"
+	geofenceExit  = "exit"
+)
+
+type Geofence struct {
+	Id        int
+	Name      string
+	Geometry  *geojson.Geometry
+	BufferM   float64 // How close, in metres, a report needs to be to be inside
+	CreatedAt time.Time
+}
+
+type GeofenceEvent struct {
+	Id           int
+	GeofenceId   int
+	GeofenceName string
+	IncidentUUID string
+	RFSId        int
+	ReportUUID   string
+	Type         string
+	DistanceM    float64
+	OccurredAt   time.Time
+}
+
+// What, if anything, happened when an incident was inside or not and now is or isn't
+func geofenceTransition(wasInside, inside bool) string {
+	if inside && !wasInside {
+		return geofenceEnter
+	}
+	if !inside && wasInside {
+		return geofenceExit
+	}
+	return ""
+}
+
+// Checks newly inserted reports against every geofence, recording incidents entering and leaving them.
+// An incident only enters (or exits) a geofence once, however many reports in a row are inside (or outside) it
+func CheckGeofences(reports []Report) ([]GeofenceEvent, error) {
+	events := []GeofenceEvent{}
+
+	for _, r := range reports {
+		if r.UUID == "" {
+			continue
+		}
+
+		rows, err := db.Query(`SELECT g.id, g.name,
+      ST_Distance(g.geometry::geography, r.geometry::geography),
+      ST_DWithin(g.geometry::geography, r.geometry::geography, g.buffer_m),
+      COALESCE(gi.inside, false)
+    FROM geofences g
+    JOIN reports r ON r.uuid = $1
+    LEFT JOIN geofence_incidents gi ON gi.geofence_id = g.id AND gi.incident_uuid = r.incident_uuid
+    WHERE r.geometry IS NOT NULL`, r.UUID)
+		if err != nil {
+			return events, err
+		}
+
+		checked := []GeofenceEvent{}
+		inside := make(map[int]bool)
+		for rows.Next() {
+			e := GeofenceEvent{IncidentUUID: r.IncidentUUID, ReportUUID: r.UUID, OccurredAt: r.Pubdate}
+			var isInside, wasInside bool
+			err = rows.Scan(&e.GeofenceId, &e.GeofenceName, &e.DistanceM, &isInside, &wasInside)
+			if err != nil {
+				rows.Close()
+				return events, err
+			}
+			e.Type = geofenceTransition(wasInside, isInside)
+			inside[e.GeofenceId] = isInside
+			checked = append(checked, e)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return events, err
+		}
+
+		for _, e := range checked {
+			err = SetGeofenceIncidentInside(e.GeofenceId, r.IncidentUUID, inside[e.GeofenceId])
+			if err != nil {
+				return events, err
+			}
+			if e.Type == "" {
+				continue
+			}
+			err = e.Insert()
+			if err != nil {
+				return events, err
+			}
+			events = append(events, e)
+		}
+	}
+
+	return events, nil
+}
+
+// Turns the geofences a resolved incident was inside into exits. It's no longer in the feed, so it's no longer anywhere
+func geofenceExits(inside []GeofenceEvent, at time.Time) []GeofenceEvent {
+	exits := []GeofenceEvent{}
+	for _, e := range inside {
+		e.Type = geofenceTransition(true, false)
+		e.OccurredAt = at
+		exits = append(exits, e)
+	}
+	return exits
+}
+
+// Records a resolved incident exiting every geofence it was inside. The exits refer to its latest report,
+// with how far that was from each geofence
+func ExitGeofences(incidentUUID string, at time.Time) ([]GeofenceEvent, error) {
+	events := []GeofenceEvent{}
+
+	rows, err := db.Query(`SELECT g.id, g.name, r.uuid, COALESCE(ST_Distance(g.geometry::geography, r.geometry::geography), 0)
+    FROM geofence_incidents gi
+    JOIN geofences g ON g.id = gi.geofence_id
+    JOIN LATERAL (SELECT * FROM reports WHERE reports.incident_uuid = gi.incident_uuid ORDER BY pubdate DESC, created_at DESC LIMIT 1) r ON true
+    WHERE gi.incident_uuid = $1 AND gi.inside = true`, incidentUUID)
+	if err != nil {
+		return events, err
+	}
+
+	inside := []GeofenceEvent{}
+	for rows.Next() {
+		e := GeofenceEvent{IncidentUUID: incidentUUID}
+		err = rows.Scan(&e.GeofenceId, &e.GeofenceName, &e.ReportUUID, &e.DistanceM)
+		if err != nil {
+			rows.Close()
+			return events, err
+		}
+		inside = append(inside, e)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return events, err
+	}
+
+	for _, e := range geofenceExits(inside, at) {
+		err = SetGeofenceIncidentInside(e.GeofenceId, incidentUUID, false)
+		if err != nil {
+			return events, err
+		}
+		err = e.Insert()
+		if err != nil {
+			return events, err
+		}
+		events = append(events, e)
+	}
+
+	return events, nil
+}
+
+func SetGeofenceIncidentInside(geofenceId int, incidentUUID string, inside bool) error {
+	stmt, err := db.Prepare(`INSERT INTO geofence_incidents(geofence_id, incident_uuid, inside) VALUES($1, $2, $3)
+    ON CONFLICT (geofence_id, incident_uuid) DO UPDATE SET inside = EXCLUDED.inside, updated_at = (NOW() AT TIME ZONE 'UTC')`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(geofenceId, incidentUUID, inside)
+	return err
+}
+
+// Inserts the event into the database
+func (e *GeofenceEvent) Insert() error {
+	stmt, err := db.Prepare(`INSERT INTO geofence_events(geofence_id, incident_uuid, report_uuid, type, distance_m, occurred_at)
+    VALUES($1, $2, $3, $4, $5, $6)
+    RETURNING id`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	return stmt.QueryRow(e.GeofenceId, e.IncidentUUID, e.ReportUUID, e.Type, e.DistanceM, e.OccurredAt.UTC().Format(time.RFC3339)).Scan(&e.Id)
+}
+
+// Inserts the geofence into the database
+func (g *Geofence) Insert() error {
+	geom, err := g.Geometry.MarshalJSON()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := db.Prepare(`INSERT INTO geofences(name, geometry, buffer_m) VALUES($1, ST_SetSRID(ST_GeomFromGeoJSON($2), 4326), $3)
+    RETURNING id, created_at`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	return stmt.QueryRow(g.Name, geom, g.BufferM).Scan(&g.Id, &g.CreatedAt)
+}
+
+func DeleteGeofence(id int) error {
+	stmt, err := db.Prepare(`DELETE FROM geofences WHERE id = $1`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("No geofence with id %d", id)
+	}
+	return nil
+}
+
+func GetGeofences() ([]Geofence, error) {
+	geofences := []Geofence{}
+
+	rows, err := db.Query(`SELECT id, name, ST_AsGeoJSON(geometry), buffer_m, created_at FROM geofences ORDER BY id`)
+	if err != nil {
+		return geofences, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		g := Geofence{}
+		var geom string
+		err = rows.Scan(&g.Id, &g.Name, &geom, &g.BufferM, &g.CreatedAt)
+		if err != nil {
+			return geofences, err
+		}
+		g.Geometry, err = geojson.UnmarshalGeometry([]byte(geom))
+		if err != nil {
+			return geofences, err
+		}
+		geofences = append(geofences, g)
+	}
+
+	return geofences, rows.Err()
+}
+
+// Fetches the most recent geofence events, optionally only for one geofence
+func GetGeofenceEvents(geofenceId, limit int) ([]GeofenceEvent, error) {
+	events := []GeofenceEvent{}
+
+	rows, err := db.Query(`SELECT e.id, e.geofence_id, g.name, e.incident_uuid, i.rfs_id, e.report_uuid, e.type, e.distance_m, e.occurred_at
+    FROM geofence_events e
+    JOIN geofences g ON g.id = e.geofence_id
+    JOIN incidents i ON i.uuid = e.incident_uuid
+    WHERE $1 = 0 OR e.geofence_id = $1
+    ORDER BY e.id DESC
+    LIMIT $2`, geofenceId, limit)
+	if err != nil {
+		return events, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e := GeofenceEvent{}
+		err = rows.Scan(&e.Id, &e.GeofenceId, &e.GeofenceName, &e.IncidentUUID, &e.RFSId, &e.ReportUUID, &e.Type, &e.DistanceM, &e.OccurredAt)
+		if err != nil {
+			return events, err
+		}
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+// Parses "lon,lat" into a point
+func parsePoint(s string) (*geojson.Geometry, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Expected a point as lon,lat, got %q", s)
+	}
+	lon, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil {
+		return nil, err
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil {
+		return nil, err
+	}
+	if lon < -180 || lon > 180 || lat < -90 || lat > 90 {
+		return nil, fmt.Errorf("Point %q is out of range, it should be lon,lat", s)
+	}
+	return geojson.NewPointGeometry([]float64{lon, lat}), nil
+}
+
+// Reads a geometry from a GeoJSON file. It can be a geometry, a feature or the first feature of a collection
+func geometryFromGeoJSON(data []byte) (*geojson.Geometry, error) {
+	if fc, err := geojson.UnmarshalFeatureCollection(data); err == nil && fc.Type == "FeatureCollection" {
+		if len(fc.Features) == 0 {
+			return nil, fmt.Errorf("Feature collection has no features")
+		}
+		return fc.Features[0].Geometry, nil
+	}
+	if f, err := geojson.UnmarshalFeature(data); err == nil && f.Type == "Feature" {
+		return f.Geometry, nil
+	}
+	return geojson.UnmarshalGeometry(data)
+}
+
+// Writes geofences for a human
+func PrintGeofences(w io.Writer, geofences []Geofence) {
+	for _, g := range geofences {
+		fmt.Fprintf(w, "%d  %s  %s within %.1f km\n", g.Id, g.Name, g.Geometry.Type, g.BufferM/1000)
+	}
+}
+
+// Writes geofence events for a human
+func PrintGeofenceEvents(w io.Writer, events []GeofenceEvent) {
+	for _, e := range events {
+		fmt.Fprintf(w, "%s  %s  incident %d %s, %.1f km away\n", e.OccurredAt.In(feedLocation).Format("2006-01-02 15:04"), e.GeofenceName, e.RFSId, e.Type, e.DistanceM/1000)
+	}
+}
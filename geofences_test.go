@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGeofenceTransition(t *testing.T) {
+	cases := []struct {
+		wasInside, inside bool
+		expected          string
+	}{
+		{false, true, geofenceEnter},
+		{true, false, geofenceExit},
+		{true, true, ""},
+		{false, false, ""},
+	}
+
+	for _, c := range cases {
+		if got := geofenceTransition(c.wasInside, c.inside); got != c.expected {
+			t.Errorf("Expected %q going from %t to %t, got %q", c.expected, c.wasInside, c.inside, got)
+		}
+	}
+}
+
+func TestGeofenceExits(t *testing.T) {
+	at := time.Date(2015, 12, 2, 9, 0, 0, 0, time.UTC)
+	inside := []GeofenceEvent{
+		{GeofenceId: 1, GeofenceName: "Katoomba", IncidentUUID: "i", ReportUUID: "r", DistanceM: 1200},
+		{GeofenceId: 2, GeofenceName: "Blue Mountains", IncidentUUID: "i", ReportUUID: "r"},
+	}
+
+	exits := geofenceExits(inside, at)
+	if len(exits) != 2 {
+		t.Fatalf("Expected an exit from each geofence, got %v", exits)
+	}
+	for i, e := range exits {
+		if e.Type != geofenceExit || !e.OccurredAt.Equal(at) || e.GeofenceId != inside[i].GeofenceId || e.ReportUUID != "r" {
+			t.Errorf("Unexpected exit %+v", e)
+		}
+	}
+	if exits[0].DistanceM != 1200 {
+		t.Errorf("Expected the distance from the latest report, got %v", exits[0].DistanceM)
+	}
+
+	if exits := geofenceExits([]GeofenceEvent{}, at); len(exits) != 0 {
+		t.Errorf("Expected no exits for an incident outside every geofence, got %v", exits)
+	}
+}
+
+func TestParsePoint(t *testing.T) {
+	p, err := parsePoint("150.31, -33.71")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.IsPoint() || p.Point[0] != 150.31 || p.Point[1] != -33.71 {
+		t.Errorf("Unexpected point %v", p.Point)
+	}
+
+	for _, s := range []string{"150.31", "a,b", "-33.71,190"} {
+		if _, err := parsePoint(s); err == nil {
+			t.Errorf("Expected an error parsing %q", s)
+		}
+	}
+}
+
+func TestGeometryFromGeoJSON(t *testing.T) {
+	inputs := []string{
+		`{"type":"Point","coordinates":[150,-33]}`,
+		`{"type":"Feature","properties":{},"geometry":{"type":"Point","coordinates":[150,-33]}}`,
+		`{"type":"FeatureCollection","features":[{"type":"Feature","properties":{},"geometry":{"type":"Point","coordinates":[150,-33]}}]}`,
+	}
+	for _, input := range inputs {
+		g, err := geometryFromGeoJSON([]byte(input))
+		if err != nil {
+			t.Errorf("Unable to read %s: %v", input, err)
+			continue
+		}
+		if !g.IsPoint() {
+			t.Errorf("Expected a point from %s, got %s", input, g.Type)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/paulmach/go.geojson"
+	"io"
+	"math"
+	"time"
+)
+
+// In a GeoPackage's header: "GPKG" and version 1.2
+const (
+	gpkgApplicationId = 0x47504b47
+	gpkgUserVersion   = 10200
+)
+
+// GeoPackage's DATETIME format
+const gpkgTimeFormat = "2006-01-02T15:04:05.000Z"
+
+const gpkgWGS84 = `GEOGCS["WGS 84",DATUM["WGS_1984",SPHEROID["WGS 84",6378137,298.257223563,AUTHORITY["EPSG","7030"]],AUTHORITY["EPSG","6326"]],PRIMEM["Greenwich",0,AUTHORITY["EPSG","8901"]],UNIT["degree",0.0174532925199433,AUTHORITY["EPSG","9122"]],AUTHORITY["EPSG","4326"]]`
+
+// The tables every GeoPackage has, as the spec defines them
+const (
+	gpkgSpatialRefSysSQL = `CREATE TABLE gpkg_spatial_ref_sys (
+  srs_name TEXT NOT NULL,
+  srs_id INTEGER NOT NULL PRIMARY KEY,
+  organization TEXT NOT NULL,
+  organization_coordsys_id INTEGER NOT NULL,
+  definition TEXT NOT NULL,
+  description TEXT
+)`
+	gpkgContentsSQL = `CREATE TABLE gpkg_contents (
+  table_name TEXT NOT NULL PRIMARY KEY,
+  data_type TEXT NOT NULL,
+  identifier TEXT UNIQUE,
+  description TEXT DEFAULT '',
+  last_change DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ','now')),
+  min_x DOUBLE,
+  min_y DOUBLE,
+  max_x DOUBLE,
+  max_y DOUBLE,
+  srs_id INTEGER,
+  CONSTRAINT fk_gc_r_srs_id FOREIGN KEY (srs_id) REFERENCES gpkg_spatial_ref_sys(srs_id)
+)`
+	gpkgGeometryColumnsSQL = `CREATE TABLE gpkg_geometry_columns (
+  table_name TEXT NOT NULL,
+  column_name TEXT NOT NULL,
+  geometry_type_name TEXT NOT NULL,
+  srs_id INTEGER NOT NULL,
+  z TINYINT NOT NULL,
+  m TINYINT NOT NULL,
+  CONSTRAINT pk_geom_cols PRIMARY KEY (table_name, column_name),
+  CONSTRAINT uk_gc_table_name UNIQUE (table_name),
+  CONSTRAINT fk_gc_tn FOREIGN KEY (table_name) REFERENCES gpkg_contents(table_name),
+  CONSTRAINT fk_gc_srs FOREIGN KEY (srs_id) REFERENCES gpkg_spatial_ref_sys (srs_id)
+)`
+)
+
+// The layers' tables. fid is the rowid
+const (
+	gpkgIncidentsSQL = `CREATE TABLE incidents (
+  fid INTEGER PRIMARY KEY,
+  geom GEOMETRY,
+  rfs_id INTEGER,
+  incident_uuid TEXT,
+  title TEXT,
+  link TEXT,
+  alert_level TEXT,
+  status TEXT,
+  location TEXT,
+  council_area TEXT,
+  fire_type TEXT,
+  fire BOOLEAN,
+  size TEXT,
+  first_report DATETIME,
+  latest_report DATETIME,
+  reports INTEGER
+)`
+	gpkgReportsSQL = `CREATE TABLE reports (
+  fid INTEGER PRIMARY KEY,
+  geom GEOMETRY,
+  rfs_id INTEGER,
+  incident_uuid TEXT,
+  report_uuid TEXT,
+  title TEXT,
+  link TEXT,
+  pubdate DATETIME,
+  start_time DATETIME,
+  end_time DATETIME,
+  alert_level TEXT,
+  status TEXT,
+  location TEXT,
+  council_area TEXT,
+  fire_type TEXT,
+  fire BOOLEAN,
+  size TEXT,
+  responsible_agency TEXT
+)`
+)
+
+// WKB geometry types
+var wkbTypes = map[geojson.GeometryType]uint32{
+	geojson.GeometryPoint:           1,
+	geojson.GeometryLineString:      2,
+	geojson.GeometryPolygon:         3,
+	geojson.GeometryMultiPoint:      4,
+	geojson.GeometryMultiLineString: 5,
+	geojson.GeometryMultiPolygon:    6,
+	geojson.GeometryCollection:      7,
+}
+
+// Encodes a geometry as little-endian WKB
+func geometryWKB(g *geojson.Geometry) ([]byte, error) {
+	wkbType, ok := wkbTypes[g.Type]
+	if !ok {
+		return nil, fmt.Errorf("Can't encode a %s as WKB", g.Type)
+	}
+
+	b := []byte{1}
+	putUint32 := func(v uint32) {
+		b = append(b, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(b[len(b)-4:], v)
+	}
+	putPoint := func(p []float64) {
+		for _, v := range p[:2] {
+			b = append(b, 0, 0, 0, 0, 0, 0, 0, 0)
+			binary.LittleEndian.PutUint64(b[len(b)-8:], math.Float64bits(v))
+		}
+	}
+	putPoints := func(points [][]float64) {
+		putUint32(uint32(len(points)))
+		for _, p := range points {
+			putPoint(p)
+		}
+	}
+	putRings := func(rings [][][]float64) {
+		putUint32(uint32(len(rings)))
+		for _, r := range rings {
+			putPoints(r)
+		}
+	}
+
+	putUint32(wkbType)
+	switch g.Type {
+	case geojson.GeometryPoint:
+		putPoint(g.Point)
+	case geojson.GeometryLineString:
+		putPoints(g.LineString)
+	case geojson.GeometryPolygon:
+		putRings(g.Polygon)
+	default:
+		// Each part of a multi-geometry is a geometry of its own
+		parts := []*geojson.Geometry{}
+		switch g.Type {
+		case geojson.GeometryMultiPoint:
+			for _, p := range g.MultiPoint {
+				parts = append(parts, geojson.NewPointGeometry(p))
+			}
+		case geojson.GeometryMultiLineString:
+			for _, l := range g.MultiLineString {
+				parts = append(parts, geojson.NewLineStringGeometry(l))
+			}
+		case geojson.GeometryMultiPolygon:
+			for _, p := range g.MultiPolygon {
+				parts = append(parts, geojson.NewPolygonGeometry(p))
+			}
+		case geojson.GeometryCollection:
+			parts = g.Geometries
+		}
+		putUint32(uint32(len(parts)))
+		for _, part := range parts {
+			wkb, err := geometryWKB(part)
+			if err != nil {
+				return nil, err
+			}
+			b = append(b, wkb...)
+		}
+	}
+
+	return b, nil
+}
+
+// The geometry's bounds: min x, min y, max x, max y. False when it doesn't have any coordinates
+func geometryBounds(g *geojson.Geometry) ([4]float64, bool) {
+	bounds := [4]float64{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+	found := false
+	add := func(p []float64) {
+		bounds[0], bounds[1] = math.Min(bounds[0], p[0]), math.Min(bounds[1], p[1])
+		bounds[2], bounds[3] = math.Max(bounds[2], p[0]), math.Max(bounds[3], p[1])
+		found = true
+	}
+
+	var walk func(g *geojson.Geometry)
+	walk = func(g *geojson.Geometry) {
+		switch g.Type {
+		case geojson.GeometryPoint:
+			add(g.Point)
+		case geojson.GeometryMultiPoint:
+			for _, p := range g.MultiPoint {
+				add(p)
+			}
+		case geojson.GeometryLineString:
+			for _, p := range g.LineString {
+				add(p)
+			}
+		case geojson.GeometryMultiLineString:
+			for _, l := range g.MultiLineString {
+				for _, p := range l {
+					add(p)
+				}
+			}
+		case geojson.GeometryPolygon:
+			for _, r := range g.Polygon {
+				for _, p := range r {
+					add(p)
+				}
+			}
+		case geojson.GeometryMultiPolygon:
+			for _, polygon := range g.MultiPolygon {
+				for _, r := range polygon {
+					for _, p := range r {
+						add(p)
+					}
+				}
+			}
+		case geojson.GeometryCollection:
+			for _, part := range g.Geometries {
+				walk(part)
+			}
+		}
+	}
+	if g != nil {
+		walk(g)
+	}
+	return bounds, found
+}
+
+// A geometry as a GeoPackage geometry blob: a header with its SRS and envelope, then WKB. nil for a missing geometry
+func gpkgGeometry(g *geojson.Geometry) (interface{}, error) {
+	if g == nil {
+		return nil, nil
+	}
+	wkb, err := geometryWKB(g)
+	if err != nil {
+		return nil, err
+	}
+
+	// Version 0, little-endian with an xy envelope, or flagged as empty without one
+	b := []byte{'G', 'P', 0, 0x03, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(b[4:], 4326)
+	bounds, ok := geometryBounds(g)
+	if ok {
+		for _, v := range []float64{bounds[0], bounds[2], bounds[1], bounds[3]} {
+			b = append(b, 0, 0, 0, 0, 0, 0, 0, 0)
+			binary.LittleEndian.PutUint64(b[len(b)-8:], math.Float64bits(v))
+		}
+	} else {
+		b[3] = 0x11
+	}
+	return append(b, wkb...), nil
+}
+
+func gpkgTime(t time.Time) string {
+	return t.UTC().Format(gpkgTimeFormat)
+}
+
+func gpkgBool(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// A features layer, its rows and their bounds
+type gpkgLayer struct {
+	table       sqliteTable
+	description string
+	bounds      [4]float64
+	hasBounds   bool
+}
+
+// Adds a row with a geometry, widening the layer's bounds
+func (l *gpkgLayer) add(g *geojson.Geometry, values ...interface{}) error {
+	geom, err := gpkgGeometry(g)
+	if err != nil {
+		return err
+	}
+	if b, ok := geometryBounds(g); ok {
+		if !l.hasBounds {
+			l.bounds, l.hasBounds = b, true
+		}
+		l.bounds[0], l.bounds[1] = math.Min(l.bounds[0], b[0]), math.Min(l.bounds[1], b[1])
+		l.bounds[2], l.bounds[3] = math.Max(l.bounds[2], b[2]), math.Max(l.bounds[3], b[3])
+	}
+
+	fid := int64(len(l.table.Rows) + 1)
+	l.table.Rows = append(l.table.Rows, sqliteRow{fid, append([]interface{}{nil, geom}, values...)})
+	return nil
+}
+
+// Builds a GeoPackage with an incidents layer, each incident's latest report, and a reports layer, every report in
+// the timeline with when it was current
+func geoPackage(incidents []incidentTimeline, now time.Time) (sqliteDatabase, error) {
+	incidentsLayer := &gpkgLayer{table: sqliteTable{Name: "incidents", SQL: gpkgIncidentsSQL}, description: "Each incident with its latest report"}
+	reportsLayer := &gpkgLayer{table: sqliteTable{Name: "reports", SQL: gpkgReportsSQL}, description: "Every report, with when it was its incident's latest"}
+
+	for _, i := range incidents {
+		first, latest := i.Entries[0].Report, i.Latest().Report
+		err := incidentsLayer.add(latest.Geometry, int64(i.RFSId), latest.IncidentUUID, latest.Title, latest.Link, latest.AlertLevel,
+			latest.Status, latest.Location, latest.CouncilArea, latest.FireType, gpkgBool(latest.Fire), latest.Size,
+			gpkgTime(first.Pubdate), gpkgTime(latest.Pubdate), int64(len(i.Entries)))
+		if err != nil {
+			return sqliteDatabase{}, err
+		}
+
+		for _, e := range i.Entries {
+			r := e.Report
+			err = reportsLayer.add(r.Geometry, int64(i.RFSId), r.IncidentUUID, r.UUID, r.Title, r.Link, gpkgTime(r.Pubdate),
+				gpkgTime(e.Start), gpkgTime(e.End), r.AlertLevel, r.Status, r.Location, r.CouncilArea, r.FireType,
+				gpkgBool(r.Fire), r.Size, r.ResponsibleAgency)
+			if err != nil {
+				return sqliteDatabase{}, err
+			}
+		}
+	}
+
+	srs := sqliteTable{Name: "gpkg_spatial_ref_sys", SQL: gpkgSpatialRefSysSQL, Rows: []sqliteRow{
+		{-1, []interface{}{"Undefined cartesian SRS", nil, "NONE", int64(-1), "undefined", "undefined cartesian coordinate reference system"}},
+		{0, []interface{}{"Undefined geographic SRS", nil, "NONE", int64(0), "undefined", "undefined geographic coordinate reference system"}},
+		{4326, []interface{}{"WGS 84 geodetic", nil, "EPSG", int64(4326), gpkgWGS84, "longitude/latitude coordinates in decimal degrees on the WGS 84 spheroid"}},
+	}}
+	contents := sqliteTable{Name: "gpkg_contents", SQL: gpkgContentsSQL, Indexes: []sqliteIndex{
+		{Name: "sqlite_autoindex_gpkg_contents_1", Columns: []int{0}},
+		{Name: "sqlite_autoindex_gpkg_contents_2", Columns: []int{2}},
+	}}
+	geometryColumns := sqliteTable{Name: "gpkg_geometry_columns", SQL: gpkgGeometryColumnsSQL, Indexes: []sqliteIndex{
+		{Name: "sqlite_autoindex_gpkg_geometry_columns_1", Columns: []int{0, 1}},
+		{Name: "sqlite_autoindex_gpkg_geometry_columns_2", Columns: []int{0}},
+	}}
+
+	for n, l := range []*gpkgLayer{incidentsLayer, reportsLayer} {
+		bounds := []interface{}{nil, nil, nil, nil}
+		if l.hasBounds {
+			bounds = []interface{}{l.bounds[0], l.bounds[1], l.bounds[2], l.bounds[3]}
+		}
+		rowid := int64(n + 1)
+		contents.Rows = append(contents.Rows, sqliteRow{rowid, append([]interface{}{l.table.Name, "features", l.table.Name, l.description, gpkgTime(now)},
+			append(bounds, int64(4326))...)})
+		geometryColumns.Rows = append(geometryColumns.Rows, sqliteRow{rowid, []interface{}{l.table.Name, "geom", "GEOMETRY", int64(4326), int64(0), int64(0)}})
+	}
+
+	return sqliteDatabase{
+		ApplicationId: gpkgApplicationId,
+		UserVersion:   gpkgUserVersion,
+		Tables:        []sqliteTable{srs, contents, geometryColumns, incidentsLayer.table, reportsLayer.table},
+	}, nil
+}
+
+// Writes the incidents as a GeoPackage
+func writeGeoPackage(w io.Writer, incidents []incidentTimeline) error {
+	gpkg, err := geoPackage(incidents, time.Now())
+	if err != nil {
+		return err
+	}
+	return writeSQLite(w, gpkg)
+}
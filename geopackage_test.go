@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/paulmach/go.geojson"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSQLiteVarint(t *testing.T) {
+	cases := map[uint64]string{
+		0:                  "00",
+		0x7f:               "7f",
+		0x80:               "8100",
+		0x3fff:             "ff7f",
+		0x4000:             "818000",
+		0xffffffffffffffff: "ffffffffffffffffff",
+	}
+	for v, expected := range cases {
+		if got := hex.EncodeToString(sqliteVarint(v)); got != expected {
+			t.Errorf("Expected %d as %s, got %s", v, expected, got)
+		}
+	}
+}
+
+func TestSQLiteRecord(t *testing.T) {
+	record, err := sqliteRecord([]interface{}{nil, int64(1), int64(-2), int64(300), "ab", []byte{0xff}, 1.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Header size, then NULL, 1, 8-bit, 16-bit, text of 2, blob of 1 and a float
+	expected := "08" + "00" + "09" + "01" + "02" + "11" + "0e" + "07" + "fe" + "012c" + "6162" + "ff" + "3ff8000000000000"
+	if hex.EncodeToString(record) != expected {
+		t.Errorf("Expected %s, got %x", expected, record)
+	}
+
+	if _, err = sqliteRecord([]interface{}{true}); err == nil {
+		t.Error("Expected a bool to be an error")
+	}
+}
+
+func TestGeometryWKB(t *testing.T) {
+	wkb, err := geometryWKB(geojson.NewPointGeometry([]float64{150.5, -34}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(wkb) != "0101000000"+"0000000000d06240"+"00000000000041c0" {
+		t.Errorf("Unexpected WKB %x", wkb)
+	}
+
+	g := geojson.NewCollectionGeometry(
+		geojson.NewPointGeometry([]float64{150.65, -34.05}),
+		geojson.NewPolygonGeometry([][][]float64{{{150.6, -34}, {150.7, -34}, {150.7, -34.1}, {150.6, -34}}}),
+	)
+	blob, err := gpkgGeometry(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := blob.([]byte)
+	if string(b[:2]) != "GP" || b[3] != 0x03 || binary.LittleEndian.Uint32(b[4:]) != 4326 {
+		t.Errorf("Unexpected header %x", b[:8])
+	}
+	bounds, _ := geometryBounds(g)
+	if bounds != [4]float64{150.6, -34.1, 150.7, -34} {
+		t.Errorf("Unexpected bounds %v", bounds)
+	}
+	// Header, envelope, then a collection of 2
+	if b[40] != 1 || binary.LittleEndian.Uint32(b[41:]) != 7 || binary.LittleEndian.Uint32(b[45:]) != 2 {
+		t.Errorf("Expected a geometry collection, got %x", b[40:49])
+	}
+}
+
+func TestWriteGeoPackage(t *testing.T) {
+	r := Report{
+		UUID:         "r",
+		IncidentUUID: "i",
+		Title:        "Cobbitty Rd, Cobbitty",
+		AlertLevel:   "Advice",
+		Fire:         true,
+		Pubdate:      time.Date(2015, 12, 1, 10, 31, 0, 0, time.UTC),
+		Geometry:     geojson.NewPointGeometry([]float64{150.65, -34.05}),
+	}
+	incidents := groupTimeline([]TimelineEntry{{123456, r, r.Pubdate, r.Pubdate.Add(time.Hour)}})
+
+	gpkg, err := geoPackage(incidents, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports := gpkg.Tables[4]
+	if reports.Name != "reports" || len(reports.Rows) != 1 || reports.Rows[0].Values[2] != int64(123456) || reports.Rows[0].Values[9] != "2015-12-01T11:31:00.000Z" {
+		t.Errorf("Unexpected reports %+v", reports)
+	}
+	contents := gpkg.Tables[1].Rows[0].Values
+	if contents[0] != "incidents" || contents[5] != 150.65 || contents[6] != -34.05 {
+		t.Errorf("Unexpected contents %v", contents)
+	}
+
+	var b bytes.Buffer
+	if err = writeGeoPackage(&b, incidents); err != nil {
+		t.Fatal(err)
+	}
+	header := b.Bytes()[:100]
+	if string(header[:16]) != "SQLite format 3\x00" || binary.BigEndian.Uint32(header[68:]) != gpkgApplicationId || binary.BigEndian.Uint32(header[60:]) != gpkgUserVersion {
+		t.Errorf("Unexpected header %x", header)
+	}
+	if pages := binary.BigEndian.Uint32(header[28:]); int(pages)*sqlitePageSize != b.Len() {
+		t.Errorf("Expected %d pages, got %d bytes", pages, b.Len())
+	}
+	// sqlite_master is on page 1, after the header, with a table or index for each of the tables and their indexes
+	if b.Bytes()[100] != sqliteTableLeaf || binary.BigEndian.Uint16(b.Bytes()[103:]) != 9 {
+		t.Errorf("Unexpected sqlite_master %x", b.Bytes()[100:108])
+	}
+}
+
+// Reads a SQLite varint, returning it and how many bytes it took
+func readSQLiteVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < 8; i++ {
+		v = v<<7 | uint64(b[i]&0x7f)
+		if b[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	return v<<8 | uint64(b[8]), 9
+}
+
+// Decodes a record back into its values
+func readSQLiteRecord(t *testing.T, record []byte) []interface{} {
+	headerSize, n := readSQLiteVarint(record)
+	types := []uint64{}
+	for n < int(headerSize) {
+		serialType, size := readSQLiteVarint(record[n:])
+		types = append(types, serialType)
+		n += size
+	}
+
+	values := []interface{}{}
+	body := record[headerSize:]
+	for _, serialType := range types {
+		switch {
+		case serialType == 0:
+			values = append(values, nil)
+		case serialType >= 1 && serialType <= 6:
+			size := []int{0, 1, 2, 3, 4, 6, 8}[serialType]
+			v := int64(int8(body[0])) // Sign extended
+			for _, b := range body[1:size] {
+				v = v<<8 | int64(b)
+			}
+			values = append(values, v)
+			body = body[size:]
+		case serialType == 7:
+			values = append(values, math.Float64frombits(binary.BigEndian.Uint64(body)))
+			body = body[8:]
+		case serialType == 8 || serialType == 9:
+			values = append(values, int64(serialType-8))
+		case serialType >= 12:
+			size := int(serialType-12) / 2
+			if serialType%2 == 0 {
+				values = append(values, append([]byte{}, body[:size]...))
+			} else {
+				values = append(values, string(body[:size]))
+			}
+			body = body[size:]
+		default:
+			t.Fatalf("Unexpected serial type %d", serialType)
+		}
+	}
+	return values
+}
+
+// Walks a table's b-tree back into its rows, following interior pages and overflow chains, and noting the pages used
+func readSQLiteTable(t *testing.T, file []byte, root int, used map[int]bool) []sqliteRow {
+	use := func(n int) []byte {
+		if used[n] {
+			t.Fatalf("Page %d is used twice", n)
+		}
+		used[n] = true
+		return file[(n-1)*sqlitePageSize : n*sqlitePageSize]
+	}
+
+	page := use(root)
+	offset := sqliteHeaderOffset(root)
+	cells := int(binary.BigEndian.Uint16(page[offset+3:]))
+	content := int(binary.BigEndian.Uint16(page[offset+5:]))
+
+	switch page[offset] {
+	case sqliteTableInterior:
+		if content < offset+12+cells*2 {
+			t.Fatalf("Page %d's cells overlap its header", root)
+		}
+		rows := []sqliteRow{}
+		for i := 0; i < cells; i++ {
+			cell := page[binary.BigEndian.Uint16(page[offset+12+i*2:]):]
+			maxRowid, _ := readSQLiteVarint(cell[4:])
+			child := readSQLiteTable(t, file, int(binary.BigEndian.Uint32(cell)), used)
+			if len(child) == 0 || child[len(child)-1].Rowid != int64(maxRowid) {
+				t.Errorf("Expected page %d's child to end at rowid %d", root, maxRowid)
+			}
+			rows = append(rows, child...)
+		}
+		return append(rows, readSQLiteTable(t, file, int(binary.BigEndian.Uint32(page[offset+8:])), used)...)
+
+	case sqliteTableLeaf:
+		if content < offset+8+cells*2 {
+			t.Fatalf("Page %d's cells overlap its header", root)
+		}
+		rows := []sqliteRow{}
+		for i := 0; i < cells; i++ {
+			cell := page[binary.BigEndian.Uint16(page[offset+8+i*2:]):]
+			size, n := readSQLiteVarint(cell)
+			rowid, m := readSQLiteVarint(cell[n:])
+			cell = cell[n+m:]
+
+			// How much is on the page, as the file format spells it out for 4096 byte pages
+			local := int(size)
+			if local > 4061 {
+				local = 489 + (int(size)-489)%4092
+				if local > 4061 {
+					local = 489
+				}
+			}
+			payload := append([]byte{}, cell[:local]...)
+			for next := 0; len(payload) < int(size); {
+				if next == 0 {
+					next = int(binary.BigEndian.Uint32(cell[local:]))
+				}
+				overflow := use(next)
+				take := int(size) - len(payload)
+				if take > sqlitePageSize-4 {
+					take = sqlitePageSize - 4
+				}
+				payload = append(payload, overflow[4:4+take]...)
+				next = int(binary.BigEndian.Uint32(overflow))
+			}
+			rows = append(rows, sqliteRow{int64(rowid), readSQLiteRecord(t, payload)})
+		}
+		return rows
+	}
+
+	t.Fatalf("Unexpected page type %x on page %d", page[offset], root)
+	return nil
+}
+
+func TestWriteSQLiteTree(t *testing.T) {
+	// Enough rows for interior pages, with some too big for a page and some spilling onto more than one overflow page
+	rows := []sqliteRow{}
+	for i := int64(1); i <= 3000; i++ {
+		data := []byte{}
+		switch {
+		case i%500 == 0:
+			data = bytes.Repeat([]byte{byte(i)}, 3*sqlitePageSize)
+		case i%250 == 0:
+			// Big enough that more than the minimum stays on the page
+			data = bytes.Repeat([]byte{byte(i)}, 6000)
+		case i%100 == 0:
+			data = bytes.Repeat([]byte{byte(i)}, sqlitePageSize)
+		}
+		rows = append(rows, sqliteRow{i, []interface{}{nil, fmt.Sprintf("row %d", i), i * 1000, float64(i) / 2, data}})
+	}
+	database := sqliteDatabase{Tables: []sqliteTable{{Name: "t", SQL: "CREATE TABLE t(id INTEGER PRIMARY KEY, name TEXT, n INTEGER, f REAL, data BLOB)", Rows: rows}}}
+
+	var b bytes.Buffer
+	if err := writeSQLite(&b, database); err != nil {
+		t.Fatal(err)
+	}
+	file := b.Bytes()
+	pages := int(binary.BigEndian.Uint32(file[28:]))
+	if pages*sqlitePageSize != len(file) {
+		t.Fatalf("Expected %d pages, got %d bytes", pages, len(file))
+	}
+
+	used := make(map[int]bool)
+	master := readSQLiteTable(t, file, 1, used)
+	if len(master) != 1 || master[0].Values[1] != "t" {
+		t.Fatalf("Unexpected sqlite_master %v", master)
+	}
+	root := master[0].Values[3].(int64)
+	if page := file[(root-1)*sqlitePageSize]; page != sqliteTableInterior {
+		t.Errorf("Expected the table's root to be an interior page, got %x", page)
+	}
+
+	got := readSQLiteTable(t, file, int(root), used)
+	if len(got) != len(rows) {
+		t.Fatalf("Expected %d rows back, got %d", len(rows), len(got))
+	}
+	for i := range rows {
+		if !reflect.DeepEqual(got[i].Values, rows[i].Values) || got[i].Rowid != rows[i].Rowid {
+			t.Fatalf("Expected row %d to be %v, got %v", i, rows[i], got[i])
+		}
+	}
+	if len(used) != pages {
+		t.Errorf("Expected every one of the %d pages to be used once, %d were", pages, len(used))
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits for the number of entries in a feed
+const (
+	feedDefaultLimit = 100
+	feedMaxLimit     = 1000
+)
+
+// How far back the reports feed goes when it isn't given a since
+const feedDefaultPeriod = 7 * 24 * time.Hour
+
+// Filters for a feed's reports
+type feedQuery struct {
+	AlertLevels  []string  // Matched ignoring case
+	CouncilAreas []string  // Matched ignoring case
+	FireOnly     bool      // Only reports that are fires
+	BBox         []float64 // minx, miny, maxx, maxy, or empty
+	Since        time.Time // Only reports published since
+	Limit        int
+}
+
+// Parses a feed's filters: alert_level, council_area, fire, bbox, since and limit
+func parseFeedQuery(r *http.Request) (feedQuery, error) {
+	v := r.URL.Query()
+	q := feedQuery{
+		AlertLevels:  splitList(v.Get("alert_level")),
+		CouncilAreas: splitList(v.Get("council_area")),
+	}
+
+	var err error
+	if fire := v.Get("fire"); fire != "" {
+		if q.FireOnly, err = strconv.ParseBool(fire); err != nil {
+			return q, fmt.Errorf("Expected fire to be true or false, got %q", fire)
+		}
+	}
+	if q.BBox, err = parseBBox(v.Get("bbox")); err != nil {
+		return q, err
+	}
+	if since := v.Get("since"); since != "" {
+		if q.Since, err = parseCLITime(since); err != nil {
+			return q, err
+		}
+	}
+	if q.Limit, err = queryInt(r, "limit", feedDefaultLimit); err != nil {
+		return q, err
+	}
+	if q.Limit < 1 {
+		q.Limit = feedDefaultLimit
+	}
+	if q.Limit > feedMaxLimit {
+		q.Limit = feedMaxLimit
+	}
+
+	return q, nil
+}
+
+// The query's filters as conditions on reports, each starting with AND, and the args with theirs added
+func (q feedQuery) where(args []interface{}) (string, []interface{}) {
+	conditions := ""
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	in := func(column string, values []string) string {
+		placeholders := []string{}
+		for _, v := range values {
+			placeholders = append(placeholders, arg(strings.ToLower(v)))
+		}
+		return fmt.Sprintf(" AND lower(trim(%s)) IN (%s)", column, strings.Join(placeholders, ", "))
+	}
+
+	if len(q.AlertLevels) > 0 {
+		conditions += in("reports.alert_level", q.AlertLevels)
+	}
+	if len(q.CouncilAreas) > 0 {
+		conditions += in("reports.council_area", q.CouncilAreas)
+	}
+	if q.FireOnly {
+		conditions += " AND reports.fire"
+	}
+	if len(q.BBox) == 4 {
+		conditions += fmt.Sprintf(" AND reports.geometry && ST_MakeEnvelope(%s, %s, %s, %s, 4326)",
+			arg(q.BBox[0]), arg(q.BBox[1]), arg(q.BBox[2]), arg(q.BBox[3]))
+	}
+	if !q.Since.IsZero() {
+		conditions += " AND reports.pubdate >= " + arg(q.Since.UTC().Format(time.RFC3339)) + "::timestamptz"
+	}
+
+	return conditions, args
+}
+
+// Fetches the incidents in the feed now, each with its latest report, most recently published first
+func GetFeedIncidents(q feedQuery) ([]IncidentReport, error) {
+	query, args := reportsAtQuery(time.Time{})
+	where, args := q.where(args)
+	args = append(args, q.Limit)
+
+	// Aliased as reports so reportColumns can select from them
+	return queryIncidentReports(fmt.Sprintf(`WITH asof AS (`+query+`)
+    SELECT `+reportColumns+`, reports.rfs_id FROM asof reports
+    WHERE true%s
+    ORDER BY reports.pubdate DESC
+    LIMIT $%d`, where, len(args)), args...)
+}
+
+// Fetches recent reports, most recently published first
+func GetFeedReports(q feedQuery) ([]IncidentReport, error) {
+	if q.Since.IsZero() {
+		q.Since = time.Now().Add(-feedDefaultPeriod)
+	}
+	where, args := q.where(nil)
+	args = append(args, q.Limit)
+
+	return queryIncidentReports(fmt.Sprintf(`SELECT `+reportColumns+`, i.rfs_id FROM reports
+    JOIN incidents i ON i.uuid = reports.incident_uuid
+    WHERE true%s
+    ORDER BY reports.pubdate DESC, reports.created_at DESC
+    LIMIT $%d`, where, len(args)), args...)
+}
+
+// Runs a query selecting reportColumns followed by an RFS id
+func queryIncidentReports(query string, args ...interface{}) ([]IncidentReport, error) {
+	reports := []IncidentReport{}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return reports, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		i := IncidentReport{}
+		i.Report, err = scanReport(extraColumns{rows, []interface{}{&i.RFSId}})
+		if err != nil {
+			return reports, err
+		}
+		reports = append(reports, i)
+	}
+
+	return reports, rows.Err()
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr,omitempty"`
+	Body string `xml:",chardata"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	Id         string         `xml:"id"`
+	Links      []atomLink     `xml:"link"`
+	Published  string         `xml:"published"`
+	Updated    string         `xml:"updated"`
+	Categories []atomCategory `xml:"category"`
+	Summary    *atomText      `xml:"summary,omitempty"`
+	Point      string         `xml:"georss:point,omitempty"`
+}
+
+type atomFeed struct {
+	XMLName     xml.Name    `xml:"feed"`
+	Xmlns       string      `xml:"xmlns,attr"`
+	XmlnsGeoRSS string      `xml:"xmlns:georss,attr"`
+	Title       string      `xml:"title"`
+	Id          string      `xml:"id"`
+	Links       []atomLink  `xml:"link"`
+	Updated     string      `xml:"updated"`
+	Author      string      `xml:"author>name"`
+	Generator   string      `xml:"generator"`
+	Entries     []atomEntry `xml:"entry"`
+}
+
+// A GeoRSS-Simple point, "lat lon", of the first point in the report's geometry. Empty when it doesn't have one
+func georssPoint(r Report) string {
+	points, _ := geometryPointsAndPolygons(r.Geometry)
+	if len(points) == 0 || len(points[0]) < 2 {
+		return ""
+	}
+	return strconv.FormatFloat(points[0][1], 'f', -1, 64) + " " + strconv.FormatFloat(points[0][0], 'f', -1, 64)
+}
+
+// The report as an entry. Entries in the incidents feed are the incident's, updated by each report, while entries
+// in the reports feed are the report's own
+func atomReportEntry(r Report, byIncident bool) atomEntry {
+	e := atomEntry{
+		Title:     r.Title,
+		Id:        "urn:uuid:" + r.UUID,
+		Published: r.Pubdate.UTC().Format(time.RFC3339),
+		Updated:   r.Pubdate.UTC().Format(time.RFC3339),
+		Point:     georssPoint(r),
+	}
+	if byIncident {
+		e.Id = "urn:uuid:" + r.IncidentUUID
+	}
+	if r.Link != "" {
+		e.Links = append(e.Links, atomLink{Href: r.Link, Rel: "alternate", Type: "text/html"})
+	}
+	for _, term := range []string{r.Category, r.AlertLevel} {
+		if term = strings.TrimSpace(term); term != "" && (len(e.Categories) == 0 || !strings.EqualFold(e.Categories[0].Term, term)) {
+			e.Categories = append(e.Categories, atomCategory{term})
+		}
+	}
+	if r.Description != "" {
+		e.Summary = &atomText{Type: "html", Body: r.Description}
+	}
+	return e
+}
+
+// An Atom feed of the reports with GeoRSS-Simple points. self is the feed's URL, which is also its id
+func atomFeedOf(title, self string, reports []IncidentReport, byIncident bool) atomFeed {
+	feed := atomFeed{
+		Xmlns:       "http://www.w3.org/2005/Atom",
+		XmlnsGeoRSS: "http://www.georss.org/georss",
+		Title:       title,
+		Id:          self,
+		Links:       []atomLink{{Href: self, Rel: "self", Type: "application/atom+xml"}},
+		Author:      "NSW Rural Fire Service",
+		Generator:   "incidentworker",
+		Entries:     []atomEntry{},
+	}
+
+	// Updated when the most recent report was published
+	var updated time.Time
+	for _, i := range reports {
+		feed.Entries = append(feed.Entries, atomReportEntry(i.Report, byIncident))
+		if i.Report.Pubdate.After(updated) {
+			updated = i.Report.Pubdate
+		}
+	}
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+	feed.Updated = updated.UTC().Format(time.RFC3339)
+
+	return feed
+}
+
+func writeAtomFeed(w io.Writer, feed atomFeed) error {
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(feed)
+}
+
+// GET /feeds/incidents.atom and /feeds/reports.atom, filtered with alert_level=<level,...>&council_area=<area,...>
+// &fire=true&bbox=<minx,miny,maxx,maxy>&since=<time>&limit=<n>
+// Current incidents, or recent reports, as a GeoRSS-Simple Atom feed built from what's been imported, so it stays
+// the same whatever the upstream feed looks like
+func handleFeed(w http.ResponseWriter, r *http.Request) {
+	q, err := parseFeedQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var title string
+	var reports []IncidentReport
+	byIncident := false
+	switch r.URL.Path {
+	case "/feeds/incidents.atom":
+		title = "Current incidents"
+		byIncident = true
+		reports, err = GetFeedIncidents(q)
+	case "/feeds/reports.atom":
+		title = "Recent reports"
+		reports, err = GetFeedReports(q)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("There isn't a feed at %s", r.URL.Path))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	feed := atomFeedOf(title, baseURL(r)+r.URL.RequestURI(), reports, byIncident)
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	err = writeAtomFeed(w, feed)
+	if err != nil {
+		log.Printf("Error writing feed %v\n", err)
+	}
+}
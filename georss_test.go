@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"github.com/paulmach/go.geojson"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFeedQuery(t *testing.T) {
+	r := httptest.NewRequest("GET", "/feeds/reports.atom?alert_level=Emergency+Warning,Watch+and+Act&fire=true&since=2015-12-01&limit=5000", nil)
+	q, err := parseFeedQuery(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(q.AlertLevels) != 2 || !q.FireOnly || q.Limit != feedMaxLimit || q.Since.IsZero() {
+		t.Errorf("Unexpected query %+v", q)
+	}
+
+	where, args := q.where([]interface{}{"a"})
+	expected := " AND lower(trim(reports.alert_level)) IN ($2, $3) AND reports.fire AND reports.pubdate >= $4::timestamptz"
+	if where != expected {
+		t.Errorf("Expected %s, got %s", expected, where)
+	}
+	if len(args) != 4 || args[1] != "emergency warning" {
+		t.Errorf("Unexpected args %v", args)
+	}
+
+	r = httptest.NewRequest("GET", "/feeds/reports.atom?fire=maybe", nil)
+	if _, err = parseFeedQuery(r); err == nil {
+		t.Error("Expected fire=maybe to be an error")
+	}
+}
+
+func TestAtomFeed(t *testing.T) {
+	r := Report{
+		UUID:         "r",
+		IncidentUUID: "i",
+		Title:        "Cobbitty Rd, Cobbitty",
+		Link:         "http://www.rfs.nsw.gov.au/fire-information/fires-near-me",
+		Category:     "Advice",
+		AlertLevel:   "Advice",
+		Description:  "ALERT LEVEL: Advice<br />STATUS: under control",
+		Pubdate:      time.Date(2015, 12, 1, 10, 31, 0, 0, time.UTC),
+		Geometry: geojson.NewCollectionGeometry(
+			geojson.NewPolygonGeometry([][][]float64{{{150.6, -34}, {150.7, -34}, {150.7, -34.1}, {150.6, -34}}}),
+			geojson.NewPointGeometry([]float64{150.65, -34.05}),
+		),
+	}
+
+	if p := georssPoint(r); p != "-34.05 150.65" {
+		t.Errorf("Expected the point as lat lon, got %q", p)
+	}
+
+	feed := atomFeedOf("Recent reports", "http://localhost/feeds/reports.atom", []IncidentReport{{123456, r}}, false)
+	if feed.Updated != "2015-12-01T10:31:00Z" || feed.Entries[0].Id != "urn:uuid:r" {
+		t.Errorf("Unexpected feed %+v", feed)
+	}
+	if e := atomFeedOf("Current incidents", "", []IncidentReport{{123456, r}}, true).Entries[0]; e.Id != "urn:uuid:i" {
+		t.Errorf("Expected the incident's id, got %s", e.Id)
+	}
+
+	var b bytes.Buffer
+	if err := writeAtomFeed(&b, feed); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		`<feed xmlns="http://www.w3.org/2005/Atom" xmlns:georss="http://www.georss.org/georss">`,
+		`<georss:point>-34.05 150.65</georss:point>`,
+		`<summary type="html">ALERT LEVEL: Advice&lt;br /&gt;STATUS: under control</summary>`,
+		`<category term="Advice"></category>`,
+	} {
+		if !strings.Contains(b.String(), s) {
+			t.Errorf("Expected the feed to contain %s, got %s", s, b.String())
+		}
+	}
+}
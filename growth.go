@@ -0,0 +1,270 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/paulmach/go.geojson"
+	"io"
+	"math"
+	"time"
+)
+
+// Centroids moving less than this, in metres, haven't gone anywhere in particular
+const spreadMinDistanceM = 10
+
+var compassPoints = []string{"N", "NE", "E", "SE", "S", "SW", "W", "NW"}
+
+type PerimeterGrowth struct {
+	ReportUUID         string
+	IncidentUUID       string
+	PreviousReportUUID string
+	Pubdate            time.Time // Of the report
+	AreaHa             float64
+	PreviousAreaHa     float64
+	GrowthHa           float64
+	Hours              float64
+	GrowthHaPerHour    float64
+	NewArea            *geojson.Geometry
+	NewAreaHa          float64
+	SpreadM            float64
+	SpreadBearing      float64
+	SpreadDirection    string // Empty when the perimeter didn't move
+}
+
+// How fast a perimeter grew, in hectares per hour. Reports published at the same time don't have a rate
+func growthRate(growthHa, hours float64) (float64, bool) {
+	if hours <= 0 {
+		return 0, false
+	}
+	return growthHa / hours, true
+}
+
+// The compass point nearest a bearing, in degrees clockwise from north
+func compassDirection(bearing float64) string {
+	i := int(math.Floor(math.Mod(bearing+22.5+360, 360) / 45))
+	return compassPoints[i%len(compassPoints)]
+}
+
+// Compares the report's perimeter with the incident's previous perimeter, and records how it grew.
+// Returns nil when either the report or the reports before it don't have a polygon
+func (r *Report) RecordGrowth() (*PerimeterGrowth, error) {
+	// Only the polygons of a report's geometry are its perimeter, the point's where it started
+	stmt, err := db.Prepare(`WITH cur AS (
+      SELECT uuid, incident_uuid, pubdate, ST_MakeValid(ST_CollectionExtract(geometry, 3)) AS perimeter FROM reports WHERE uuid = $1
+    ), prev AS (
+      SELECT p.uuid, p.pubdate, ST_MakeValid(ST_CollectionExtract(p.geometry, 3)) AS perimeter
+      FROM reports p, cur
+      WHERE p.incident_uuid = cur.incident_uuid AND p.uuid <> cur.uuid AND p.pubdate <= cur.pubdate
+        AND NOT ST_IsEmpty(ST_CollectionExtract(p.geometry, 3))
+      ORDER BY p.pubdate DESC, p.created_at DESC
+      LIMIT 1
+    )
+    SELECT cur.incident_uuid, prev.uuid, cur.pubdate, EXTRACT(EPOCH FROM cur.pubdate - prev.pubdate) / 3600,
+      ST_Area(cur.perimeter::geography) / 10000, ST_Area(prev.perimeter::geography) / 10000,
+      ST_AsGeoJSON(ST_Difference(cur.perimeter, prev.perimeter)),
+      ST_Area(ST_Difference(cur.perimeter, prev.perimeter)::geography) / 10000,
+      ST_Distance(ST_Centroid(prev.perimeter)::geography, ST_Centroid(cur.perimeter)::geography),
+      COALESCE(degrees(ST_Azimuth(ST_Centroid(prev.perimeter)::geography, ST_Centroid(cur.perimeter)::geography)), 0)
+    FROM cur, prev
+    WHERE NOT ST_IsEmpty(cur.perimeter)`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	g := PerimeterGrowth{ReportUUID: r.UUID}
+	var newArea string
+	err = stmt.QueryRow(r.UUID).Scan(&g.IncidentUUID, &g.PreviousReportUUID, &g.Pubdate, &g.Hours, &g.AreaHa, &g.PreviousAreaHa, &newArea, &g.NewAreaHa, &g.SpreadM, &g.SpreadBearing)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	g.NewArea, err = geojson.UnmarshalGeometry([]byte(newArea))
+	if err != nil {
+		return nil, err
+	}
+	g.GrowthHa = g.AreaHa - g.PreviousAreaHa
+	g.GrowthHaPerHour, _ = growthRate(g.GrowthHa, g.Hours)
+	if g.SpreadM >= spreadMinDistanceM {
+		g.SpreadDirection = compassDirection(g.SpreadBearing)
+	}
+
+	return &g, g.Insert()
+}
+
+// Inserts the growth into the database, replacing any already recorded for the report
+func (g *PerimeterGrowth) Insert() error {
+	stmt, err := db.Prepare(`INSERT INTO perimeter_growth(report_uuid, incident_uuid, previous_report_uuid, area_ha, previous_area_ha, growth_ha, hours,
+      growth_ha_per_hour, new_area, new_area_ha, spread_m, spread_bearing, spread_direction)
+    VALUES($1, $2, $3, $4, $5, $6, $7, $8, ST_SetSRID(ST_GeomFromGeoJSON($9), 4326), $10, $11, $12, NULLIF($13, ''))
+    ON CONFLICT (report_uuid) DO UPDATE SET previous_report_uuid = EXCLUDED.previous_report_uuid, area_ha = EXCLUDED.area_ha,
+      previous_area_ha = EXCLUDED.previous_area_ha, growth_ha = EXCLUDED.growth_ha, hours = EXCLUDED.hours,
+      growth_ha_per_hour = EXCLUDED.growth_ha_per_hour, new_area = EXCLUDED.new_area, new_area_ha = EXCLUDED.new_area_ha,
+      spread_m = EXCLUDED.spread_m, spread_bearing = EXCLUDED.spread_bearing, spread_direction = EXCLUDED.spread_direction`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	geom, err := g.NewArea.MarshalJSON()
+	if err != nil {
+		return err
+	}
+
+	var rate, bearing interface{}
+	if _, ok := growthRate(g.GrowthHa, g.Hours); ok {
+		rate = g.GrowthHaPerHour
+	}
+	if g.SpreadDirection != "" {
+		bearing = g.SpreadBearing
+	}
+
+	_, err = stmt.Exec(g.ReportUUID, g.IncidentUUID, g.PreviousReportUUID, g.AreaHa, g.PreviousAreaHa, g.GrowthHa, g.Hours,
+		rate, string(geom), g.NewAreaHa, g.SpreadM, bearing, g.SpreadDirection)
+	return err
+}
+
+// Records growth for an incident's reports that don't have it yet, e.g. those imported before growth was tracked.
+// Returns how many reports had growth to record
+func RecordIncidentGrowth(incidentUUID string) (int, error) {
+	reports, err := GetIncidentReports(incidentUUID)
+	if err != nil {
+		return 0, err
+	}
+
+	recorded := make(map[string]bool)
+	growth, err := GetIncidentGrowth(incidentUUID)
+	if err != nil {
+		return 0, err
+	}
+	for _, g := range growth {
+		recorded[g.ReportUUID] = true
+	}
+
+	count := 0
+	for _, r := range reports {
+		if recorded[r.UUID] {
+			continue
+		}
+		g, err := r.RecordGrowth()
+		if err != nil {
+			return count, err
+		}
+		if g != nil {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// Records growth for the reports of an incident, by its RFS id, that were imported before growth was tracked
+func BackfillIncidentGrowth(rfsId int) (int, error) {
+	uuid, err := GetIncidentUUIDForRFSId(rfsId)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("No incident with RFS id %d", rfsId)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return RecordIncidentGrowth(uuid)
+}
+
+// Fetches the growth recorded for an incident's reports, oldest first
+func GetIncidentGrowth(incidentUUID string) ([]PerimeterGrowth, error) {
+	growth := []PerimeterGrowth{}
+
+	rows, err := db.Query(`SELECT g.report_uuid, g.incident_uuid, g.previous_report_uuid, r.pubdate, g.area_ha, g.previous_area_ha, g.growth_ha, g.hours,
+      COALESCE(g.growth_ha_per_hour, 0), COALESCE(ST_AsGeoJSON(g.new_area), ''), g.new_area_ha, g.spread_m, COALESCE(g.spread_bearing, 0), COALESCE(g.spread_direction, '')
+    FROM perimeter_growth g
+    JOIN reports r ON r.uuid = g.report_uuid
+    WHERE g.incident_uuid = $1
+    ORDER BY r.pubdate, r.created_at`, incidentUUID)
+	if err != nil {
+		return growth, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		g := PerimeterGrowth{}
+		var newArea string
+		err = rows.Scan(&g.ReportUUID, &g.IncidentUUID, &g.PreviousReportUUID, &g.Pubdate, &g.AreaHa, &g.PreviousAreaHa, &g.GrowthHa, &g.Hours,
+			&g.GrowthHaPerHour, &newArea, &g.NewAreaHa, &g.SpreadM, &g.SpreadBearing, &g.SpreadDirection)
+		if err != nil {
+			return growth, err
+		}
+		if newArea != "" {
+			g.NewArea, err = geojson.UnmarshalGeometry([]byte(newArea))
+			if err != nil {
+				return growth, err
+			}
+		}
+		growth = append(growth, g)
+	}
+
+	return growth, rows.Err()
+}
+
+// The newly burnt areas of an incident's growth as features, for mapping its progression
+func growthFeatureCollection(growth []PerimeterGrowth) *geojson.FeatureCollection {
+	fc := geojson.NewFeatureCollection()
+	for _, g := range growth {
+		if g.NewArea == nil {
+			continue
+		}
+		f := geojson.NewFeature(g.NewArea)
+		f.SetProperty("report_uuid", g.ReportUUID)
+		f.SetProperty("previous_report_uuid", g.PreviousReportUUID)
+		f.SetProperty("pubdate", g.Pubdate.UTC().Format(time.RFC3339))
+		f.SetProperty("area_ha", g.AreaHa)
+		f.SetProperty("growth_ha", g.GrowthHa)
+		f.SetProperty("growth_ha_per_hour", g.GrowthHaPerHour)
+		f.SetProperty("new_area_ha", g.NewAreaHa)
+		f.SetProperty("spread_m", g.SpreadM)
+		f.SetProperty("spread_direction", g.SpreadDirection)
+		fc.AddFeature(f)
+	}
+	return fc
+}
+
+// Writes how an incident's perimeter grew, as text for a human or as GeoJSON of the newly burnt areas.
+// Only growth that's been recorded is written, see BackfillIncidentGrowth
+func PrintIncidentGrowth(w io.Writer, rfsId int, asGeoJSON bool) error {
+	uuid, err := GetIncidentUUIDForRFSId(rfsId)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("No incident with RFS id %d", rfsId)
+	}
+	if err != nil {
+		return err
+	}
+
+	growth, err := GetIncidentGrowth(uuid)
+	if err != nil {
+		return err
+	}
+
+	if asGeoJSON {
+		return json.NewEncoder(w).Encode(growthFeatureCollection(growth))
+	}
+
+	if len(growth) == 0 {
+		fmt.Fprintf(w, "Incident %d doesn't have perimeters to compare\n", rfsId)
+		return nil
+	}
+	for _, g := range growth {
+		fmt.Fprintf(w, "%s  %.1f ha (%+.1f ha", g.Pubdate.In(feedLocation).Format("2006-01-02 15:04"), g.AreaHa, g.GrowthHa)
+		if g.Hours > 0 {
+			fmt.Fprintf(w, ", %+.1f ha/h", g.GrowthHaPerHour)
+		}
+		fmt.Fprintf(w, "), %.1f ha newly burnt", g.NewAreaHa)
+		if g.SpreadDirection != "" {
+			fmt.Fprintf(w, ", spreading %s %.1f km", g.SpreadDirection, g.SpreadM/1000)
+		}
+		fmt.Fprintln(w)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestGrowthRate(t *testing.T) {
+	if rate, ok := growthRate(30, 6); !ok || rate != 5 {
+		t.Errorf("Expected 5 ha/h, got %v %t", rate, ok)
+	}
+	if _, ok := growthRate(30, 0); ok {
+		t.Error("Expected no rate between reports published at the same time")
+	}
+}
+
+func TestCompassDirection(t *testing.T) {
+	cases := map[float64]string{
+		0:     "N",
+		22.4:  "N",
+		22.5:  "NE",
+		90:    "E",
+		180:   "S",
+		225:   "SW",
+		337.4: "NW",
+		359.9: "N",
+		-90:   "W",
+	}
+
+	for bearing, expected := range cases {
+		if got := compassDirection(bearing); got != expected {
+			t.Errorf("Expected %v degrees to be %s, got %s", bearing, expected, got)
+		}
+	}
+}
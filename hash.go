@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/paulmach/go.geojson"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The version of reportHash. Bump it whenever what goes into the hash changes, and run the rehash command
+const reportHashVersion = 2
+
+// Hashes are prefixed with their version. Version 1 hashes, from before hashes were versioned, have no prefix
+var reportHashPrefix = fmt.Sprintf("v%d:", reportHashVersion)
+
+// The feature properties that make one report different from another
+var reportHashProperties = []string{"guid", "title", "link", "category", "pubDate", "description"}
+
+// Decimal places coordinates are rounded to. 6 is about 10cm
+const reportHashPrecision = 6
+
+var hashWhitespaceRe = regexp.MustCompile(`\s+`)
+
+// Hashes the meaningful content of a feature, so the same report always has the same hash
+// regardless of property order, float formatting or how geometry collections are nested
+func reportHash(f *geojson.Feature) (string, error) {
+	s, err := json.Marshal(canonicalFeature(f)) // Map keys are sorted when marshalled
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write(s)
+	return fmt.Sprintf("%s%x", reportHashPrefix, h.Sum(nil)), nil
+}
+
+// The version 1 hash of a feature, the SHA1 of the library's JSON representation of it
+func legacyReportHash(f *geojson.Feature) string {
+	s, _ := json.Marshal(f)
+	h := sha1.New()
+	h.Write([]byte(s))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// The parts of a feature that go into its hash
+func canonicalFeature(f *geojson.Feature) map[string]interface{} {
+	props := make(map[string]string)
+	for _, k := range reportHashProperties {
+		v, _ := f.PropertyString(k)
+		// Whitespace changes are cosmetic
+		props[k] = strings.TrimSpace(hashWhitespaceRe.ReplaceAllString(v, " "))
+	}
+
+	return map[string]interface{}{
+		"properties": props,
+		"geometry":   canonicalGeometry(f.Geometry),
+	}
+}
+
+// A geometry with rounded coordinates and collections flattened and sorted
+func canonicalGeometry(g *geojson.Geometry) interface{} {
+	if g == nil {
+		return nil
+	}
+
+	if g.IsCollection() {
+		geoms := []string{}
+		for _, c := range flattenGeometries(g.Geometries) {
+			s, _ := json.Marshal(canonicalGeometry(c))
+			geoms = append(geoms, string(s))
+		}
+		// Order within a collection isn't meaningful
+		sort.Strings(geoms)
+		return map[string]interface{}{"type": g.Type, "geometries": geoms}
+	}
+
+	var coords interface{}
+	switch g.Type {
+	case geojson.GeometryPoint:
+		coords = roundPosition(g.Point)
+	case geojson.GeometryMultiPoint:
+		coords = roundPositions(g.MultiPoint)
+	case geojson.GeometryLineString:
+		coords = roundPositions(g.LineString)
+	case geojson.GeometryMultiLineString:
+		coords = roundPaths(g.MultiLineString)
+	case geojson.GeometryPolygon:
+		coords = roundPaths(g.Polygon)
+	case geojson.GeometryMultiPolygon:
+		polygons := [][][][]float64{}
+		for _, p := range g.MultiPolygon {
+			polygons = append(polygons, roundPaths(p))
+		}
+		coords = polygons
+	}
+
+	return map[string]interface{}{"type": g.Type, "coordinates": coords}
+}
+
+func roundPosition(p []float64) []float64 {
+	rounded := make([]float64, len(p))
+	scale := math.Pow(10, reportHashPrecision)
+	for i, v := range p {
+		rounded[i] = math.Round(v*scale) / scale
+	}
+	return rounded
+}
+
+func roundPositions(ps [][]float64) [][]float64 {
+	rounded := make([][]float64, len(ps))
+	for i, p := range ps {
+		rounded[i] = roundPosition(p)
+	}
+	return rounded
+}
+
+func roundPaths(paths [][][]float64) [][][]float64 {
+	rounded := make([][][]float64, len(paths))
+	for i, p := range paths {
+		rounded[i] = roundPositions(p)
+	}
+	return rounded
+}
+
+// Looks for a report by its current hash, then by its legacy hash, without changing anything.
+// Whether it was found by its legacy hash is returned too
+func findReportUUIDForHashes(hash, legacyHash string) (string, bool, error) {
+	uuid, err := GetReportUUIDForHash(hash)
+	if err != sql.ErrNoRows || legacyHash == "" {
+		return uuid, false, err
+	}
+
+	uuid, err = GetReportUUIDForHash(legacyHash)
+	if err != nil {
+		return "", false, err
+	}
+	return uuid, true, nil
+}
+
+// Looks for a report by its current hash, then by its legacy hash.
+// A report found by its legacy hash has its hash upgraded, so it's found by the current hash from then on
+func GetReportUUIDForHashes(hash, legacyHash string) (string, error) {
+	uuid, legacy, err := findReportUUIDForHashes(hash, legacyHash)
+	if err != nil || !legacy {
+		return uuid, err
+	}
+
+	err = SetReportHash(uuid, hash)
+	if err != nil {
+		return "", err
+	}
+	return uuid, nil
+}
+
+// Replaces a report's hash, when moving it to the current hash version
+func SetReportHash(uuid, hash string) error {
+	stmt, err := db.Prepare(`UPDATE reports SET hash = $2, updated_at = (NOW() AT TIME ZONE 'UTC') WHERE uuid = $1`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(uuid, hash)
+	return err
+}
+
+// Reports that have the same current hash, because they only differed in something older hash versions were sensitive
+// to, e.g. coordinate precision or key order. Existing is the report that already had the hash, if there was one
+type hashCollision struct {
+	Hash     string
+	UUIDs    []string
+	Existing string
+}
+
+// Groups reports by their current hash, rebuilding their features from their stored properties
+func groupReportsByHash(reports []Report) (map[string][]string, error) {
+	groups := make(map[string][]string)
+	for _, r := range reports {
+		f := geojson.NewFeature(r.Geometry)
+		f.Properties = r.Properties
+
+		hash, err := reportHash(f)
+		if err != nil {
+			return groups, err
+		}
+		groups[hash] = append(groups[hash], r.UUID)
+	}
+	return groups, nil
+}
+
+// Moves reports with an older hash version to the current one, rebuilding their features from their stored properties.
+// Reports from before properties were stored keep their old hash, they're upgraded if they're seen in a feed again.
+// Reports whose current hash would be shared, with each other or a report that already has it, keep their old hash
+// too and are returned as collisions, so they're never found by the wrong hash.
+// Returns the number of reports rehashed
+func RehashReports() (int, []hashCollision, error) {
+	q := `SELECT ` + reportColumns + ` FROM reports WHERE properties IS NOT NULL AND hash NOT LIKE $1`
+	rows, err := db.Query(q, reportHashPrefix+"%")
+	if err != nil {
+		return 0, nil, err
+	}
+
+	reports := []Report{}
+	for rows.Next() {
+		r, err := scanReport(rows)
+		if err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		reports = append(reports, r)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	groups, err := groupReportsByHash(reports)
+	if err != nil {
+		return 0, nil, err
+	}
+	hashes := make([]string, 0, len(groups))
+	for hash := range groups {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+
+	count := 0
+	collisions := []hashCollision{}
+	for _, hash := range hashes {
+		existing, err := GetReportUUIDForHash(hash)
+		if err != nil && err != sql.ErrNoRows {
+			return count, collisions, err
+		}
+		if len(groups[hash]) > 1 || existing != "" {
+			collisions = append(collisions, hashCollision{hash, groups[hash], existing})
+			continue
+		}
+
+		err = SetReportHash(groups[hash][0], hash)
+		if err != nil {
+			return count, collisions, err
+		}
+		count++
+	}
+
+	return count, collisions, nil
+}
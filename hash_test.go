@@ -0,0 +1,106 @@
+package main
+
+import (
+	"github.com/paulmach/go.geojson"
+	"strings"
+	"testing"
+)
+
+func hashTestFeature() *geojson.Feature {
+	f := geojson.NewFeature(geojson.NewCollectionGeometry(
+		geojson.NewPointGeometry([]float64{150.1234567, -33.7654321}),
+		geojson.NewPolygonGeometry([][][]float64{{{150, -33}, {151, -33}, {151, -34}, {150, -33}}}),
+	))
+	f.SetProperty("guid", "https://incidents.rfs.nsw.gov.au/api/v1/incidents/123")
+	f.SetProperty("title", "Wambelong")
+	f.SetProperty("pubDate", "1/12/2015 9:31:00 PM")
+	f.SetProperty("description", "ALERT LEVEL: Advice<br />STATUS: Out of control")
+	return f
+}
+
+func TestReportHashIsVersioned(t *testing.T) {
+	h, err := reportHash(hashTestFeature())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(h, "v2:") {
+		t.Errorf("Expected hash to be prefixed with its version, got %s", h)
+	}
+}
+
+func TestReportHashIgnoresCosmeticChanges(t *testing.T) {
+	a := hashTestFeature()
+
+	b := hashTestFeature()
+	// Nested differently, in a different order, with a little float noise
+	b.Geometry = geojson.NewCollectionGeometry(
+		geojson.NewCollectionGeometry(
+			geojson.NewPolygonGeometry([][][]float64{{{150, -33}, {151, -33}, {151, -34.0000000001}, {150, -33}}}),
+		),
+		geojson.NewPointGeometry([]float64{150.12345670001, -33.7654321}),
+	)
+	b.SetProperty("title", " Wambelong ")
+	b.SetProperty("someNewProperty", "Something")
+
+	ha, _ := reportHash(a)
+	hb, _ := reportHash(b)
+	if ha != hb {
+		t.Errorf("Expected cosmetic changes to keep the hash, got %s and %s", ha, hb)
+	}
+}
+
+func TestReportHashChangesWithContent(t *testing.T) {
+	a := hashTestFeature()
+
+	b := hashTestFeature()
+	b.SetProperty("description", "ALERT LEVEL: Emergency Warning<br />STATUS: Out of control")
+
+	c := hashTestFeature()
+	c.Geometry.Geometries[0] = geojson.NewPointGeometry([]float64{150.124, -33.7654321})
+
+	ha, _ := reportHash(a)
+	hb, _ := reportHash(b)
+	hc, _ := reportHash(c)
+	if ha == hb {
+		t.Error("Expected a changed description to change the hash")
+	}
+	if ha == hc {
+		t.Error("Expected a moved point to change the hash")
+	}
+}
+
+func TestGroupReportsByHash(t *testing.T) {
+	report := func(uuid string, f *geojson.Feature) Report {
+		return Report{UUID: uuid, Geometry: f.Geometry, Properties: f.Properties}
+	}
+
+	a := hashTestFeature()
+	// The same report as a, as the feed sent it another time, in a different order with more precision
+	b := hashTestFeature()
+	b.Geometry = geojson.NewCollectionGeometry(
+		geojson.NewPolygonGeometry([][][]float64{{{150, -33}, {151, -33}, {151, -34.0000000001}, {150, -33}}}),
+		geojson.NewPointGeometry([]float64{150.12345670001, -33.7654321}),
+	)
+	c := hashTestFeature()
+	c.SetProperty("description", "ALERT LEVEL: Emergency Warning<br />STATUS: Out of control")
+
+	if legacyReportHash(a) == legacyReportHash(b) {
+		t.Fatal("Expected a and b to have different legacy hashes")
+	}
+
+	groups, err := groupReportsByHash([]Report{report("a", a), report("b", b), report("c", c)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 {
+		t.Errorf("Expected 2 hashes, got %v", groups)
+	}
+	ha, _ := reportHash(a)
+	if strings.Join(groups[ha], ",") != "a,b" {
+		t.Errorf("Expected a and b to collide, got %v", groups)
+	}
+	hc, _ := reportHash(c)
+	if strings.Join(groups[hc], ",") != "c" {
+		t.Errorf("Expected c to have its own hash, got %v", groups)
+	}
+}
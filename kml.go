@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/paulmach/go.geojson"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KML colours are aabbggrr
+func kmlColour(rgba []int, alpha int) string {
+	return fmt.Sprintf("%02x%02x%02x%02x", alpha, rgba[2], rgba[1], rgba[0])
+}
+
+// The id of an alert level's style, e.g. watch-and-act. The feed's spelling of alert levels varies in case
+func kmlStyleId(alertLevel string) string {
+	level := alertLevels[alertLevelRank(alertLevel)]
+	if _, ok := alertLevelColours[level]; !ok {
+		return "other"
+	}
+	return strings.ToLower(strings.Replace(level, " ", "-", -1))
+}
+
+type kmlStyle struct {
+	Id        string `xml:"id,attr"`
+	IconColor string `xml:"IconStyle>color"`
+	LineColor string `xml:"LineStyle>color"`
+	LineWidth int    `xml:"LineStyle>width"`
+	PolyColor string `xml:"PolyStyle>color"`
+}
+
+type kmlTimeSpan struct {
+	Begin string `xml:"begin"`
+	End   string `xml:"end"`
+}
+
+type kmlPoint struct {
+	Coordinates string `xml:"coordinates"`
+}
+
+type kmlLineString struct {
+	Coordinates string `xml:"coordinates"`
+}
+
+type kmlPolygon struct {
+	Outer  string   `xml:"outerBoundaryIs>LinearRing>coordinates"`
+	Inners []string `xml:"innerBoundaryIs>LinearRing>coordinates"`
+}
+
+type kmlMultiGeometry struct {
+	Points      []kmlPoint      `xml:"Point"`
+	LineStrings []kmlLineString `xml:"LineString"`
+	Polygons    []kmlPolygon    `xml:"Polygon"`
+}
+
+// Fields are in the order the KML 2.2 schema wants them
+type kmlPlacemark struct {
+	Name        string            `xml:"name"`
+	Description string            `xml:"description,omitempty"`
+	TimeSpan    kmlTimeSpan       `xml:"TimeSpan"`
+	StyleUrl    string            `xml:"styleUrl"`
+	Geometry    *kmlMultiGeometry `xml:"MultiGeometry,omitempty"`
+}
+
+type kmlFolder struct {
+	Name       string         `xml:"name"`
+	Placemarks []kmlPlacemark `xml:"Placemark"`
+}
+
+type kmlDocument struct {
+	XMLName xml.Name    `xml:"http://www.opengis.net/kml/2.2 kml"`
+	Name    string      `xml:"Document>name"`
+	Styles  []kmlStyle  `xml:"Document>Style"`
+	Folders []kmlFolder `xml:"Document>Folder"`
+}
+
+// Positions as KML coordinates, lon,lat separated by spaces
+func kmlCoordinates(positions [][]float64) string {
+	coordinates := []string{}
+	for _, p := range positions {
+		coordinates = append(coordinates, strconv.FormatFloat(p[0], 'f', -1, 64)+","+strconv.FormatFloat(p[1], 'f', -1, 64))
+	}
+	return strings.Join(coordinates, " ")
+}
+
+// The geometry's points, lines and polygons. nil when it doesn't have any
+func kmlGeometry(g *geojson.Geometry) *kmlMultiGeometry {
+	if g == nil {
+		return nil
+	}
+
+	m := &kmlMultiGeometry{}
+	addPolygon := func(rings [][][]float64) {
+		if len(rings) == 0 {
+			return
+		}
+		p := kmlPolygon{Outer: kmlCoordinates(rings[0])}
+		for _, inner := range rings[1:] {
+			p.Inners = append(p.Inners, kmlCoordinates(inner))
+		}
+		m.Polygons = append(m.Polygons, p)
+	}
+
+	geoms := []*geojson.Geometry{g}
+	if g.IsCollection() {
+		geoms = flattenGeometries(g.Geometries)
+	}
+	for _, g := range geoms {
+		switch g.Type {
+		case geojson.GeometryPoint:
+			m.Points = append(m.Points, kmlPoint{kmlCoordinates([][]float64{g.Point})})
+		case geojson.GeometryMultiPoint:
+			for _, p := range g.MultiPoint {
+				m.Points = append(m.Points, kmlPoint{kmlCoordinates([][]float64{p})})
+			}
+		case geojson.GeometryLineString:
+			m.LineStrings = append(m.LineStrings, kmlLineString{kmlCoordinates(g.LineString)})
+		case geojson.GeometryMultiLineString:
+			for _, l := range g.MultiLineString {
+				m.LineStrings = append(m.LineStrings, kmlLineString{kmlCoordinates(l)})
+			}
+		case geojson.GeometryPolygon:
+			addPolygon(g.Polygon)
+		case geojson.GeometryMultiPolygon:
+			for _, p := range g.MultiPolygon {
+				addPolygon(p)
+			}
+		}
+	}
+
+	if len(m.Points) == 0 && len(m.LineStrings) == 0 && len(m.Polygons) == 0 {
+		return nil
+	}
+	return m
+}
+
+// A style for each alert level, coloured as they are on animated maps, with translucent polygons
+func kmlStyles() []kmlStyle {
+	styles := []kmlStyle{}
+	for _, level := range alertLevels {
+		colour, ok := alertLevelColours[level]
+		if !ok {
+			continue
+		}
+		styles = append(styles, kmlStyle{kmlStyleId(level), kmlColour(colour, 255), kmlColour(colour, 255), 2, kmlColour(colour, 0x66)})
+	}
+	return append(styles, kmlStyle{kmlStyleId(""), kmlColour(defaultAlertLevelColour, 255), kmlColour(defaultAlertLevelColour, 255), 2, kmlColour(defaultAlertLevelColour, 0x66)})
+}
+
+// A KML document with a folder for each incident, named after its latest report, with a placemark for each of its
+// reports lasting as long as it was the latest, so Google Earth's time slider shows one report of each incident at a time
+func kmlDocumentOf(name string, incidents []incidentTimeline) kmlDocument {
+	doc := kmlDocument{Name: name, Styles: kmlStyles(), Folders: []kmlFolder{}}
+
+	for _, i := range incidents {
+		folder := kmlFolder{Name: fmt.Sprintf("%s (%d)", i.Latest().Report.Title, i.RFSId)}
+		for _, e := range i.Entries {
+			r := e.Report
+			p := kmlPlacemark{
+				Name:        r.Pubdate.In(feedLocation).Format("2006-01-02 15:04") + " " + r.AlertLevel,
+				TimeSpan:    kmlTimeSpan{e.Start.UTC().Format(time.RFC3339), e.End.UTC().Format(time.RFC3339)},
+				StyleUrl:    "#" + kmlStyleId(r.AlertLevel),
+				Description: r.Description,
+				Geometry:    kmlGeometry(r.Geometry),
+			}
+			folder.Placemarks = append(folder.Placemarks, p)
+		}
+		doc.Folders = append(doc.Folders, folder)
+	}
+
+	return doc
+}
+
+func writeKML(w io.Writer, name string, incidents []incidentTimeline) error {
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(kmlDocumentOf(name, incidents))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"github.com/paulmach/go.geojson"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportFormat(t *testing.T) {
+	cases := map[[2]string]string{
+		{"incidents.kml", ""}:       exportKML,
+		{"incidents.GPKG", ""}:      exportGeoPackage,
+		{"incidents", "gpkg"}:       exportGeoPackage,
+		{"incidents.kml", "gpkg"}:   exportGeoPackage,
+		{"incidents", "geopackage"}: exportGeoPackage,
+	}
+	for c, expected := range cases {
+		if format, err := exportFormat(c[0], c[1]); err != nil || format != expected {
+			t.Errorf("Expected %v to be %s, got %s %v", c, expected, format, err)
+		}
+	}
+	if _, err := exportFormat("incidents.shp", ""); err == nil {
+		t.Error("Expected a shapefile to be an error")
+	}
+}
+
+func TestKML(t *testing.T) {
+	if c := kmlColour([]int{228, 26, 28, 255}, 0x66); c != "661c1ae4" {
+		t.Errorf("Expected aabbggrr, got %s", c)
+	}
+
+	for level, expected := range map[string]string{"Emergency warning": "emergency-warning", " watch and act ": "watch-and-act", "Not Applicable": "other", "": "other"} {
+		if id := kmlStyleId(level); id != expected {
+			t.Errorf("Expected %q's style to be %s, got %s", level, expected, id)
+		}
+	}
+
+	first := Report{
+		IncidentUUID: "i",
+		Title:        "Cobbitty Rd, Cobbitty",
+		AlertLevel:   "Advice",
+		Description:  "STATUS: Under control",
+		Pubdate:      time.Date(2015, 12, 1, 10, 31, 0, 0, time.UTC),
+		Geometry:     geojson.NewPointGeometry([]float64{150.65, -34.05}),
+	}
+	latest := first
+	latest.AlertLevel = "Watch and Act"
+	latest.Pubdate = first.Pubdate.Add(time.Hour)
+	latest.Geometry = geojson.NewCollectionGeometry(
+		geojson.NewPointGeometry([]float64{150.65, -34.05}),
+		geojson.NewPolygonGeometry([][][]float64{{{150.6, -34}, {150.7, -34}, {150.7, -34.1}, {150.6, -34}}}),
+	)
+	other := first
+	other.IncidentUUID = "j"
+
+	incidents := groupTimeline([]TimelineEntry{
+		{123456, first, first.Pubdate, latest.Pubdate},
+		{654321, other, other.Pubdate, other.Pubdate},
+		{123456, latest, latest.Pubdate, latest.Pubdate.Add(time.Hour)},
+	})
+	if len(incidents) != 2 || len(incidents[0].Entries) != 2 || incidents[0].Latest().Report.AlertLevel != "Watch and Act" {
+		t.Fatalf("Unexpected incidents %+v", incidents)
+	}
+
+	doc := kmlDocumentOf("Incidents", incidents)
+	if len(doc.Styles) != 4 || doc.Folders[0].Name != "Cobbitty Rd, Cobbitty (123456)" || len(doc.Folders[0].Placemarks) != 2 {
+		t.Errorf("Unexpected document %+v", doc)
+	}
+	p := doc.Folders[0].Placemarks[1]
+	if p.StyleUrl != "#watch-and-act" || p.TimeSpan.Begin != "2015-12-01T11:31:00Z" || len(p.Geometry.Polygons) != 1 || len(p.Geometry.Points) != 1 {
+		t.Errorf("Unexpected placemark %+v", p)
+	}
+
+	var b bytes.Buffer
+	if err := writeKML(&b, "Incidents", incidents); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		`<kml xmlns="http://www.opengis.net/kml/2.2">`,
+		// The schema wants a description before the time span and style
+		"<description>STATUS: Under control</description>\n        <TimeSpan>",
+		`<Style id="watch-and-act">`,
+		`<coordinates>150.6,-34 150.7,-34 150.7,-34.1 150.6,-34</coordinates>`,
+	} {
+		if !strings.Contains(b.String(), s) {
+			t.Errorf("Expected the KML to contain %s, got %s", s, b.String())
+		}
+	}
+	if strings.Count(b.String(), "<Document>") != 1 {
+		t.Errorf("Expected one document, got %s", b.String())
+	}
+}
@@ -1,9 +1,7 @@
 package main
 
 import (
-	"crypto/sha1"
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"github.com/codegangsta/cli"
 	"github.com/franela/goreq"
@@ -21,9 +19,18 @@ import (
 
 var db *sql.DB // Global for database connection
 
+// The database, or a transaction on it, so a change and the events it causes can be written together
+type dbQueryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Prepare(query string) (*sql.Stmt, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
 func ImportFromFile(path string) error {
 	// Check if the file exists / or if there's a permissions error there
-	if _, err := os.Stat(path); err != nil {
+	info, err := os.Stat(path)
+	if err != nil {
 		return err
 	}
 
@@ -32,6 +39,9 @@ func ImportFromFile(path string) error {
 		return err
 	}
 
+	// Collected files were written when they were fetched
+	archiveFeed(contents, path, info.ModTime())
+
 	err = ImportGeoJSON(contents)
 	if err != nil {
 		return err
@@ -58,6 +68,8 @@ func ImportFromURI(u *url.URL) error {
 		return err
 	}
 
+	archiveFeed(contents, u.String(), time.Now())
+
 	err = ImportGeoJSON(contents)
 	if err != nil {
 		return err
@@ -66,12 +78,25 @@ func ImportFromURI(u *url.URL) error {
 	return nil
 }
 
+// Archives the raw feed before it's imported, so it's kept even if the import fails.
+// Failing to archive shouldn't stop the import
+func archiveFeed(contents []byte, source string, fetchedAt time.Time) {
+	s, err := ArchiveFeed(contents, source, fetchedAt)
+	if err != nil {
+		fmt.Printf("\nError archiving feed %v\n", err)
+		return
+	}
+	log.Printf("Archived feed %s (fetched %d times)\n", s.Hash, s.FetchCount)
+}
+
 // Imports from loc. Loc being a path or a URL
 func ImportFrom(loc string) error {
 	var err error
 
 	// We log metrics at the end, so we need to know current details before db changes
 	stCiCount, _ := GetNumCurrentIncidents()
+	// Events recorded after this one are published once the import's done
+	lastEventId, lastEventErr := GetLatestEventId()
 
 	// Argument could be URL or path
 	if u, urlErr := url.Parse(loc); urlErr == nil {
@@ -90,6 +115,28 @@ func ImportFrom(loc string) error {
 	// If we're here, things have been success. Log stats to Librato
 	_ = logMetrics(stCiCount)
 
+	// Let anyone listening know about the changes, now they're committed
+	if lastEventErr == nil {
+		count, err := PublishNotifications(lastEventId)
+		if err != nil {
+			fmt.Printf("\nError publishing notifications %v\n", err)
+		} else if count > 0 {
+			log.Printf("Published %d notifications on %s\n", count, notifyChannel)
+		}
+
+		if len(capDir) > 0 {
+			count, err = WriteCAPFiles(capDir, lastEventId)
+			if err != nil {
+				fmt.Printf("\nError writing CAP messages %v\n", err)
+			} else if count > 0 {
+				log.Printf("Wrote %d CAP messages to %s\n", count, capDir)
+			}
+		}
+	}
+
+	// Queue what's happened for webhooks, they're delivered separately
+	queueWebhooks()
+
 	return nil
 }
 
@@ -117,6 +164,8 @@ func logMetrics(currentIncidents int) error {
 	numCurrentIncidents, _ := GetNumCurrentIncidents()
 	// - [Gauge] Change in current incidents
 	changeCurrentIncidents := numCurrentIncidents - currentIncidents
+	// - [Counter] Total number of times the feed's schema has drifted
+	numSchemaDriftEvents, _ := GetNumSchemaDriftEvents()
 
 	// Sent to Librato
 	rep := m.GetCounter("reports.total")
@@ -135,6 +184,10 @@ func logMetrics(currentIncidents int) error {
 	chCuInc <- int64(changeCurrentIncidents)
 	fmt.Printf("Librato current_incidents.change <- %d\n", int64(changeCurrentIncidents))
 
+	drift := m.GetCounter("schema_drift.total")
+	drift <- int64(numSchemaDriftEvents)
+	fmt.Printf("Librato schema_drift.total <- %d\n", int64(numSchemaDriftEvents))
+
 	return nil
 }
 
@@ -149,6 +202,12 @@ func ImportGeoJSON(data []byte) error {
 		return err
 	}
 
+	// Warn if RFS have changed the shape of the feed. This shouldn't stop the import
+	_, err = feedSchemaFromFeatureCollection(fc).Check()
+	if err != nil {
+		fmt.Printf("\nError checking feed schema %v\n", err)
+	}
+
 	// For the incidents in our new data
 	var incidents []Incident
 
@@ -181,9 +240,46 @@ func ImportGeoJSON(data []byte) error {
 		return err
 	}
 
+	inserted := insertedReports(incidents)
+
+	// See whether the new reports have brought incidents into (or out of) geofences. This shouldn't stop the import
+	_, err = CheckGeofences(inserted)
+	if err != nil {
+		fmt.Printf("\nError checking geofences %v\n", err)
+	}
+
+	// Note the assets nearest to the new reports
+	_, err = AnnotateReportsWithAssets(inserted)
+	if err != nil {
+		fmt.Printf("\nError finding assets near reports %v\n", err)
+	}
+
+	// Work out where the new reports are from the boundaries, rather than the feed
+	_, err = EnrichReports(inserted)
+	if err != nil {
+		fmt.Printf("\nError enriching reports with boundaries %v\n", err)
+	}
+
+	// Add the new perimeters to the burnt area of their incidents and seasons
+	err = UpdateFootprints(db, inserted)
+	if err != nil {
+		fmt.Printf("\nError updating footprints %v\n", err)
+	}
+
 	return nil
 }
 
+// The reports inserted during an import. Reports we already had don't have a UUID
+func insertedReports(incidents []Incident) []Report {
+	reports := []Report{}
+	for _, i := range incidents {
+		if len(i.Reports) > 0 && i.Reports[len(i.Reports)-1].UUID != "" {
+			reports = append(reports, i.Reports[len(i.Reports)-1])
+		}
+	}
+	return reports
+}
+
 func UpdateCurrentIncidents(incidents []Incident) error {
 	// We have a collection of incidents
 	// These incidents are now considered "current"
@@ -203,18 +299,61 @@ func UpdateCurrentIncidents(incidents []Incident) error {
 	}
 	// We've got a slice of ["$1", "$2" ...]
 
+	// Resolve the incidents and record their events together, so the outbox has every resolution
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	// Set all current incidents who aren't in this collection of incidents to not current
-	q := fmt.Sprintf(`UPDATE incidents SET current = false WHERE current = true AND uuid NOT IN (%s)`, strings.Join(ins, ","))
-	stmt, err := db.Prepare(q)
+	q := fmt.Sprintf(`UPDATE incidents SET current = false WHERE current = true AND uuid NOT IN (%s) RETURNING uuid`, strings.Join(ins, ","))
+	stmt, err := tx.Prepare(q)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(args...)
+	rows, err := stmt.Query(args...)
 	if err != nil {
 		return err
 	}
+	resolved := []string{}
+	for rows.Next() {
+		var uuid string
+		err = rows.Scan(&uuid)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		resolved = append(resolved, uuid)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	// The incidents no longer in the feed have been resolved
+	now := time.Now()
+	for _, uuid := range resolved {
+		e := IncidentEvent{IncidentUUID: uuid, Type: eventIncidentResolved, OccurredAt: now}
+		err = e.Insert(tx)
+		if err != nil {
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	for _, uuid := range resolved {
+		// It's left any geofences it was in. This shouldn't stop the import
+		_, err = ExitGeofences(uuid, now)
+		if err != nil {
+			fmt.Printf("\nError exiting geofences %v\n", err)
+		}
+	}
 
 	// Now the only incidents marked as current in the database will be from this update
 
@@ -278,11 +417,12 @@ func reportFromFeature(f *geojson.Feature) (Report, error) {
 	r := Report{}
 	var err error
 
-	// Generate hash of json representation of item
-	s, _ := json.Marshal(f)
-	h := sha1.New()
-	h.Write([]byte(s))
-	r.Hash = fmt.Sprintf("%x", h.Sum(nil))
+	// Hash the meaningful content of the item, so we can tell if we've seen this report before
+	r.Hash, err = reportHash(f)
+	if err != nil {
+		return r, err
+	}
+	r.LegacyHash = legacyReportHash(f)
 
 	r.Guid, _ = f.PropertyString("guid")
 	r.Title, _ = f.PropertyString("title")
@@ -293,10 +433,8 @@ func reportFromFeature(f *geojson.Feature) (Report, error) {
 	r.Geometry = mergeNestedGeometryCollections(f.Geometry)
 
 	// Pubdate should be of type time
-	// "1/12/2015 9:31:00 PM" as "2006/01/02 15:04:05+00"
-	pubdateFormat := "2/1/2006 3:04:00 PM"
 	dateStr, _ := f.PropertyString("pubDate")
-	r.Pubdate, err = time.Parse(pubdateFormat, dateStr)
+	r.Pubdate, _, err = parsePubdate(dateStr)
 	if err != nil {
 		return r, err
 	}
@@ -308,9 +446,7 @@ func reportFromFeature(f *geojson.Feature) (Report, error) {
 
 	// Pull expected details into the struct as fields
 
-	loc, _ := time.LoadLocation("Australia/Sydney")
-	updatedFormat := "2 Jan 2006 15:04"
-	r.Updated, err = time.ParseInLocation(updatedFormat, details["updated"], loc) // Convert to time
+	r.Updated, _, err = parseUpdated(details["updated"]) // Convert to time
 	if err != nil {
 		return r, err
 	}
@@ -325,6 +461,10 @@ func reportFromFeature(f *geojson.Feature) (Report, error) {
 	r.ResponsibleAgency = details["responsible_agency"]
 	r.Extra = details["extra"]
 
+	// Keep everything, including keys we don't (yet) have columns for
+	r.Properties = f.Properties
+	r.Details = details
+
 	return r, nil
 }
 
@@ -421,7 +561,68 @@ func main() {
 	app.Version = "0.1.0"
 	app.Usage = "Import data from an RFS GeoRSS feed"
 	app.Flags = []cli.Flag{
-		cli.StringFlag{"tick,t", "", "import from URL every n seconds (e.g 3600)"},
+		cli.StringFlag{Name: "tick,t", Value: "", Usage: "import from URL every n seconds (e.g 3600)"},
+		cli.IntFlag{Name: "archive-retention", Value: 0, Usage: "days to keep archived raw feeds for, 0 keeps them forever (defaults to $ARCHIVE_RETENTION_DAYS)"},
+		cli.StringFlag{Name: "timezone", Value: "", Usage: "timezone of times in the feed (defaults to $FEED_TIMEZONE or Australia/Sydney)"},
+		cli.StringFlag{Name: "notify-channel", Value: "", Usage: "channel to NOTIFY with import changes (defaults to $NOTIFY_CHANNEL, none when empty)"},
+		cli.StringFlag{Name: "cap-dir", Value: "", Usage: "directory to write a CAP 1.2 message to for each alert level change after each import (defaults to $CAP_DIR, none when empty)"},
+		cli.StringFlag{Name: "cap-sender", Value: "", Usage: "sender of CAP messages (defaults to $CAP_SENDER or incidentworker)"},
+		cli.StringFlag{Name: "outbox-sinks", Value: "", Usage: "where to dispatch outbox messages, comma separated file:<path>, notify:<channel> or URLs (defaults to $OUTBOX_SINKS)"},
+	}
+	app.Before = func(c *cli.Context) error {
+		archiveRetentionDays = c.Int("archive-retention")
+		if archiveRetentionDays == 0 && len(os.Getenv("ARCHIVE_RETENTION_DAYS")) > 0 {
+			days, err := strconv.Atoi(os.Getenv("ARCHIVE_RETENTION_DAYS"))
+			if err != nil {
+				return err
+			}
+			archiveRetentionDays = days
+		}
+
+		notifyChannel = c.String("notify-channel")
+		if len(notifyChannel) == 0 {
+			notifyChannel = os.Getenv("NOTIFY_CHANNEL")
+		}
+
+		capDir = c.String("cap-dir")
+		if len(capDir) == 0 {
+			capDir = os.Getenv("CAP_DIR")
+		}
+		if sender := c.String("cap-sender"); len(sender) > 0 {
+			capSender = sender
+		} else if len(os.Getenv("CAP_SENDER")) > 0 {
+			capSender = os.Getenv("CAP_SENDER")
+		}
+
+		sinks := c.String("outbox-sinks")
+		if len(sinks) == 0 {
+			sinks = os.Getenv("OUTBOX_SINKS")
+		}
+		var err error
+		outboxSinks, err = parseOutboxSinks(sinks)
+		if err != nil {
+			return err
+		}
+
+		return SetFeedTimezone(c.String("timezone"))
+	}
+	app.Commands = []cli.Command{
+		reprocessCommand(),
+		rehashCommand(),
+		incidentCommand(),
+		eventsCommand(),
+		serveCommand(),
+		webhooksCommand(),
+		geofencesCommand(),
+		assetsCommand(),
+		boundariesCommand(),
+		footprintsCommand(),
+		asofCommand(),
+		timelineCommand(),
+		outboxCommand(),
+		capCommand(),
+		exportCommand(),
+		sitrepCommand(),
 	}
 	app.Action = func(c *cli.Context) {
 		if len(c.Args()) == 0 {
@@ -438,6 +639,12 @@ func main() {
 
 			log.Printf("Importing from %s every %d seconds\n", loc, sec)
 
+			// Outbox messages are dispatched as they're written, not just after each import
+			if len(outboxSinks) > 0 {
+				go RunOutboxDispatcher(outboxDispatchInterval)
+			}
+			go RunWebhookDeliverer(webhookDeliveryInterval)
+
 			ticker := time.NewTicker(time.Second * time.Duration(sec))
 			for t := range ticker.C {
 				log.Printf("Importing at %v\n", t)
@@ -455,8 +662,12 @@ func main() {
 			if err != nil {
 				log.Fatal(err)
 			}
+			deliverWebhooks()
+			dispatchOutbox()
 		}
 	}
 
-	app.Run(os.Args)
+	if err := app.Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
 }
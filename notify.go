@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// The channel import changes are published on with NOTIFY. Empty doesn't publish anything
+var notifyChannel string
+
+// Postgres drops notifications with payloads longer than this
+const notifyMaxPayload = 8000
+
+// Events published on the channel: new incidents, new reports, and incidents leaving and coming back to the feed
+var notifyEventTypes = []string{eventIncidentCreated, eventReportInserted, eventIncidentResolved, eventIncidentReopened}
+
+// A notification's payload, kept small so it fits. Consumers can look up the rest
+type Notification struct {
+	Id           int       `json:"id"` // Of the event
+	Type         string    `json:"type"`
+	RFSId        int       `json:"rfs_id"`
+	IncidentUUID string    `json:"incident_uuid"`
+	ReportUUID   string    `json:"report_uuid,omitempty"`
+	Current      bool      `json:"current"` // Whether the incident's in the feed after this
+	OccurredAt   time.Time `json:"occurred_at"`
+}
+
+func notificationPayload(e IncidentEvent) ([]byte, error) {
+	payload, err := json.Marshal(Notification{
+		Id:           e.Id,
+		Type:         e.Type,
+		RFSId:        e.RFSId,
+		IncidentUUID: e.IncidentUUID,
+		ReportUUID:   e.ReportUUID,
+		Current:      e.Type != eventIncidentResolved,
+		OccurredAt:   e.OccurredAt.UTC(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) > notifyMaxPayload {
+		return nil, fmt.Errorf("Notification for event %d is too long", e.Id)
+	}
+	return payload, nil
+}
+
+// Publishes the events recorded since an event id on the notify channel. They're sent in one transaction, so
+// consumers get them together once it's committed, after the import's own changes. Returns how many were published
+func PublishNotifications(since int) (int, error) {
+	if notifyChannel == "" {
+		return 0, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	count := 0
+	for {
+		events, err := GetIncidentEvents(EventQuery{Since: since, Types: notifyEventTypes, Limit: 500})
+		if err != nil {
+			return 0, err
+		}
+		if len(events) == 0 {
+			break
+		}
+
+		for _, e := range events {
+			payload, err := notificationPayload(e)
+			if err != nil {
+				return 0, err
+			}
+			_, err = tx.Exec(`SELECT pg_notify($1, $2)`, notifyChannel, string(payload))
+			if err != nil {
+				return 0, err
+			}
+			count++
+		}
+		since = events[len(events)-1].Id
+	}
+
+	return count, tx.Commit()
+}
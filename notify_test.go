@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestNotificationPayload(t *testing.T) {
+	e := IncidentEvent{
+		Id:           42,
+		IncidentUUID: "i",
+		RFSId:        123456,
+		Type:         eventIncidentResolved,
+		OccurredAt:   time.Date(2015, 12, 1, 21, 31, 0, 0, time.FixedZone("AEDT", 11*60*60)),
+	}
+
+	payload, err := notificationPayload(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"id":42,"type":"incident_resolved","rfs_id":123456,"incident_uuid":"i","current":false,"occurred_at":"2015-12-01T10:31:00Z"}`
+	if string(payload) != expected {
+		t.Errorf("Expected %s, got %s", expected, payload)
+	}
+
+	e.Type = eventReportInserted
+	e.ReportUUID = "r"
+	payload, _ = notificationPayload(e)
+	n := Notification{}
+	if err = json.Unmarshal(payload, &n); err != nil {
+		t.Fatal(err)
+	}
+	if !n.Current || n.ReportUUID != "r" {
+		t.Errorf("Expected a current incident with the report, got %+v", n)
+	}
+}
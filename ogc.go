@@ -0,0 +1,522 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/paulmach/go.geojson"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OGC API - Features conformance classes implemented
+var ogcConformance = []string{
+	"http://www.opengis.net/spec/ogcapi-features-1/1.0/conf/core",
+	"http://www.opengis.net/spec/ogcapi-features-1/1.0/conf/geojson",
+	"http://www.opengis.net/spec/ogcapi-features-1/1.0/conf/oas30",
+}
+
+// Paging limits for items
+const (
+	ogcDefaultLimit = 100
+	ogcMaxLimit     = 1000
+)
+
+// A collection of features. Its query selects each feature's id, geometry, start_at and end_at (the times datetime
+// filters on) and properties (as jsonb) from whichever tables back it
+type ogcCollection struct {
+	Id          string
+	Title       string
+	Description string
+	Query       string
+	Args        func() []interface{} // The query's arguments
+}
+
+const ogcReportProperties = `'title', reports.title, 'link', reports.link, 'category', reports.category, 'pubdate', reports.pubdate,
+  'updated', reports.updated, 'alert_level', reports.alert_level, 'location', reports.location, 'council_area', reports.council_area,
+  'status', reports.status, 'fire_type', reports.fire_type, 'fire', reports.fire, 'size', reports.size,
+  'responsible_agency', reports.responsible_agency`
+
+var ogcCollections = []ogcCollection{
+	{
+		Id:          "incidents-current",
+		Title:       "Current incidents",
+		Description: "Incidents in the feed now, each with its latest report",
+		Query: `SELECT reports.rfs_id::text AS id, reports.geometry, reports.pubdate AS start_at, reports.pubdate AS end_at,
+        jsonb_build_object('rfs_id', reports.rfs_id, 'incident_uuid', reports.incident_uuid, 'report_uuid', reports.uuid, ` + ogcReportProperties + `) AS properties
+      FROM (` + currentReportsQuery + `) reports`,
+		Args: func() []interface{} { return nil },
+	},
+	{
+		Id:          "reports",
+		Title:       "Reports",
+		Description: "Every report of every incident, as it was published",
+		Query: `SELECT reports.uuid::text AS id, reports.geometry, reports.pubdate AS start_at, reports.pubdate AS end_at,
+        jsonb_build_object('rfs_id', i.rfs_id, 'incident_uuid', reports.incident_uuid, 'report_uuid', reports.uuid, ` + ogcReportProperties + `) AS properties
+      FROM reports
+      JOIN incidents i ON i.uuid = reports.incident_uuid`,
+		Args: func() []interface{} { return nil },
+	},
+	{
+		Id:          "incident-history",
+		Title:       "Incident history",
+		Description: "Every incident, current or not, with when it was first and last seen and its latest report",
+		Query: `SELECT i.rfs_id::text AS id, reports.geometry, lower(i.current_from) AS start_at, upper(i.current_from) AS end_at,
+        jsonb_build_object('rfs_id', i.rfs_id, 'incident_uuid', i.uuid, 'current', i.current, 'first_seen', lower(i.current_from),
+          'last_seen', upper(i.current_from), 'reports', n.count, 'report_uuid', reports.uuid, ` + ogcReportProperties + `) AS properties
+      FROM incidents i
+      JOIN LATERAL (SELECT * FROM reports WHERE reports.incident_uuid = i.uuid ORDER BY pubdate DESC, created_at DESC LIMIT 1) reports ON true
+      JOIN LATERAL (SELECT COUNT(*) AS count FROM reports WHERE reports.incident_uuid = i.uuid) n ON true`,
+		Args: func() []interface{} { return nil },
+	},
+}
+
+func getOGCCollection(id string) (ogcCollection, bool) {
+	for _, c := range ogcCollections {
+		if c.Id == id {
+			return c, true
+		}
+	}
+	return ogcCollection{}, false
+}
+
+// Filters and paging for items
+type ogcItemsQuery struct {
+	BBox   []float64  // minx, miny, maxx, maxy, or empty
+	From   *time.Time // Open when nil
+	To     *time.Time // Open when nil
+	Limit  int
+	Offset int
+}
+
+type ogcLink struct {
+	Href  string `json:"href"`
+	Rel   string `json:"rel"`
+	Type  string `json:"type,omitempty"`
+	Title string `json:"title,omitempty"`
+}
+
+type ogcFeatureCollection struct {
+	Type           string             `json:"type"`
+	Features       []*geojson.Feature `json:"features"`
+	Links          []ogcLink          `json:"links"`
+	TimeStamp      string             `json:"timeStamp"`
+	NumberMatched  int                `json:"numberMatched"`
+	NumberReturned int                `json:"numberReturned"`
+}
+
+// Parses a bbox parameter, minx,miny,maxx,maxy. Heights in a 6 number bbox are ignored
+func parseBBox(s string) ([]float64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 && len(parts) != 6 {
+		return nil, fmt.Errorf("Expected bbox as minx,miny,maxx,maxy, got %q", s)
+	}
+	values := make([]float64, len(parts))
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return nil, fmt.Errorf("Expected bbox as minx,miny,maxx,maxy, got %q", s)
+		}
+		values[i] = v
+	}
+	if len(values) == 6 {
+		values = []float64{values[0], values[1], values[3], values[4]}
+	}
+	if values[1] > values[3] {
+		return nil, fmt.Errorf("bbox's miny is greater than its maxy")
+	}
+	return values, nil
+}
+
+// Parses a datetime parameter: an instant, or an interval of two instants separated by / where either can be
+// .. or empty to leave it open
+func parseDatetime(s string) (*time.Time, *time.Time, error) {
+	if s == "" {
+		return nil, nil, nil
+	}
+
+	parse := func(v string) (*time.Time, error) {
+		if v == "" || v == ".." {
+			return nil, nil
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, fmt.Errorf("Expected datetime as RFC3339, got %q", v)
+		}
+		return &t, nil
+	}
+
+	if !strings.Contains(s, "/") {
+		t, err := parse(s)
+		if err != nil || t == nil {
+			return nil, nil, fmt.Errorf("Expected datetime as RFC3339, got %q", s)
+		}
+		return t, t, nil
+	}
+
+	parts := strings.SplitN(s, "/", 2)
+	from, err := parse(parts[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	to, err := parse(parts[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	if from != nil && to != nil && to.Before(*from) {
+		return nil, nil, fmt.Errorf("datetime's end is before its start")
+	}
+	return from, to, nil
+}
+
+// Builds the where clause for the filters, numbering its placeholders after the collection's own arguments
+func (q ogcItemsQuery) where(args []interface{}) (string, []interface{}) {
+	conditions := []string{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if len(q.BBox) == 4 {
+		conditions = append(conditions, fmt.Sprintf("items.geometry && ST_MakeEnvelope(%s, %s, %s, %s, 4326)",
+			arg(q.BBox[0]), arg(q.BBox[1]), arg(q.BBox[2]), arg(q.BBox[3])))
+	}
+	if q.From != nil {
+		conditions = append(conditions, "items.end_at >= "+arg(q.From.UTC().Format(time.RFC3339))+"::timestamptz")
+	}
+	if q.To != nil {
+		conditions = append(conditions, "items.start_at <= "+arg(q.To.UTC().Format(time.RFC3339))+"::timestamptz")
+	}
+
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// Fetches a page of a collection's features, and how many features match the filters
+func GetOGCItems(c ogcCollection, q ogcItemsQuery) ([]*geojson.Feature, int, error) {
+	features := []*geojson.Feature{}
+
+	where, args := q.where(c.Args())
+	from := `(` + c.Query + `) items` + where
+
+	var matched int
+	err := db.QueryRow(`SELECT COUNT(*) FROM `+from, args...).Scan(&matched)
+	if err != nil {
+		return features, 0, err
+	}
+
+	args = append(args, q.Limit, q.Offset)
+	rows, err := db.Query(fmt.Sprintf(`SELECT items.id, COALESCE(ST_AsGeoJSON(items.geometry), ''), items.properties FROM %s
+    ORDER BY items.start_at DESC, items.id
+    LIMIT $%d OFFSET $%d`, from, len(args)-1, len(args)), args...)
+	if err != nil {
+		return features, matched, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		f, err := scanOGCFeature(rows)
+		if err != nil {
+			return features, matched, err
+		}
+		features = append(features, f)
+	}
+
+	return features, matched, rows.Err()
+}
+
+// Fetches one of a collection's features
+func GetOGCItem(c ogcCollection, id string) (*geojson.Feature, error) {
+	args := append(c.Args(), id)
+	row := db.QueryRow(fmt.Sprintf(`SELECT items.id, COALESCE(ST_AsGeoJSON(items.geometry), ''), items.properties FROM (%s) items
+    WHERE items.id = $%d`, c.Query, len(args)), args...)
+	return scanOGCFeature(row)
+}
+
+func scanOGCFeature(row rowScanner) (*geojson.Feature, error) {
+	var id, geom string
+	var props []byte
+	err := row.Scan(&id, &geom, &props)
+	if err != nil {
+		return nil, err
+	}
+
+	f := geojson.NewFeature(nil)
+	f.ID = id
+	if geom != "" {
+		f.Geometry, err = geojson.UnmarshalGeometry([]byte(geom))
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = json.Unmarshal(props, &f.Properties)
+	return f, err
+}
+
+// The spatial and temporal extent of a collection's features
+func GetOGCExtent(c ogcCollection) (map[string]interface{}, error) {
+	var minx, miny, maxx, maxy *float64
+	var start, end *time.Time
+	err := db.QueryRow(`SELECT ST_XMin(e.extent), ST_YMin(e.extent), ST_XMax(e.extent), ST_YMax(e.extent), e.start_at, e.end_at
+    FROM (SELECT ST_Extent(items.geometry) AS extent, MIN(items.start_at) AS start_at, MAX(items.end_at) AS end_at FROM (`+c.Query+`) items) e`, c.Args()...).Scan(&minx, &miny, &maxx, &maxy, &start, &end)
+	if err != nil {
+		return nil, err
+	}
+
+	extent := make(map[string]interface{})
+	if minx != nil {
+		extent["spatial"] = map[string]interface{}{
+			"bbox": [][]float64{{*minx, *miny, *maxx, *maxy}},
+			"crs":  "http://www.opengis.net/def/crs/OGC/1.3/CRS84",
+		}
+	}
+	interval := []interface{}{nil, nil}
+	if start != nil {
+		interval[0] = start.UTC().Format(time.RFC3339)
+	}
+	if end != nil {
+		interval[1] = end.UTC().Format(time.RFC3339)
+	}
+	extent["temporal"] = map[string]interface{}{"interval": [][]interface{}{interval}}
+	return extent, nil
+}
+
+// The URL the API's being served from, e.g. https://incidentworker.example.com
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+func ogcCollectionMetadata(base string, c ogcCollection, extent map[string]interface{}) map[string]interface{} {
+	collectionURL := base + "/collections/" + c.Id
+	return map[string]interface{}{
+		"id":          c.Id,
+		"title":       c.Title,
+		"description": c.Description,
+		"itemType":    "feature",
+		"crs":         []string{"http://www.opengis.net/def/crs/OGC/1.3/CRS84"},
+		"extent":      extent,
+		"links": []ogcLink{
+			{Href: collectionURL, Rel: "self", Type: "application/json", Title: "This collection"},
+			{Href: collectionURL + "/items", Rel: "items", Type: "application/geo+json", Title: c.Title},
+		},
+	}
+}
+
+// GET /
+// The OGC API - Features landing page
+func handleLandingPage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Not found"))
+		return
+	}
+
+	base := baseURL(r)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"title":       "incidentworker",
+		"description": "Incidents and reports from the NSW RFS major incidents feed",
+		"links": []ogcLink{
+			{Href: base + "/", Rel: "self", Type: "application/json", Title: "This document"},
+			{Href: base + "/api", Rel: "service-desc", Type: "application/vnd.oai.openapi+json;version=3.0", Title: "The API definition"},
+			{Href: base + "/conformance", Rel: "conformance", Type: "application/json", Title: "Conformance classes implemented"},
+			{Href: base + "/collections", Rel: "data", Type: "application/json", Title: "Collections"},
+		},
+	})
+}
+
+// GET /conformance
+func handleConformance(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"conformsTo": ogcConformance})
+}
+
+// GET /api
+// A minimal OpenAPI 3.0 definition of the features API
+func handleAPIDefinition(w http.ResponseWriter, r *http.Request) {
+	param := func(name, in, description string) map[string]interface{} {
+		return map[string]interface{}{"name": name, "in": in, "description": description, "required": in == "path", "schema": map[string]string{"type": "string"}}
+	}
+	ok := map[string]interface{}{"200": map[string]string{"description": "OK"}}
+
+	paths := map[string]interface{}{
+		"/":            map[string]interface{}{"get": map[string]interface{}{"summary": "Landing page", "responses": ok}},
+		"/conformance": map[string]interface{}{"get": map[string]interface{}{"summary": "Conformance classes", "responses": ok}},
+		"/collections": map[string]interface{}{"get": map[string]interface{}{"summary": "Collections", "responses": ok}},
+		"/collections/{collectionId}": map[string]interface{}{"get": map[string]interface{}{
+			"summary": "A collection", "responses": ok,
+			"parameters": []interface{}{param("collectionId", "path", "The collection's id")},
+		}},
+		"/collections/{collectionId}/items": map[string]interface{}{"get": map[string]interface{}{
+			"summary": "A collection's features", "responses": ok,
+			"parameters": []interface{}{
+				param("collectionId", "path", "The collection's id"),
+				param("bbox", "query", "minx,miny,maxx,maxy in WGS84"),
+				param("datetime", "query", "An RFC3339 instant, or an interval with .. for an open end"),
+				param("limit", "query", fmt.Sprintf("How many features to return, up to %d", ogcMaxLimit)),
+				param("offset", "query", "How many features to skip"),
+			},
+		}},
+		"/collections/{collectionId}/items/{featureId}": map[string]interface{}{"get": map[string]interface{}{
+			"summary": "A feature", "responses": ok,
+			"parameters": []interface{}{param("collectionId", "path", "The collection's id"), param("featureId", "path", "The feature's id")},
+		}},
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.oai.openapi+json;version=3.0")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"openapi": "3.0.0",
+		"info":    map[string]string{"title": "incidentworker", "version": "1.0"},
+		"servers": []map[string]string{{"url": baseURL(r)}},
+		"paths":   paths,
+	})
+}
+
+// GET /collections, /collections/{id}, /collections/{id}/items and /collections/{id}/items/{featureId}
+func handleCollections(w http.ResponseWriter, r *http.Request) {
+	base := baseURL(r)
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/collections"), "/"), "/")
+
+	if parts[0] == "" {
+		collections := []interface{}{}
+		for _, c := range ogcCollections {
+			extent, err := GetOGCExtent(c)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			collections = append(collections, ogcCollectionMetadata(base, c, extent))
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"links":       []ogcLink{{Href: base + "/collections", Rel: "self", Type: "application/json", Title: "This document"}},
+			"collections": collections,
+		})
+		return
+	}
+
+	c, ok := getOGCCollection(parts[0])
+	if !ok || len(parts) > 3 || (len(parts) > 1 && parts[1] != "items") {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Not found"))
+		return
+	}
+
+	switch len(parts) {
+	case 1:
+		extent, err := GetOGCExtent(c)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, ogcCollectionMetadata(base, c, extent))
+	case 2:
+		handleItems(w, r, base, c)
+	case 3:
+		f, err := GetOGCItem(c, parts[2])
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, fmt.Errorf("No feature %s in %s", parts[2], c.Id))
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeGeoJSON(w, map[string]interface{}{
+			"type":       f.Type,
+			"id":         f.ID,
+			"geometry":   f.Geometry,
+			"properties": f.Properties,
+			"links": []ogcLink{
+				{Href: base + "/collections/" + c.Id + "/items/" + f.ID, Rel: "self", Type: "application/geo+json", Title: "This feature"},
+				{Href: base + "/collections/" + c.Id, Rel: "collection", Type: "application/json", Title: c.Title},
+			},
+		})
+	}
+}
+
+func handleItems(w http.ResponseWriter, r *http.Request, base string, c ogcCollection) {
+	q := ogcItemsQuery{}
+	var err error
+
+	if q.BBox, err = parseBBox(r.URL.Query().Get("bbox")); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if q.From, q.To, err = parseDatetime(r.URL.Query().Get("datetime")); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if q.Limit, err = queryInt(r, "limit", ogcDefaultLimit); err != nil || q.Limit < 1 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("limit should be a positive integer"))
+		return
+	}
+	if q.Limit > ogcMaxLimit {
+		q.Limit = ogcMaxLimit
+	}
+	if q.Offset, err = queryInt(r, "offset", 0); err != nil || q.Offset < 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("offset should be zero or a positive integer"))
+		return
+	}
+
+	features, matched, err := GetOGCItems(c, q)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	fc := ogcFeatureCollection{
+		Type:           "FeatureCollection",
+		Features:       features,
+		TimeStamp:      time.Now().UTC().Format(time.RFC3339),
+		NumberMatched:  matched,
+		NumberReturned: len(features),
+		Links:          ogcPageLinks(base+"/collections/"+c.Id+"/items", r.URL.Query(), q, matched),
+	}
+	writeGeoJSON(w, fc)
+}
+
+// Links to this page of items, and the next and previous pages when there are some
+func ogcPageLinks(itemsURL string, params url.Values, q ogcItemsQuery, matched int) []ogcLink {
+	page := func(offset int) string {
+		values := url.Values{}
+		for k, v := range params {
+			values[k] = v
+		}
+		values.Set("offset", strconv.Itoa(offset))
+		return itemsURL + "?" + values.Encode()
+	}
+
+	links := []ogcLink{{Href: page(q.Offset), Rel: "self", Type: "application/geo+json", Title: "This page"}}
+	if q.Offset+q.Limit < matched {
+		links = append(links, ogcLink{Href: page(q.Offset + q.Limit), Rel: "next", Type: "application/geo+json", Title: "Next page"})
+	}
+	if q.Offset > 0 {
+		prev := q.Offset - q.Limit
+		if prev < 0 {
+			prev = 0
+		}
+		links = append(links, ogcLink{Href: page(prev), Rel: "prev", Type: "application/geo+json", Title: "Previous page"})
+	}
+	return links
+}
+
+// Writes v as a GeoJSON response
+func writeGeoJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/geo+json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("Error writing response %v\n", err)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseBBox(t *testing.T) {
+	bbox, err := parseBBox("149.5,-34.5,151.5,-32.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bbox, []float64{149.5, -34.5, 151.5, -32.5}) {
+		t.Errorf("Unexpected bbox %v", bbox)
+	}
+
+	bbox, err = parseBBox("149.5,-34.5,0,151.5,-32.5,100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bbox, []float64{149.5, -34.5, 151.5, -32.5}) {
+		t.Errorf("Expected heights to be ignored, got %v", bbox)
+	}
+
+	for _, s := range []string{"149.5,-34.5,151.5", "a,b,c,d", "149.5,-32.5,151.5,-34.5"} {
+		if _, err := parseBBox(s); err == nil {
+			t.Errorf("Expected an error parsing %q", s)
+		}
+	}
+}
+
+func TestParseDatetime(t *testing.T) {
+	instant := time.Date(2015, 12, 1, 10, 31, 0, 0, time.UTC)
+
+	from, to, err := parseDatetime("2015-12-01T10:31:00Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !from.Equal(instant) || !to.Equal(instant) {
+		t.Errorf("Expected an instant to be both ends, got %v and %v", from, to)
+	}
+
+	from, to, err = parseDatetime("../2015-12-01T10:31:00Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != nil || !to.Equal(instant) {
+		t.Errorf("Expected an open start, got %v and %v", from, to)
+	}
+
+	from, to, err = parseDatetime("2015-12-01T10:31:00Z/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !from.Equal(instant) || to != nil {
+		t.Errorf("Expected an open end, got %v and %v", from, to)
+	}
+
+	for _, s := range []string{"yesterday", "..", "2015-12-02T00:00:00Z/2015-12-01T00:00:00Z"} {
+		if _, _, err := parseDatetime(s); err == nil {
+			t.Errorf("Expected an error parsing %q", s)
+		}
+	}
+}
+
+func TestOGCItemsQueryWhere(t *testing.T) {
+	from := time.Date(2015, 12, 1, 0, 0, 0, 0, time.UTC)
+	q := ogcItemsQuery{BBox: []float64{149, -35, 152, -32}, From: &from}
+
+	where, args := q.where([]interface{}{"now", "resolved"})
+	expected := " WHERE items.geometry && ST_MakeEnvelope($3, $4, $5, $6, 4326) AND items.end_at >= $7::timestamptz"
+	if where != expected {
+		t.Errorf("Expected %q, got %q", expected, where)
+	}
+	if len(args) != 7 || args[6] != "2015-12-01T00:00:00Z" {
+		t.Errorf("Unexpected args %v", args)
+	}
+
+	if where, _ := (ogcItemsQuery{}).where(nil); where != "" {
+		t.Errorf("Expected no where clause without filters, got %q", where)
+	}
+}
+
+func TestOGCPageLinks(t *testing.T) {
+	params := url.Values{"limit": {"10"}, "offset": {"10"}, "bbox": {"149,-35,152,-32"}}
+	links := ogcPageLinks("http://localhost/collections/reports/items", params, ogcItemsQuery{Limit: 10, Offset: 10}, 25)
+
+	rels := map[string]string{}
+	for _, l := range links {
+		rels[l.Rel] = l.Href
+	}
+	if rels["next"] != "http://localhost/collections/reports/items?bbox=149%2C-35%2C152%2C-32&limit=10&offset=20" {
+		t.Errorf("Unexpected next link %s", rels["next"])
+	}
+	if rels["prev"] != "http://localhost/collections/reports/items?bbox=149%2C-35%2C152%2C-32&limit=10&offset=0" {
+		t.Errorf("Unexpected prev link %s", rels["prev"])
+	}
+
+	links = ogcPageLinks("http://localhost/collections/reports/items", url.Values{}, ogcItemsQuery{Limit: 10, Offset: 20}, 25)
+	for _, l := range links {
+		if l.Rel == "next" {
+			t.Error("Expected no next link on the last page")
+		}
+	}
+}
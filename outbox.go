@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/franela/goreq"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sinks outbox messages are dispatched to, as configured, e.g. file:/var/log/incidents.jsonl,https://example.com/events,notify:incidents
+var outboxSinks []outboxSink
+
+// How often the worker's dispatcher looks at the outbox
+const outboxDispatchInterval = 5 * time.Second
+
+// How many messages behind its cursor a sink looks for ones committed late
+const outboxRescanWindow = 1000
+
+type OutboxMessage struct {
+	Id           int64           `json:"id"`
+	IncidentUUID string          `json:"incident_uuid"`
+	Type         string          `json:"type"`
+	Payload      json.RawMessage `json:"payload"`
+	CreatedAt    time.Time       `json:"created_at"`
+}
+
+// Somewhere outbox messages are published. Publishing the same message twice should be harmless, delivery's at least once
+type outboxSink interface {
+	Name() string
+	Publish(m OutboxMessage) error
+}
+
+// Appends messages to a file as JSON lines
+type fileSink struct {
+	path string
+}
+
+func (s fileSink) Name() string {
+	return "file:" + s.path
+}
+
+func (s fileSink) Publish(m OutboxMessage) error {
+	line, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	// It's only delivered once it's on disk
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Posts messages to a URL as JSON
+type httpSink struct {
+	url string
+}
+
+func (s httpSink) Name() string {
+	return s.url
+}
+
+func (s httpSink) Publish(m OutboxMessage) error {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	req := goreq.Request{
+		Method:      "POST",
+		Uri:         s.url,
+		Body:        body,
+		ContentType: "application/json",
+		UserAgent:   "incidentworker",
+		Timeout:     10 * time.Second,
+	}
+	// Lets the receiver ignore messages it's already had
+	req.AddHeader("X-Incidentworker-Outbox-Id", strconv.FormatInt(m.Id, 10))
+
+	res, err := req.Do()
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("Outbox sink responded with %d", res.StatusCode)
+	}
+	return nil
+}
+
+// Sends messages on a channel with NOTIFY
+type notifySink struct {
+	channel string
+}
+
+func (s notifySink) Name() string {
+	return "notify:" + s.channel
+}
+
+func (s notifySink) Publish(m OutboxMessage) error {
+	payload, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if len(payload) > notifyMaxPayload {
+		return fmt.Errorf("Outbox message %d is too long to NOTIFY", m.Id)
+	}
+	_, err = db.Exec(`SELECT pg_notify($1, $2)`, s.channel, string(payload))
+	return err
+}
+
+// Parses a comma separated list of sinks: file:<path>, notify:<channel> or an http(s) URL
+func parseOutboxSinks(s string) ([]outboxSink, error) {
+	sinks := []outboxSink{}
+	for _, v := range splitList(s) {
+		switch {
+		case strings.HasPrefix(v, "file:") && len(v) > len("file:"):
+			sinks = append(sinks, fileSink{strings.TrimPrefix(v, "file:")})
+		case strings.HasPrefix(v, "notify:") && len(v) > len("notify:"):
+			sinks = append(sinks, notifySink{strings.TrimPrefix(v, "notify:")})
+		case strings.HasPrefix(v, "http://") || strings.HasPrefix(v, "https://"):
+			sinks = append(sinks, httpSink{v})
+		default:
+			return nil, fmt.Errorf("Unknown outbox sink %q, use file:<path>, notify:<channel> or an http(s) URL", v)
+		}
+	}
+	return sinks, nil
+}
+
+// The outcome of publishing a message
+type outboxAttempt struct {
+	Message OutboxMessage
+	Err     error
+}
+
+// Publishes messages in order. Once one of an incident's messages fails, its later messages wait for the next
+// dispatch so they aren't published out of order. Other incidents' messages carry on
+func publishOutboxMessages(sink outboxSink, messages []OutboxMessage) []outboxAttempt {
+	attempts := []outboxAttempt{}
+	blocked := make(map[string]bool)
+
+	for _, m := range messages {
+		if blocked[m.IncidentUUID] {
+			continue
+		}
+		err := sink.Publish(m)
+		if err != nil {
+			blocked[m.IncidentUUID] = true
+		}
+		attempts = append(attempts, outboxAttempt{m, err})
+	}
+
+	return attempts
+}
+
+// Queues a sink's deliveries of messages written since it last looked, then publishes those that are due.
+// Returns how many were delivered and how many failed this time
+func DispatchOutbox(sink outboxSink) (int, int, error) {
+	delivered, failed := 0, 0
+
+	err := QueueOutboxDeliveries(sink.Name())
+	if err != nil {
+		return delivered, failed, err
+	}
+
+	messages, err := GetDueOutboxMessages(sink.Name(), 100)
+	if err != nil {
+		return delivered, failed, err
+	}
+
+	for _, a := range publishOutboxMessages(sink, messages) {
+		if a.Err != nil {
+			failed++
+			log.Printf("Outbox message %d to %s failed %v\n", a.Message.Id, sink.Name(), a.Err)
+		} else {
+			delivered++
+		}
+		err = SaveOutboxAttempt(sink.Name(), a)
+		if err != nil {
+			return delivered, failed, err
+		}
+	}
+
+	return delivered, failed, nil
+}
+
+// Dispatches the outbox to every sink until there's nothing due. Problems are logged
+func dispatchOutbox() {
+	for _, sink := range outboxSinks {
+		for {
+			delivered, failed, err := DispatchOutbox(sink)
+			if err != nil {
+				log.Printf("Error dispatching the outbox to %s %v\n", sink.Name(), err)
+				break
+			}
+			if delivered > 0 || failed > 0 {
+				log.Printf("Outbox to %s: %d delivered, %d failed\n", sink.Name(), delivered, failed)
+			}
+			if delivered == 0 {
+				break
+			}
+		}
+	}
+}
+
+// Dispatches the outbox at an interval, for running alongside imports
+func RunOutboxDispatcher(interval time.Duration) {
+	for range time.Tick(interval) {
+		dispatchOutbox()
+	}
+}
+
+// Queues deliveries to a sink of the messages written since it last looked. A new sink starts with messages
+// written from now on
+func QueueOutboxDeliveries(sink string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO outbox_sinks(name, first_outbox_id, last_outbox_id)
+    SELECT $1, COALESCE(MAX(id), 0), COALESCE(MAX(id), 0) FROM outbox
+    ON CONFLICT (name) DO NOTHING`, sink)
+	if err != nil {
+		return err
+	}
+
+	// Locked, so dispatchers in other processes don't move the cursor at the same time
+	var first, last int64
+	err = tx.QueryRow(`SELECT first_outbox_id, last_outbox_id FROM outbox_sinks WHERE name = $1 FOR UPDATE`, sink).Scan(&first, &last)
+	if err != nil {
+		return err
+	}
+
+	// Ids are handed out before transactions commit, so one can appear behind the cursor after it's moved past.
+	// Looking back over a window catches those, and the deliveries already queued are left alone
+	from := last - outboxRescanWindow
+	if from < first {
+		from = first
+	}
+
+	var next int64
+	err = tx.QueryRow(`WITH queued AS (
+      INSERT INTO outbox_deliveries(sink, outbox_id, incident_uuid)
+      SELECT $1, id, incident_uuid FROM outbox WHERE id > $2 ORDER BY id
+      ON CONFLICT (sink, outbox_id) DO NOTHING
+    )
+    SELECT GREATEST(COALESCE(MAX(id), 0), $3) FROM outbox WHERE id > $2`, sink, from, last).Scan(&next)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE outbox_sinks SET last_outbox_id = $2, updated_at = (NOW() AT TIME ZONE 'UTC') WHERE name = $1`, sink, next)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Fetches a sink's messages that are due, oldest first. A message waits while an earlier one of the same incident
+// is still pending, so each incident's messages are published in order
+func GetDueOutboxMessages(sink string, limit int) ([]OutboxMessage, error) {
+	messages := []OutboxMessage{}
+
+	rows, err := db.Query(`SELECT o.id, o.incident_uuid, o.type, o.payload, o.created_at
+    FROM outbox_deliveries d
+    JOIN outbox o ON o.id = d.outbox_id
+    WHERE d.sink = $1 AND d.status = 'pending' AND d.next_attempt_at <= NOW()
+      AND NOT EXISTS (
+        SELECT 1 FROM outbox_deliveries earlier
+        WHERE earlier.sink = d.sink AND earlier.incident_uuid = d.incident_uuid AND earlier.status = 'pending' AND earlier.outbox_id < d.outbox_id
+      )
+    ORDER BY o.id
+    LIMIT $2`, sink, limit)
+	if err != nil {
+		return messages, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		m := OutboxMessage{}
+		var payload []byte
+		err = rows.Scan(&m.Id, &m.IncidentUUID, &m.Type, &payload, &m.CreatedAt)
+		if err != nil {
+			return messages, err
+		}
+		m.Payload = json.RawMessage(payload)
+		messages = append(messages, m)
+	}
+
+	return messages, rows.Err()
+}
+
+// Records the outcome of publishing a message to a sink, scheduling a retry when it failed
+func SaveOutboxAttempt(sink string, a outboxAttempt) error {
+	if a.Err == nil {
+		_, err := db.Exec(`UPDATE outbox_deliveries
+      SET status = 'delivered', attempts = attempts + 1, last_error = NULL, delivered_at = (NOW() AT TIME ZONE 'UTC')
+      WHERE sink = $1 AND outbox_id = $2`, sink, a.Message.Id)
+		return err
+	}
+
+	var attempts int
+	err := db.QueryRow(`UPDATE outbox_deliveries SET attempts = attempts + 1, last_error = $3
+    WHERE sink = $1 AND outbox_id = $2
+    RETURNING attempts`, sink, a.Message.Id, a.Err.Error()).Scan(&attempts)
+	if err != nil {
+		return err
+	}
+
+	// It's retried until it's delivered, backing off like webhooks
+	next := time.Now().Add(webhookBackoff(attempts))
+	_, err = db.Exec(`UPDATE outbox_deliveries SET next_attempt_at = $3 WHERE sink = $1 AND outbox_id = $2`, sink, a.Message.Id, next.UTC().Format(time.RFC3339))
+	return err
+}
+
+// How far a sink's got through the outbox
+type OutboxSinkStatus struct {
+	Name         string
+	LastOutboxId int64
+	Pending      int
+	Failing      int // Pending deliveries that have failed at least once
+}
+
+func GetOutboxStatus() ([]OutboxSinkStatus, error) {
+	statuses := []OutboxSinkStatus{}
+
+	rows, err := db.Query(`SELECT s.name, s.last_outbox_id,
+      COUNT(d.outbox_id) FILTER (WHERE d.status = 'pending'),
+      COUNT(d.outbox_id) FILTER (WHERE d.status = 'pending' AND d.attempts > 0)
+    FROM outbox_sinks s
+    LEFT JOIN outbox_deliveries d ON d.sink = s.name
+    GROUP BY s.name, s.last_outbox_id
+    ORDER BY s.name`)
+	if err != nil {
+		return statuses, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		s := OutboxSinkStatus{}
+		err = rows.Scan(&s.Name, &s.LastOutboxId, &s.Pending, &s.Failing)
+		if err != nil {
+			return statuses, err
+		}
+		statuses = append(statuses, s)
+	}
+
+	return statuses, rows.Err()
+}
+
+func PrintOutboxStatus(w io.Writer, statuses []OutboxSinkStatus) {
+	for _, s := range statuses {
+		fmt.Fprintf(w, "%s  queued to: %d  pending: %d  failing: %d\n", s.Name, s.LastOutboxId, s.Pending, s.Failing)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/paulmach/go.geojson"
+)
+
+func TestParseOutboxSinks(t *testing.T) {
+	sinks, err := parseOutboxSinks(" file:/tmp/outbox.jsonl, https://example.com/events ,notify:incidents,")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	for _, s := range sinks {
+		names = append(names, s.Name())
+	}
+	expected := "file:/tmp/outbox.jsonl,https://example.com/events,notify:incidents"
+	if strings.Join(names, ",") != expected {
+		t.Errorf("Expected %s, got %v", expected, names)
+	}
+
+	sinks, err = parseOutboxSinks("")
+	if err != nil || len(sinks) != 0 {
+		t.Errorf("Expected no sinks, got %v %v", sinks, err)
+	}
+
+	for _, s := range []string{"file:", "notify:", "ftp://example.com", "incidents"} {
+		if _, err = parseOutboxSinks(s); err == nil {
+			t.Errorf("Expected %s to be an error", s)
+		}
+	}
+}
+
+func TestFileSinkPublish(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink := fileSink{filepath.Join(dir, "outbox.jsonl")}
+	for _, id := range []int64{1, 2} {
+		err = sink.Publish(OutboxMessage{Id: id, IncidentUUID: "i", Type: eventReportInserted, Payload: json.RawMessage(`{"rfs_id":1}`)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := ioutil.ReadFile(sink.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %q", b)
+	}
+	m := OutboxMessage{}
+	if err = json.Unmarshal([]byte(lines[1]), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Id != 2 || string(m.Payload) != `{"rfs_id":1}` {
+		t.Errorf("Expected message 2 with its payload, got %+v", m)
+	}
+}
+
+func TestHTTPSinkPublish(t *testing.T) {
+	status := http.StatusOK
+	var id string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id = r.Header.Get("X-Incidentworker-Outbox-Id")
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	sink := httpSink{server.URL}
+	err := sink.Publish(OutboxMessage{Id: 7, Payload: json.RawMessage(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "7" {
+		t.Errorf("Expected the message id in a header, got %q", id)
+	}
+
+	status = http.StatusServiceUnavailable
+	if err = sink.Publish(OutboxMessage{Id: 8, Payload: json.RawMessage(`{}`)}); err == nil {
+		t.Error("Expected a 503 to be an error")
+	}
+}
+
+// Fails messages with the given ids
+type fakeSink struct {
+	fail      map[int64]bool
+	published []int64
+}
+
+func (s *fakeSink) Name() string {
+	return "fake"
+}
+
+func (s *fakeSink) Publish(m OutboxMessage) error {
+	if s.fail[m.Id] {
+		return fmt.Errorf("failed")
+	}
+	s.published = append(s.published, m.Id)
+	return nil
+}
+
+func TestPublishOutboxMessages(t *testing.T) {
+	sink := &fakeSink{fail: map[int64]bool{2: true}}
+	messages := []OutboxMessage{
+		{Id: 1, IncidentUUID: "a"},
+		{Id: 2, IncidentUUID: "b"},
+		{Id: 3, IncidentUUID: "a"},
+		{Id: 4, IncidentUUID: "b"},
+		{Id: 5, IncidentUUID: "c"},
+	}
+
+	attempts := publishOutboxMessages(sink, messages)
+
+	if fmt.Sprint(sink.published) != "[1 3 5]" {
+		t.Errorf("Expected 1, 3 and 5 to be published, got %v", sink.published)
+	}
+	// 4 waits behind 2, so it isn't attempted
+	if len(attempts) != 4 || attempts[1].Message.Id != 2 || attempts[1].Err == nil {
+		t.Errorf("Expected 4 attempts with 2 failing, got %+v", attempts)
+	}
+}
+
+// A database connection that logs what's run on it and fails inserting events
+type failingEventsConn struct {
+	log *[]string
+}
+
+func (c failingEventsConn) Prepare(query string) (driver.Stmt, error) {
+	return failingEventsStmt{c, query}, nil
+}
+
+func (c failingEventsConn) Close() error { return nil }
+
+func (c failingEventsConn) Begin() (driver.Tx, error) {
+	*c.log = append(*c.log, "BEGIN")
+	return c, nil
+}
+
+func (c failingEventsConn) Commit() error {
+	*c.log = append(*c.log, "COMMIT")
+	return nil
+}
+
+func (c failingEventsConn) Rollback() error {
+	*c.log = append(*c.log, "ROLLBACK")
+	return nil
+}
+
+type failingEventsStmt struct {
+	conn  failingEventsConn
+	query string
+}
+
+func (s failingEventsStmt) Close() error  { return nil }
+func (s failingEventsStmt) NumInput() int { return -1 }
+
+func (s failingEventsStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, fmt.Errorf("Unexpected exec %s", s.query)
+}
+
+func (s failingEventsStmt) Query(args []driver.Value) (driver.Rows, error) {
+	*s.conn.log = append(*s.conn.log, strings.Fields(s.query)[0])
+	if strings.Contains(s.query, "incident_events") {
+		return nil, fmt.Errorf("Inserting event failed")
+	}
+	return &uuidRows{uuids: []string{"1d5b0a5c-3f1e-4a6b-9c2d-8e7f6a5b4c3d"}}, nil
+}
+
+// Rows of a single uuid column
+type uuidRows struct {
+	uuids []string
+}
+
+func (r *uuidRows) Columns() []string { return []string{"uuid"} }
+func (r *uuidRows) Close() error      { return nil }
+
+func (r *uuidRows) Next(dest []driver.Value) error {
+	if len(r.uuids) == 0 {
+		return io.EOF
+	}
+	dest[0] = r.uuids[0]
+	r.uuids = r.uuids[1:]
+	return nil
+}
+
+type failingEventsConnector struct {
+	log *[]string
+}
+
+func (c failingEventsConnector) Connect(context.Context) (driver.Conn, error) {
+	return failingEventsConn{c.log}, nil
+}
+
+func (c failingEventsConnector) Driver() driver.Driver { return nil }
+
+func TestEventInsertFailureCommitsNothing(t *testing.T) {
+	var log []string
+	prev := db
+	db = sql.OpenDB(failingEventsConnector{&log})
+	defer func() {
+		db.Close()
+		db = prev
+	}()
+
+	cases := map[string]func() error{
+		"resolving incidents": func() error {
+			return UpdateCurrentIncidents([]Incident{{UUID: "6f0e1d2c-3b4a-4958-8776-65a4b3c2d1e0"}})
+		},
+		"inserting a report": func() error {
+			r := Report{IncidentUUID: "6f0e1d2c-3b4a-4958-8776-65a4b3c2d1e0", Geometry: geojson.NewPointGeometry([]float64{151.2, -33.8})}
+			return r.insertWithEvents()
+		},
+		"creating an incident": func() error {
+			i := Incident{RFSId: 1}
+			return i.Insert()
+		},
+	}
+	for name, change := range cases {
+		log = nil
+		if err := change(); err == nil {
+			t.Errorf("Expected %s to fail when its event can't be inserted", name)
+		}
+		if len(log) < 3 || log[0] != "BEGIN" || log[len(log)-1] != "ROLLBACK" {
+			t.Errorf("Expected %s to be rolled back, got %v", name, log)
+		}
+		for _, l := range log {
+			if l == "COMMIT" {
+				t.Errorf("Expected nothing committed %s, got %v", name, log)
+			}
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParsedDescriptionKeepsUnknownKeys(t *testing.T) {
+	r := Report{Description: "ALERT LEVEL: Advice<br />COUNCIL AREA: Tumut<br />FIRE DANGER RATING: Severe<br />UPDATED: 5 Feb 2014 08:58<br />Some trailing text"}
+
+	details, err := r.parsedDescription()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if details["fire_danger_rating"] != "Severe" {
+		t.Errorf("Expected unknown key to be kept, got %q", details["fire_danger_rating"])
+	}
+	if details["council_area"] != "Tumut" {
+		t.Errorf("Expected council_area of Tumut, got %q", details["council_area"])
+	}
+	if details["extra"] != "Some trailing text" {
+		t.Errorf("Expected extra text to be kept, got %q", details["extra"])
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/paulmach/go.geojson"
+	"io"
+	"sort"
+	"time"
+)
+
+// Where reprocessing reads raw data from
+const (
+	reprocessFromFeeds   = "feeds"   // Archived feed snapshots
+	reprocessFromReports = "reports" // The raw properties stored with each report
+)
+
+type ReprocessOptions struct {
+	Source string
+	From   time.Time // Snapshot fetch time or report pubdate, zero for no lower bound
+	To     time.Time // Zero for no upper bound
+	RFSId  int       // Only reprocess this incident's reports, 0 for all
+	DryRun bool      // Work out what would change without saving it
+}
+
+// What reprocessing did
+type ReprocessSummary struct {
+	Reports   int            // Reports rebuilt
+	Changed   int            // Reports with at least one field that changed
+	Unmatched int            // Features in archived feeds we have no report for
+	Errors    int            // Features that couldn't be rebuilt
+	Fields    map[string]int // Field -> number of reports it changed in
+	Incidents map[string]bool
+}
+
+// Rebuilds reports with reportFromFeature from the raw data we've kept, updating them in place
+func Reprocess(o ReprocessOptions) (ReprocessSummary, error) {
+	s := ReprocessSummary{Fields: make(map[string]int), Incidents: make(map[string]bool)}
+	var err error
+
+	switch o.Source {
+	case reprocessFromFeeds, "":
+		err = reprocessFeeds(o, &s)
+	case reprocessFromReports:
+		err = reprocessReports(o, &s)
+	default:
+		err = fmt.Errorf("Unknown reprocess source %s, use %s or %s", o.Source, reprocessFromFeeds, reprocessFromReports)
+	}
+	if err != nil {
+		return s, err
+	}
+
+	if o.DryRun {
+		return s, nil
+	}
+
+	// Pubdates may have moved, so incidents' current_from need to follow
+	for uuid := range s.Incidents {
+		err = SetIncidentCurrentFromReports(uuid)
+		if err != nil {
+			return s, err
+		}
+	}
+
+	return s, nil
+}
+
+// Reprocesses every feature of the archived feeds, matching features to reports by hash
+func reprocessFeeds(o ReprocessOptions, s *ReprocessSummary) error {
+	ids, err := GetFeedSnapshotIds(o.From, o.To)
+	if err != nil {
+		return err
+	}
+
+	// The same report is in many feeds, it only needs doing once
+	done := make(map[string]bool)
+
+	for _, id := range ids {
+		snapshot, err := GetFeedSnapshot(id)
+		if err != nil {
+			return err
+		}
+
+		fc, err := geojson.UnmarshalFeatureCollection(snapshot.Body)
+		if err != nil {
+			fmt.Printf("\nError parsing feed snapshot %d %v\n", id, err)
+			s.Errors++
+			continue
+		}
+
+		for _, f := range fc.Features {
+			r, err := reportFromFeature(f)
+			if err != nil {
+				fmt.Printf("\nError parsing report in feed snapshot %d %v\n", id, err)
+				s.Errors++
+				continue
+			}
+			if done[r.Hash] || (o.RFSId != 0 && r.Id() != o.RFSId) {
+				continue
+			}
+			done[r.Hash] = true
+
+			// GetReportUUIDForHashes upgrades a report found by its legacy hash, which a dry run mustn't do
+			var uuid string
+			if o.DryRun {
+				uuid, _, err = findReportUUIDForHashes(r.Hash, r.LegacyHash)
+			} else {
+				uuid, err = GetReportUUIDForHashes(r.Hash, r.LegacyHash)
+			}
+			if err == sql.ErrNoRows {
+				// Most likely a feature that failed to import the first time around
+				s.Unmatched++
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			old, err := GetReport(uuid)
+			if err != nil {
+				return err
+			}
+
+			err = reprocessReport(old, r, o, s)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Reprocesses reports by rebuilding their features from the raw properties stored with them
+func reprocessReports(o ReprocessOptions, s *ReprocessSummary) error {
+	q := `SELECT ` + reportColumns + ` FROM reports JOIN incidents ON incidents.uuid = reports.incident_uuid
+    WHERE reports.properties IS NOT NULL
+    AND ($1::timestamptz IS NULL OR reports.pubdate >= $1) AND ($2::timestamptz IS NULL OR reports.pubdate <= $2)
+    AND ($3 = 0 OR incidents.rfs_id = $3)
+    ORDER BY reports.pubdate`
+	rows, err := db.Query(q, nullTime(o.From), nullTime(o.To), o.RFSId)
+	if err != nil {
+		return err
+	}
+
+	// Collect them first, updating while iterating would hold the connection
+	olds := []Report{}
+	for rows.Next() {
+		old, err := scanReport(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		olds = append(olds, old)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, old := range olds {
+		if old.Geometry == nil {
+			s.Errors++
+			continue
+		}
+		f := geojson.NewFeature(old.Geometry)
+		f.Properties = old.Properties
+
+		r, err := reportFromFeature(f)
+		if err != nil {
+			fmt.Printf("\nError parsing report %s %v\n", old.UUID, err)
+			s.Errors++
+			continue
+		}
+
+		err = reprocessReport(old, r, o, s)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Compares the rebuilt report to what we have and saves it if it's different
+func reprocessReport(old, r Report, o ReprocessOptions, s *ReprocessSummary) error {
+	s.Reports++
+
+	changed := diffReportFields(old, r)
+	if len(changed) == 0 {
+		return nil
+	}
+	s.Changed++
+	for _, field := range changed {
+		s.Fields[field]++
+	}
+	s.Incidents[old.IncidentUUID] = true
+
+	if o.DryRun {
+		return nil
+	}
+
+	// Keep who this report is. Its hash is left to the rehash command
+	r.UUID = old.UUID
+	r.IncidentUUID = old.IncidentUUID
+	r.Hash = old.Hash
+
+	return r.Update()
+}
+
+// Lists the names of the columns that differ between two versions of a report
+func diffReportFields(a, b Report) []string {
+	changed := []string{}
+
+	check := func(name string, same bool) {
+		if !same {
+			changed = append(changed, name)
+		}
+	}
+
+	check("guid", a.Guid == b.Guid)
+	check("title", a.Title == b.Title)
+	check("link", a.Link == b.Link)
+	check("category", a.Category == b.Category)
+	check("pubdate", a.Pubdate.Equal(b.Pubdate))
+	check("description", a.Description == b.Description)
+	check("updated", a.Updated.Equal(b.Updated))
+	check("alert_level", a.AlertLevel == b.AlertLevel)
+	check("location", a.Location == b.Location)
+	check("council_area", a.CouncilArea == b.CouncilArea)
+	check("status", a.Status == b.Status)
+	check("fire_type", a.FireType == b.FireType)
+	check("fire", a.Fire == b.Fire)
+	check("size", a.Size == b.Size)
+	check("responsible_agency", a.ResponsibleAgency == b.ResponsibleAgency)
+	check("extra", a.Extra == b.Extra)
+	check("properties", sameJSON(a.Properties, b.Properties))
+	check("details", sameJSON(a.Details, b.Details))
+	// Stored geometry comes back through ST_AsGeoJSON, so compare it the way the hash does
+	check("geometry", sameJSON(canonicalGeometry(a.Geometry), canonicalGeometry(b.Geometry)))
+
+	return changed
+}
+
+// Whether two values marshal to the same JSON. Map keys are sorted by encoding/json, so order doesn't matter
+func sameJSON(a, b interface{}) bool {
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(ja) == string(jb)
+}
+
+// Writes the summary for a human
+func (s ReprocessSummary) Print(w io.Writer) {
+	fmt.Fprintf(w, "Reprocessed %d reports, %d changed across %d incidents\n", s.Reports, s.Changed, len(s.Incidents))
+	if s.Unmatched > 0 {
+		fmt.Fprintf(w, "%d archived reports had no matching report\n", s.Unmatched)
+	}
+	if s.Errors > 0 {
+		fmt.Fprintf(w, "%d reports couldn't be parsed\n", s.Errors)
+	}
+
+	fields := []string{}
+	for field := range s.Fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		fmt.Fprintf(w, "  %-20s %d\n", field, s.Fields[field])
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/paulmach/go.geojson"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiffReportFields(t *testing.T) {
+	pubdate := time.Date(2015, 12, 1, 21, 31, 0, 0, time.UTC)
+	a := Report{
+		Title:      "Wambelong",
+		Pubdate:    pubdate,
+		AlertLevel: "Advice",
+		Properties: map[string]interface{}{"a": "1", "b": "2"},
+		Geometry:   geojson.NewPointGeometry([]float64{150, -33}),
+	}
+	b := a
+	b.Pubdate = pubdate.In(feedLocation) // Same instant, different zone
+	b.Properties = map[string]interface{}{"b": "2", "a": "1"}
+	// Read back from PostGIS with less precision
+	b.Geometry = geojson.NewPointGeometry([]float64{150.0000000001, -32.9999999999})
+
+	if changed := diffReportFields(a, b); len(changed) != 0 {
+		t.Errorf("Expected no changes, got %v", changed)
+	}
+
+	b.AlertLevel = "Emergency Warning"
+	b.Pubdate = pubdate.Add(-11 * time.Hour)
+	b.Geometry = geojson.NewPointGeometry([]float64{150, -34})
+
+	changed := diffReportFields(a, b)
+	expected := []string{"pubdate", "alert_level", "geometry"}
+	if !reflect.DeepEqual(changed, expected) {
+		t.Errorf("Expected %v, got %v", expected, changed)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"github.com/paulmach/go.geojson"
+	"log"
+	"sort"
+)
+
+// The kinds of things we track about the shape of the feed
+const (
+	schemaProperty       = "property"
+	schemaDescriptionKey = "description_key"
+	schemaGeometry       = "geometry"
+	schemaDateFormat     = "date_format"
+)
+
+// Ways the feed can drift from what we've seen before
+const (
+	driftNew        = "new"
+	driftMissing    = "missing"
+	driftUnparsable = "unparsable"
+)
+
+type SchemaDriftEvent struct {
+	Kind   string
+	Name   string
+	Change string
+	Sample string
+}
+
+// What a single feed looked like. Kind -> name -> a sample value
+type FeedSchema struct {
+	Seen       map[string]map[string]string
+	Unparsable []SchemaDriftEvent
+	Features   int
+}
+
+func (s *FeedSchema) see(kind, name, sample string) {
+	if s.Seen[kind] == nil {
+		s.Seen[kind] = make(map[string]string)
+	}
+	if _, exists := s.Seen[kind][name]; !exists {
+		s.Seen[kind][name] = sample
+	}
+}
+
+func (s *FeedSchema) unparsable(kind, name, sample string) {
+	// One event per thing per feed is plenty
+	for _, e := range s.Unparsable {
+		if e.Kind == kind && e.Name == name {
+			return
+		}
+	}
+	s.Unparsable = append(s.Unparsable, SchemaDriftEvent{kind, name, driftUnparsable, sample})
+}
+
+// Collects the property names, description keys, geometry shapes and date formats used in a feed
+func feedSchemaFromFeatureCollection(fc *geojson.FeatureCollection) *FeedSchema {
+	s := &FeedSchema{Seen: make(map[string]map[string]string), Features: len(fc.Features)}
+
+	for _, f := range fc.Features {
+		for k, v := range f.Properties {
+			s.see(schemaProperty, k, fmt.Sprintf("%v", v))
+		}
+
+		if f.Geometry != nil {
+			for _, shape := range geometryShapes(f.Geometry) {
+				s.see(schemaGeometry, shape, "")
+			}
+		}
+
+		dateStr, _ := f.PropertyString("pubDate")
+		if _, format, err := parsePubdate(dateStr); err == nil {
+			s.see(schemaDateFormat, "pubDate "+format, dateStr)
+		} else {
+			s.unparsable(schemaDateFormat, "pubDate", dateStr)
+		}
+
+		r := Report{}
+		r.Description, _ = f.PropertyString("description")
+		details, _ := r.parsedDescription()
+		for k, v := range details {
+			s.see(schemaDescriptionKey, k, v)
+		}
+
+		if _, format, err := parseUpdated(details["updated"]); err == nil {
+			s.see(schemaDateFormat, "UPDATED "+format, details["updated"])
+		} else {
+			s.unparsable(schemaDateFormat, "UPDATED", details["updated"])
+		}
+	}
+
+	return s
+}
+
+// The distinct types of the geometries making up a geometry, looking inside collections, e.g. Point and Polygon.
+// Which combinations of them a report has depends on the incident rather than the feed, so they're kept apart
+func geometryShapes(g *geojson.Geometry) []string {
+	geoms := []*geojson.Geometry{g}
+	if g.IsCollection() {
+		geoms = flattenGeometries(g.Geometries)
+	}
+
+	seen := make(map[string]bool)
+	shapes := []string{}
+	for _, c := range geoms {
+		shape := string(c.Type)
+		if !seen[shape] {
+			seen[shape] = true
+			shapes = append(shapes, shape)
+		}
+	}
+	sort.Strings(shapes)
+
+	return shapes
+}
+
+// What we've seen before, and hadn't already noticed was missing, that isn't in this feed.
+// An empty feed has nothing to go missing from. Nor do geometry types, as which there are depends on the incidents
+func (s *FeedSchema) missing(known map[string]map[string]bool) []SchemaDriftEvent {
+	events := []SchemaDriftEvent{}
+	if s.Features == 0 {
+		return events
+	}
+
+	for kind, names := range known {
+		if kind == schemaGeometry {
+			continue
+		}
+		for name, missing := range names {
+			if _, seen := s.Seen[kind][name]; seen || missing {
+				continue
+			}
+			events = append(events, SchemaDriftEvent{kind, name, driftMissing, ""})
+		}
+	}
+
+	return events
+}
+
+// Compares this feed's schema to what we've seen before, records changes and logs warnings for them
+func (s *FeedSchema) Check() ([]SchemaDriftEvent, error) {
+	events := []SchemaDriftEvent{}
+
+	known, err := GetFeedSchema()
+	if err != nil {
+		return events, err
+	}
+	// When we've never seen a feed before everything's new, which isn't very interesting
+	firstImport := len(known) == 0
+
+	for kind, names := range s.Seen {
+		for name, sample := range names {
+			missing, exists := known[kind][name]
+			if !exists && !firstImport {
+				events = append(events, SchemaDriftEvent{kind, name, driftNew, sample})
+			}
+			if !exists || missing {
+				log.Printf("Feed schema now includes %s %q\n", kind, name)
+			}
+			err = SetFeedSchemaSeen(kind, name)
+			if err != nil {
+				return events, err
+			}
+		}
+	}
+
+	for _, e := range s.missing(known) {
+		events = append(events, e)
+		err = SetFeedSchemaMissing(e.Kind, e.Name)
+		if err != nil {
+			return events, err
+		}
+	}
+
+	events = append(events, s.Unparsable...)
+
+	for _, e := range events {
+		log.Printf("Warning: schema drift, %s %s %q %s\n", e.Change, e.Kind, e.Name, e.Sample)
+		err = e.Insert()
+		if err != nil {
+			return events, err
+		}
+	}
+
+	return events, nil
+}
+
+// Fetches everything we've seen in feeds. Kind -> name -> whether it was missing from the latest import
+func GetFeedSchema() (map[string]map[string]bool, error) {
+	known := make(map[string]map[string]bool)
+
+	rows, err := db.Query(`SELECT kind, name, missing FROM feed_schema`)
+	if err != nil {
+		return known, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var kind, name string
+		var missing bool
+		err = rows.Scan(&kind, &name, &missing)
+		if err != nil {
+			return known, err
+		}
+		if known[kind] == nil {
+			known[kind] = make(map[string]bool)
+		}
+		known[kind][name] = missing
+	}
+
+	return known, rows.Err()
+}
+
+// Records that we've seen something in the latest feed
+func SetFeedSchemaSeen(kind, name string) error {
+	stmt, err := db.Prepare(`INSERT INTO feed_schema(kind, name) VALUES($1, $2)
+    ON CONFLICT (kind, name) DO UPDATE SET missing = false, last_seen = (NOW() AT TIME ZONE 'UTC')`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(kind, name)
+	return err
+}
+
+// Records that something we've seen before wasn't in the latest feed
+func SetFeedSchemaMissing(kind, name string) error {
+	stmt, err := db.Prepare(`UPDATE feed_schema SET missing = true WHERE kind = $1 AND name = $2`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(kind, name)
+	return err
+}
+
+// Inserts the drift event into the database
+func (e *SchemaDriftEvent) Insert() error {
+	stmt, err := db.Prepare(`INSERT INTO schema_drift_events(kind, name, change, sample) VALUES($1, $2, $3, $4)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(e.Kind, e.Name, e.Change, e.Sample)
+	return err
+}
+
+func GetNumSchemaDriftEvents() (int, error) {
+	stmt, err := db.Prepare(`SELECT COUNT(*) FROM schema_drift_events`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	var count int
+	err = stmt.QueryRow().Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
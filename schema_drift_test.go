@@ -0,0 +1,67 @@
+package main
+
+import (
+	"github.com/paulmach/go.geojson"
+	"reflect"
+	"testing"
+)
+
+func TestGeometryShape(t *testing.T) {
+	g := geojson.NewCollectionGeometry(
+		geojson.NewPointGeometry([]float64{1, 2}),
+		geojson.NewPointGeometry([]float64{3, 4}),
+		geojson.NewCollectionGeometry(
+			geojson.NewPolygonGeometry([][][]float64{{{0, 0}, {1, 0}, {1, 1}, {0, 0}}}),
+		),
+	)
+
+	shapes := geometryShapes(g)
+	if !reflect.DeepEqual(shapes, []string{"Point", "Polygon"}) {
+		t.Errorf("Unexpected shapes %v", shapes)
+	}
+}
+
+func TestFeedSchemaFromFeatureCollection(t *testing.T) {
+	f := geojson.NewPointFeature([]float64{150, -33})
+	f.SetProperty("guid", "https://incidents.rfs.nsw.gov.au/api/v1/incidents/123")
+	f.SetProperty("pubDate", "1/12/2015 9:31:00 PM")
+	f.SetProperty("description", "ALERT LEVEL: Advice<br />UPDATED: 2015-12-01 21:31")
+	fc := geojson.NewFeatureCollection().AddFeature(f)
+
+	s := feedSchemaFromFeatureCollection(fc)
+
+	if _, ok := s.Seen[schemaProperty]["guid"]; !ok {
+		t.Error("Expected guid property to be seen")
+	}
+	if _, ok := s.Seen[schemaDescriptionKey]["alert_level"]; !ok {
+		t.Error("Expected alert_level description key to be seen")
+	}
+	if _, ok := s.Seen[schemaGeometry]["Point"]; !ok {
+		t.Error("Expected Point geometry to be seen")
+	}
+	if len(s.Unparsable) != 1 || s.Unparsable[0].Name != "UPDATED" {
+		t.Errorf("Expected the UPDATED date to be unparsable, got %v", s.Unparsable)
+	}
+}
+
+func TestFeedSchemaMissing(t *testing.T) {
+	known := map[string]map[string]bool{
+		schemaProperty: {"guid": false, "category": false, "gone": true},
+		schemaGeometry: {"Point": false, "Polygon": false},
+	}
+
+	f := geojson.NewPointFeature([]float64{150, -33})
+	f.SetProperty("guid", "https://incidents.rfs.nsw.gov.au/api/v1/incidents/123")
+	s := feedSchemaFromFeatureCollection(geojson.NewFeatureCollection().AddFeature(f))
+
+	// Polygons come and go with incidents, and gone has already been noticed
+	missing := s.missing(known)
+	if len(missing) != 1 || missing[0].Kind != schemaProperty || missing[0].Name != "category" || missing[0].Change != driftMissing {
+		t.Errorf("Expected only category to be missing, got %v", missing)
+	}
+
+	empty := feedSchemaFromFeatureCollection(geojson.NewFeatureCollection())
+	if missing := empty.missing(known); len(missing) != 0 {
+		t.Errorf("Expected nothing to be missing from an empty feed, got %v", missing)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Serves the HTTP API
+func Serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", handleEvents)
+	mux.HandleFunc("/events/stream", handleEventStream)
+	mux.HandleFunc("/asof", handleAsOf)
+	mux.HandleFunc("/tiles/", handleTile)
+	mux.HandleFunc("/feeds/", handleFeed)
+	mux.HandleFunc("/cap", handleCAP)
+	mux.HandleFunc("/cap/", handleCAP)
+
+	// OGC API - Features
+	mux.HandleFunc("/", handleLandingPage)
+	mux.HandleFunc("/conformance", handleConformance)
+	mux.HandleFunc("/api", handleAPIDefinition)
+	mux.HandleFunc("/collections", handleCollections)
+	mux.HandleFunc("/collections/", handleCollections)
+
+	log.Printf("Serving on %s\n", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+// Writes v as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("Error writing response %v\n", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// An optional integer query parameter, def when it's missing
+func queryInt(r *http.Request, name string, def int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	return strconv.Atoi(v)
+}
+
+// GET /events?since=<id>&type=<type,...>&incident=<rfs_id>&limit=<n>
+// Events in the order they were recorded. Poll with since set to the previous response's next to follow the stream
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	q := EventQuery{}
+	var err error
+
+	if q.Since, err = queryInt(r, "since", 0); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if q.RFSId, err = queryInt(r, "incident", 0); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if q.Limit, err = queryInt(r, "limit", 100); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if q.Limit > 1000 {
+		q.Limit = 1000
+	}
+	if t := r.URL.Query().Get("type"); t != "" {
+		q.Types = strings.Split(t, ",")
+	}
+
+	events, err := GetIncidentEvents(q)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	next := q.Since
+	if len(events) > 0 {
+		next = events[len(events)-1].Id
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"events": events,
+		"next":   next,
+	})
+}
+
+// GET /asof?at=<time>
+// The incidents that were current at a time, or now, as GeoJSON of each one's latest report by then
+func handleAsOf(w http.ResponseWriter, r *http.Request) {
+	var at time.Time // Now
+	if v := r.URL.Query().Get("at"); v != "" {
+		var err error
+		if at, err = parseCLITime(v); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	incidents, err := GetIncidentsAsOf(at)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, incidentsFeatureCollection(incidents))
+}
+
+// GET /tiles/{z}/{x}/{y}.mvt?at=<time>
+// A Mapbox Vector Tile of current incidents, or those current at a time, with incidents and perimeters layers
+func handleTile(w http.ResponseWriter, r *http.Request) {
+	z, x, y, err := parseTilePath(r.URL.Path)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	var at time.Time
+	if v := r.URL.Query().Get("at"); v != "" {
+		if at, err = parseCLITime(v); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	tile, err := tiles.Get(z, x, y, at)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.mapbox-vector-tile")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write(tile)
+}
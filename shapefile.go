@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/paulmach/go.geojson"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Reads features from a GeoJSON file, or from a shapefile (.shp with its .dbf alongside)
+func readFeatures(path string) (*geojson.FeatureCollection, error) {
+	if strings.ToLower(filepath.Ext(path)) != ".shp" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return geojson.UnmarshalFeatureCollection(data)
+	}
+
+	shp, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dbf, err := ioutil.ReadFile(strings.TrimSuffix(path, filepath.Ext(path)) + ".dbf")
+	if err != nil {
+		return nil, err
+	}
+	return decodeShapefile(shp, dbf)
+}
+
+// Decodes a shapefile's geometries and their attributes into features.
+// Coordinates are used as they are, so the shapefile should be in WGS84 (or GDA94, which is close enough)
+func decodeShapefile(shp, dbf []byte) (*geojson.FeatureCollection, error) {
+	if len(shp) < 100 || binary.BigEndian.Uint32(shp[0:4]) != 9994 {
+		return nil, fmt.Errorf("Not a shapefile")
+	}
+
+	attributes, err := decodeDBF(dbf)
+	if err != nil {
+		return nil, err
+	}
+
+	fc := geojson.NewFeatureCollection()
+	pos := 100
+	for i := 0; pos+8 <= len(shp); i++ {
+		length := int(binary.BigEndian.Uint32(shp[pos+4:pos+8])) * 2 // Lengths are in 16 bit words
+		pos += 8
+		if pos+length > len(shp) {
+			return nil, fmt.Errorf("Shapefile record %d is truncated", i+1)
+		}
+
+		geom, err := decodeShape(shp[pos : pos+length])
+		if err != nil {
+			return nil, fmt.Errorf("Shapefile record %d: %v", i+1, err)
+		}
+		pos += length
+
+		f := geojson.NewFeature(geom)
+		if i < len(attributes) {
+			f.Properties = attributes[i]
+		}
+		fc.AddFeature(f)
+	}
+
+	return fc, nil
+}
+
+// Decodes a single shape record's content. Z and M values are ignored
+func decodeShape(b []byte) (*geojson.Geometry, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("Empty shape")
+	}
+	le := binary.LittleEndian
+
+	point := func(at int) []float64 {
+		return []float64{math.Float64frombits(le.Uint64(b[at:])), math.Float64frombits(le.Uint64(b[at+8:]))}
+	}
+
+	switch shapeType := le.Uint32(b[0:4]); shapeType {
+	case 0: // Null
+		return nil, nil
+	case 1, 11, 21: // Point
+		if len(b) < 20 {
+			return nil, fmt.Errorf("Point is truncated")
+		}
+		return geojson.NewPointGeometry(point(4)), nil
+	case 8, 18, 28: // MultiPoint
+		if len(b) < 40 {
+			return nil, fmt.Errorf("MultiPoint is truncated")
+		}
+		n := int(le.Uint32(b[36:40]))
+		if len(b) < 40+n*16 {
+			return nil, fmt.Errorf("MultiPoint is truncated")
+		}
+		points := make([][]float64, n)
+		for i := range points {
+			points[i] = point(40 + i*16)
+		}
+		return geojson.NewMultiPointGeometry(points...), nil
+	case 3, 13, 23, 5, 15, 25: // PolyLine and Polygon
+		if len(b) < 44 {
+			return nil, fmt.Errorf("Shape is truncated")
+		}
+		numParts := int(le.Uint32(b[36:40]))
+		numPoints := int(le.Uint32(b[40:44]))
+		pointsAt := 44 + numParts*4
+		if len(b) < pointsAt+numPoints*16 {
+			return nil, fmt.Errorf("Shape is truncated")
+		}
+
+		parts := make([][][]float64, numParts)
+		for p := range parts {
+			start := int(le.Uint32(b[44+p*4:]))
+			end := numPoints
+			if p+1 < numParts {
+				end = int(le.Uint32(b[44+(p+1)*4:]))
+			}
+			if start > end || end > numPoints {
+				return nil, fmt.Errorf("Shape has invalid parts")
+			}
+			for i := start; i < end; i++ {
+				parts[p] = append(parts[p], point(pointsAt+i*16))
+			}
+		}
+
+		if shapeType == 3 || shapeType == 13 || shapeType == 23 {
+			if len(parts) == 1 {
+				return geojson.NewLineStringGeometry(parts[0]), nil
+			}
+			return geojson.NewMultiLineStringGeometry(parts...), nil
+		}
+		return polygonFromRings(parts), nil
+	default:
+		return nil, fmt.Errorf("Unsupported shape type %d", shapeType)
+	}
+}
+
+// Groups shapefile rings into polygons. Outer rings are clockwise and are followed by their holes, which are anticlockwise
+func polygonFromRings(rings [][][]float64) *geojson.Geometry {
+	polygons := [][][][]float64{}
+	for _, ring := range rings {
+		if ringArea(ring) <= 0 || len(polygons) == 0 {
+			polygons = append(polygons, [][][]float64{ring})
+		} else {
+			polygons[len(polygons)-1] = append(polygons[len(polygons)-1], ring)
+		}
+	}
+
+	if len(polygons) == 1 {
+		return geojson.NewPolygonGeometry(polygons[0])
+	}
+	return geojson.NewMultiPolygonGeometry(polygons...)
+}
+
+// The signed area of a ring, negative when it's clockwise
+func ringArea(ring [][]float64) float64 {
+	area := 0.0
+	for i := 0; i+1 < len(ring); i++ {
+		area += ring[i][0]*ring[i+1][1] - ring[i+1][0]*ring[i][1]
+	}
+	return area / 2
+}
+
+// Decodes the records of a dBASE file into maps of field name to value
+func decodeDBF(b []byte) ([]map[string]interface{}, error) {
+	if len(b) < 32 {
+		return nil, fmt.Errorf("Not a dBASE file")
+	}
+	le := binary.LittleEndian
+	numRecords := int(le.Uint32(b[4:8]))
+	headerLength := int(le.Uint16(b[8:10]))
+	recordLength := int(le.Uint16(b[10:12]))
+
+	type field struct {
+		name   string
+		kind   byte
+		length int
+	}
+	fields := []field{}
+	for at := 32; at+32 <= len(b) && b[at] != 0x0D; at += 32 {
+		name := string(bytes.TrimRight(b[at:at+11], "\x00"))
+		fields = append(fields, field{name, b[at+11], int(b[at+16])})
+	}
+
+	records := []map[string]interface{}{}
+	for r := 0; r < numRecords; r++ {
+		at := headerLength + r*recordLength
+		if at+recordLength > len(b) {
+			return nil, fmt.Errorf("dBASE record %d is truncated", r+1)
+		}
+		// The first byte is the deletion flag. Deleted records still have a shape, so they're kept to line up
+		at++
+
+		end := at + recordLength - 1
+		record := make(map[string]interface{})
+		for _, f := range fields {
+			if at+f.length > end {
+				return nil, fmt.Errorf("dBASE record %d is shorter than its fields", r+1)
+			}
+			value := strings.TrimSpace(string(b[at : at+f.length]))
+			at += f.length
+
+			if (f.kind == 'N' || f.kind == 'F') && value != "" {
+				if n, err := strconv.ParseFloat(value, 64); err == nil {
+					record[f.name] = n
+					continue
+				}
+			}
+			record[f.name] = value
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
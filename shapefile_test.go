@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// Builds a shapefile of polygons, each given as its rings
+func testShapefile(polygons [][][][]float64) []byte {
+	var records bytes.Buffer
+	for i, rings := range polygons {
+		var content bytes.Buffer
+		numPoints := 0
+		for _, ring := range rings {
+			numPoints += len(ring)
+		}
+		binary.Write(&content, binary.LittleEndian, int32(5))
+		content.Write(make([]byte, 32)) // Bounding box, which isn't used
+		binary.Write(&content, binary.LittleEndian, int32(len(rings)))
+		binary.Write(&content, binary.LittleEndian, int32(numPoints))
+		start := 0
+		for _, ring := range rings {
+			binary.Write(&content, binary.LittleEndian, int32(start))
+			start += len(ring)
+		}
+		for _, ring := range rings {
+			for _, p := range ring {
+				binary.Write(&content, binary.LittleEndian, math.Float64bits(p[0]))
+				binary.Write(&content, binary.LittleEndian, math.Float64bits(p[1]))
+			}
+		}
+
+		binary.Write(&records, binary.BigEndian, int32(i+1))
+		binary.Write(&records, binary.BigEndian, int32(content.Len()/2))
+		records.Write(content.Bytes())
+	}
+
+	header := make([]byte, 100)
+	binary.BigEndian.PutUint32(header[0:4], 9994)
+	binary.BigEndian.PutUint32(header[24:28], uint32((100+records.Len())/2))
+	binary.LittleEndian.PutUint32(header[28:32], 1000)
+	binary.LittleEndian.PutUint32(header[32:36], 5)
+	return append(header, records.Bytes()...)
+}
+
+// Builds a dBASE file with a character NAME field and a numeric AREA field
+func testDBF(names []string, areas []string) []byte {
+	var b bytes.Buffer
+	header := make([]byte, 32)
+	header[0] = 3
+	binary.LittleEndian.PutUint32(header[4:8], uint32(len(names)))
+	binary.LittleEndian.PutUint16(header[8:10], 32+2*32+1)
+	binary.LittleEndian.PutUint16(header[10:12], 1+20+10)
+	b.Write(header)
+
+	field := func(name string, kind byte, length int) {
+		f := make([]byte, 32)
+		copy(f, name)
+		f[11] = kind
+		f[16] = byte(length)
+		b.Write(f)
+	}
+	field("NAME", 'C', 20)
+	field("AREA", 'N', 10)
+	b.WriteByte(0x0D)
+
+	for i := range names {
+		b.WriteByte(' ')
+		b.WriteString(pad(names[i], 20))
+		b.WriteString(pad(areas[i], 10))
+	}
+	return b.Bytes()
+}
+
+func pad(s string, n int) string {
+	return s + string(bytes.Repeat([]byte(" "), n-len(s)))
+}
+
+func TestDecodeShapefile(t *testing.T) {
+	// Outer rings are clockwise, holes anticlockwise
+	square := [][]float64{{150, -33}, {151, -33}, {151, -34}, {150, -34}, {150, -33}}
+	hole := [][]float64{{150.2, -33.2}, {150.2, -33.8}, {150.8, -33.8}, {150.8, -33.2}, {150.2, -33.2}}
+	other := [][]float64{{152, -33}, {153, -34}, {152, -34}, {152, -33}}
+
+	shp := testShapefile([][][][]float64{{square, hole}, {square, other}})
+	dbf := testDBF([]string{"Blue Mountains", "Hawkesbury"}, []string{"1431.5", ""})
+
+	fc, err := decodeShapefile(shp, dbf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fc.Features) != 2 {
+		t.Fatalf("Expected 2 features, got %d", len(fc.Features))
+	}
+
+	first := fc.Features[0]
+	if !first.Geometry.IsPolygon() || len(first.Geometry.Polygon) != 2 {
+		t.Errorf("Expected a polygon with a hole, got %v", first.Geometry)
+	}
+	if name, _ := first.PropertyString("NAME"); name != "Blue Mountains" {
+		t.Errorf("Expected NAME to be Blue Mountains, got %q", name)
+	}
+	if area, _ := first.PropertyFloat64("AREA"); area != 1431.5 {
+		t.Errorf("Expected AREA to be 1431.5, got %v", area)
+	}
+
+	second := fc.Features[1]
+	if !second.Geometry.IsMultiPolygon() || len(second.Geometry.MultiPolygon) != 2 {
+		t.Errorf("Expected a multipolygon of 2 polygons, got %v", second.Geometry)
+	}
+	if area := second.Properties["AREA"]; area != "" {
+		t.Errorf("Expected a blank AREA, got %v", area)
+	}
+}
+
+func TestDecodeShapefileTruncated(t *testing.T) {
+	shp := testShapefile([][][][]float64{{{{150, -33}, {150, -34}, {151, -34}, {150, -33}}}})
+	dbf := testDBF([]string{"Blue Mountains"}, []string{"1"})
+
+	_, err := decodeShapefile(shp[:len(shp)-8], dbf)
+	if err == nil {
+		t.Error("Expected a truncated shapefile to be an error")
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Situation report formats
+const (
+	sitrepMarkdown = "markdown"
+	sitrepHTML     = "html"
+)
+
+// A size in the feed, e.g. "1,250 ha" or "0.5 ha"
+var sizeHectaresPattern = regexp.MustCompile(`(?i)([0-9][0-9,]*(?:\.[0-9]+)?)\s*ha`)
+
+// The size of an incident in hectares. False when it isn't given in hectares
+func sizeHectares(size string) (float64, bool) {
+	m := sizeHectaresPattern.FindStringSubmatch(size)
+	if m == nil {
+		return 0, false
+	}
+	ha, err := strconv.ParseFloat(strings.Replace(m[1], ",", "", -1), 64)
+	return ha, err == nil
+}
+
+type sitrepCount struct {
+	Name  string
+	Count int
+}
+
+// A summary of the situation at a time, and the hours before it
+type Sitrep struct {
+	At          time.Time
+	Hours       int
+	Incidents   int // Current
+	Fires       int // Current incidents that are fires
+	AlertLevels []sitrepCount
+	Statuses    []sitrepCount
+	Warnings    []IncidentReport // Current incidents with an alert level, the most severe first
+	Largest     []IncidentReport // Current fires by size, largest first
+	New         []IncidentReport // Incidents first reported in the last Hours, most recent first
+	Resolved    []IncidentReport // Incidents resolved in the last Hours and still resolved, most recent first
+}
+
+// Counts incidents by a field, most first. Empty values are counted as Unknown
+func countIncidents(incidents []IncidentReport, field func(Report) string) []sitrepCount {
+	counts := []sitrepCount{}
+	index := make(map[string]int)
+	for _, i := range incidents {
+		name := strings.TrimSpace(field(i.Report))
+		if name == "" {
+			name = "Unknown"
+		}
+		key := strings.ToLower(name)
+		if n, ok := index[key]; ok {
+			counts[n].Count++
+			continue
+		}
+		index[key] = len(counts)
+		counts = append(counts, sitrepCount{name, 1})
+	}
+	sort.SliceStable(counts, func(i, j int) bool { return counts[i].Count > counts[j].Count })
+	return counts
+}
+
+// Builds a situation report from the current incidents and those that were new and resolved in the hours before at.
+// top is how many of the largest fires to list
+func newSitrep(at time.Time, hours int, current, newIncidents, resolved []IncidentReport, top int) Sitrep {
+	s := Sitrep{
+		At:        at,
+		Hours:     hours,
+		Incidents: len(current),
+		Statuses:  countIncidents(current, func(r Report) string { return r.Status }),
+		Warnings:  []IncidentReport{},
+		Largest:   []IncidentReport{},
+		New:       newIncidents,
+		Resolved:  resolved,
+	}
+
+	// Alert levels are counted most severe first, whether there are any or not
+	levels := make([]int, len(alertLevels))
+	for _, i := range current {
+		levels[alertLevelRank(i.Report.AlertLevel)]++
+		if i.Report.Fire {
+			s.Fires++
+		}
+		if alertLevelRank(i.Report.AlertLevel) > 0 {
+			s.Warnings = append(s.Warnings, i)
+		}
+		if _, ok := sizeHectares(i.Report.Size); ok && i.Report.Fire {
+			s.Largest = append(s.Largest, i)
+		}
+	}
+	for n := len(alertLevels) - 1; n >= 0; n-- {
+		s.AlertLevels = append(s.AlertLevels, sitrepCount{alertLevels[n], levels[n]})
+	}
+
+	sort.SliceStable(s.Warnings, func(i, j int) bool {
+		ri, rj := alertLevelRank(s.Warnings[i].Report.AlertLevel), alertLevelRank(s.Warnings[j].Report.AlertLevel)
+		if ri != rj {
+			return ri > rj
+		}
+		return s.Warnings[i].Report.Pubdate.After(s.Warnings[j].Report.Pubdate)
+	})
+	sort.SliceStable(s.Largest, func(i, j int) bool {
+		si, _ := sizeHectares(s.Largest[i].Report.Size)
+		sj, _ := sizeHectares(s.Largest[j].Report.Size)
+		return si > sj
+	})
+	if len(s.Largest) > top {
+		s.Largest = s.Largest[:top]
+	}
+
+	return s
+}
+
+// Fetches incidents first reported since a time, each with its latest report
+func GetNewIncidents(since time.Time) ([]IncidentReport, error) {
+	return queryIncidentReports(`SELECT `+reportColumns+`, i.rfs_id FROM incidents i
+    JOIN LATERAL (SELECT * FROM reports WHERE reports.incident_uuid = i.uuid ORDER BY pubdate DESC, created_at DESC LIMIT 1) reports ON true
+    WHERE lower(i.current_from) >= $1
+    ORDER BY lower(i.current_from) DESC`, since.UTC().Format(time.RFC3339))
+}
+
+// Fetches incidents resolved since a time that haven't been reopened, each with its latest report
+func GetResolvedIncidents(since time.Time) ([]IncidentReport, error) {
+	return queryIncidentReports(`SELECT `+reportColumns+`, i.rfs_id FROM incidents i
+    JOIN LATERAL (SELECT * FROM reports WHERE reports.incident_uuid = i.uuid ORDER BY pubdate DESC, created_at DESC LIMIT 1) reports ON true
+    JOIN LATERAL (SELECT MAX(occurred_at) AS occurred_at FROM incident_events e WHERE e.incident_uuid = i.uuid AND e.type = $2) resolved ON true
+    WHERE NOT i.current AND resolved.occurred_at >= $1
+    ORDER BY resolved.occurred_at DESC`, since.UTC().Format(time.RFC3339), eventIncidentResolved)
+}
+
+// Builds a situation report of now and the hours before
+func GetSitrep(hours, top int) (Sitrep, error) {
+	at := time.Now()
+	since := at.Add(-time.Duration(hours) * time.Hour)
+
+	current, err := GetIncidentsAsOf(time.Time{}) // Now
+	if err != nil {
+		return Sitrep{}, err
+	}
+	newIncidents, err := GetNewIncidents(since)
+	if err != nil {
+		return Sitrep{}, err
+	}
+	resolved, err := GetResolvedIncidents(since)
+	if err != nil {
+		return Sitrep{}, err
+	}
+
+	return newSitrep(at, hours, current, newIncidents, resolved, top), nil
+}
+
+func sitrepTime(t time.Time) string {
+	return t.In(feedLocation).Format("2006-01-02 15:04 MST")
+}
+
+// Escapes text for a Markdown table cell
+func markdownCell(s string) string {
+	s = strings.Replace(strings.TrimSpace(s), "|", "\\|", -1)
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// The incident's title, linked to the RFS if there's a link
+func markdownIncident(i IncidentReport) string {
+	if i.Report.Link == "" {
+		return markdownCell(i.Report.Title)
+	}
+	return "[" + markdownCell(i.Report.Title) + "](" + i.Report.Link + ")"
+}
+
+func writeMarkdownIncidents(w io.Writer, title string, incidents []IncidentReport, columns []string, row func(IncidentReport) []string) {
+	fmt.Fprintf(w, "## %s\n\n", title)
+	if len(incidents) == 0 {
+		fmt.Fprint(w, "None.\n\n")
+		return
+	}
+	fmt.Fprintf(w, "| %s |\n|%s\n", strings.Join(columns, " | "), strings.Repeat(" --- |", len(columns)))
+	for _, i := range incidents {
+		fmt.Fprintf(w, "| %s |\n", strings.Join(row(i), " | "))
+	}
+	fmt.Fprint(w, "\n")
+}
+
+// Writes the situation report as Markdown
+func writeSitrepMarkdown(w io.Writer, s Sitrep) {
+	fmt.Fprintf(w, "# Situation report\n\n%s. %d incidents, %d of them fires.\n\n", sitrepTime(s.At), s.Incidents, s.Fires)
+
+	for _, c := range []struct {
+		title  string
+		counts []sitrepCount
+	}{{"Alert level", s.AlertLevels}, {"Status", s.Statuses}} {
+		fmt.Fprintf(w, "| %s | Incidents |\n| --- | ---: |\n", c.title)
+		for _, count := range c.counts {
+			fmt.Fprintf(w, "| %s | %d |\n", markdownCell(count.Name), count.Count)
+		}
+		fmt.Fprint(w, "\n")
+	}
+
+	writeMarkdownIncidents(w, "Warnings", s.Warnings, []string{"Alert level", "Incident", "Council area", "Status", "Size", "Updated"}, func(i IncidentReport) []string {
+		r := i.Report
+		return []string{markdownCell(r.AlertLevel), markdownIncident(i), markdownCell(r.CouncilArea), markdownCell(r.Status), markdownCell(r.Size), sitrepTime(r.Pubdate)}
+	})
+	writeMarkdownIncidents(w, "Largest fires", s.Largest, []string{"Incident", "Size", "Council area", "Status", "Alert level"}, func(i IncidentReport) []string {
+		r := i.Report
+		return []string{markdownIncident(i), markdownCell(r.Size), markdownCell(r.CouncilArea), markdownCell(r.Status), markdownCell(r.AlertLevel)}
+	})
+	writeMarkdownIncidents(w, fmt.Sprintf("New in the last %d hours", s.Hours), s.New, []string{"Incident", "Council area", "Type", "Status", "Alert level"}, func(i IncidentReport) []string {
+		r := i.Report
+		return []string{markdownIncident(i), markdownCell(r.CouncilArea), markdownCell(r.FireType), markdownCell(r.Status), markdownCell(r.AlertLevel)}
+	})
+	writeMarkdownIncidents(w, fmt.Sprintf("Resolved in the last %d hours", s.Hours), s.Resolved, []string{"Incident", "Council area", "Size", "Last reported"}, func(i IncidentReport) []string {
+		r := i.Report
+		return []string{markdownIncident(i), markdownCell(r.CouncilArea), markdownCell(r.Size), sitrepTime(r.Pubdate)}
+	})
+}
+
+var sitrepHTMLTemplate = template.Must(template.New("sitrep").Funcs(template.FuncMap{
+	"time":    sitrepTime,
+	"styleId": kmlStyleId,
+	"counts": func(title string, counts []sitrepCount) interface{} {
+		return struct {
+			Title  string
+			Counts []sitrepCount
+		}{title, counts}
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Situation report {{time .At}}</title>
+<style>
+body { font-family: sans-serif; max-width: 60em; margin: 2em auto; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+.emergency-warning { background: #fcdcdc; }
+.watch-and-act { background: #ffe8cc; }
+.advice { background: #fff8cc; }
+</style>
+</head>
+<body>
+<h1>Situation report</h1>
+<p>{{time .At}}. {{.Incidents}} incidents, {{.Fires}} of them fires.</p>
+{{define "counts"}}<table>
+<tr><th>{{.Title}}</th><th>Incidents</th></tr>
+{{range .Counts}}<tr><td>{{or .Name "-"}}</td><td>{{.Count}}</td></tr>
+{{end}}</table>
+{{end}}{{define "incident"}}{{if .Report.Link}}<a href="{{.Report.Link}}">{{.Report.Title}}</a>{{else}}{{.Report.Title}}{{end}}{{end}}
+{{template "counts" (counts "Alert level" .AlertLevels)}}
+{{template "counts" (counts "Status" .Statuses)}}
+<h2>Warnings</h2>
+{{with .Warnings}}<table>
+<tr><th>Alert level</th><th>Incident</th><th>Council area</th><th>Status</th><th>Size</th><th>Updated</th></tr>
+{{range .}}<tr class="{{styleId .Report.AlertLevel}}"><td>{{.Report.AlertLevel}}</td><td>{{template "incident" .}}</td><td>{{.Report.CouncilArea}}</td><td>{{.Report.Status}}</td><td>{{.Report.Size}}</td><td>{{time .Report.Pubdate}}</td></tr>
+{{end}}</table>{{else}}<p>None.</p>{{end}}
+<h2>Largest fires</h2>
+{{with .Largest}}<table>
+<tr><th>Incident</th><th>Size</th><th>Council area</th><th>Status</th><th>Alert level</th></tr>
+{{range .}}<tr><td>{{template "incident" .}}</td><td>{{.Report.Size}}</td><td>{{.Report.CouncilArea}}</td><td>{{.Report.Status}}</td><td>{{.Report.AlertLevel}}</td></tr>
+{{end}}</table>{{else}}<p>None.</p>{{end}}
+<h2>New in the last {{.Hours}} hours</h2>
+{{with .New}}<table>
+<tr><th>Incident</th><th>Council area</th><th>Type</th><th>Status</th><th>Alert level</th></tr>
+{{range .}}<tr><td>{{template "incident" .}}</td><td>{{.Report.CouncilArea}}</td><td>{{.Report.FireType}}</td><td>{{.Report.Status}}</td><td>{{.Report.AlertLevel}}</td></tr>
+{{end}}</table>{{else}}<p>None.</p>{{end}}
+<h2>Resolved in the last {{.Hours}} hours</h2>
+{{with .Resolved}}<table>
+<tr><th>Incident</th><th>Council area</th><th>Size</th><th>Last reported</th></tr>
+{{range .}}<tr><td>{{template "incident" .}}</td><td>{{.Report.CouncilArea}}</td><td>{{.Report.Size}}</td><td>{{time .Report.Pubdate}}</td></tr>
+{{end}}</table>{{else}}<p>None.</p>{{end}}
+</body>
+</html>
+`))
+
+// Writes the situation report as a standalone HTML page
+func writeSitrepHTML(w io.Writer, s Sitrep) error {
+	return sitrepHTMLTemplate.Execute(w, s)
+}
+
+// Writes a situation report of now and the hours before
+func WriteSitrep(w io.Writer, hours, top int, format string) error {
+	if format != sitrepMarkdown && format != sitrepHTML {
+		return fmt.Errorf("Unknown situation report format %q, use markdown or html", format)
+	}
+
+	s, err := GetSitrep(hours, top)
+	if err != nil {
+		return err
+	}
+
+	if format == sitrepMarkdown {
+		writeSitrepMarkdown(w, s)
+		return nil
+	}
+	return writeSitrepHTML(w, s)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSizeHectares(t *testing.T) {
+	cases := map[string]float64{
+		"120 ha":   120,
+		"1,250 ha": 1250,
+		"0.5ha":    0.5,
+		"12 HA":    12,
+	}
+	for size, expected := range cases {
+		if ha, ok := sizeHectares(size); !ok || ha != expected {
+			t.Errorf("Expected %q to be %v ha, got %v %v", size, expected, ha, ok)
+		}
+	}
+	for _, size := range []string{"", "Unknown", "3 km"} {
+		if _, ok := sizeHectares(size); ok {
+			t.Errorf("Expected %q not to be a size", size)
+		}
+	}
+}
+
+func TestSitrep(t *testing.T) {
+	at := time.Date(2015, 12, 1, 10, 31, 0, 0, time.UTC)
+	incident := func(rfsId int, title, alertLevel, status, size string, fire bool, age time.Duration) IncidentReport {
+		return IncidentReport{rfsId, Report{Title: title, AlertLevel: alertLevel, Status: status, Size: size, Fire: fire, Pubdate: at.Add(-age)}}
+	}
+	current := []IncidentReport{
+		incident(1, "Small | fire", "Advice", "Under control", "5 ha", true, time.Hour),
+		incident(2, "Big fire", "Emergency Warning", "Out of control", "1,200 ha", true, 2*time.Hour),
+		incident(3, "Medium fire", "Watch and Act", "Out of control", "300 ha", true, 3*time.Hour),
+		incident(4, "Hazard reduction", "Not Applicable", "under control", "40 ha", false, 4*time.Hour),
+		incident(5, "Another fire", "Advice", "", "Unknown", true, 30*time.Minute),
+	}
+
+	s := newSitrep(at, 24, current, current[:1], []IncidentReport{}, 2)
+	if s.Incidents != 5 || s.Fires != 4 {
+		t.Errorf("Expected 5 incidents and 4 fires, got %d and %d", s.Incidents, s.Fires)
+	}
+	if s.AlertLevels[0] != (sitrepCount{"Emergency Warning", 1}) || s.AlertLevels[2] != (sitrepCount{"Advice", 2}) || s.AlertLevels[3] != (sitrepCount{"Not Applicable", 1}) {
+		t.Errorf("Unexpected alert levels %v", s.AlertLevels)
+	}
+	if len(s.Statuses) != 3 || s.Statuses[0] != (sitrepCount{"Under control", 2}) || s.Statuses[2].Name != "Unknown" {
+		t.Errorf("Unexpected statuses %v", s.Statuses)
+	}
+	var warnings []int
+	for _, i := range s.Warnings {
+		warnings = append(warnings, i.RFSId)
+	}
+	if len(warnings) != 4 || warnings[0] != 2 || warnings[1] != 3 || warnings[2] != 5 || warnings[3] != 1 {
+		t.Errorf("Expected warnings most severe then most recent first, got %v", warnings)
+	}
+	if len(s.Largest) != 2 || s.Largest[0].RFSId != 2 || s.Largest[1].RFSId != 3 {
+		t.Errorf("Unexpected largest fires %v", s.Largest)
+	}
+
+	var b bytes.Buffer
+	writeSitrepMarkdown(&b, s)
+	for _, expected := range []string{
+		"| Emergency Warning | 1 |",
+		"| Emergency Warning | Big fire | - | Out of control | 1,200 ha | 2015-12-01 19:31 AEDT |",
+		`| Advice | Small \| fire | - | Under control |`,
+		"## Resolved in the last 24 hours\n\nNone.",
+	} {
+		if !strings.Contains(b.String(), expected) {
+			t.Errorf("Expected the Markdown to contain %q, got %s", expected, b.String())
+		}
+	}
+
+	b.Reset()
+	if err := writeSitrepHTML(&b, s); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`<tr class="emergency-warning"><td>Emergency Warning</td><td>Big fire</td>`,
+		"<tr><td>Advice</td><td>2</td></tr>",
+		"<h2>New in the last 24 hours</h2>",
+	} {
+		if !strings.Contains(b.String(), expected) {
+			t.Errorf("Expected the HTML to contain %q, got %s", expected, b.String())
+		}
+	}
+}
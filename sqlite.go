@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// Writes SQLite databases, just enough of the file format (https://www.sqlite.org/fileformat.html) to write GeoPackages
+// without cgo. Every table is written whole, so there's no free space or freelist to keep track of
+
+const sqlitePageSize = 4096
+
+// Payloads larger than these spill onto overflow pages
+const (
+	sqliteTableMaxLocal = sqlitePageSize - 35
+	sqliteIndexMaxLocal = (sqlitePageSize-12)*64/255 - 23
+	sqliteMinLocal      = (sqlitePageSize-12)*32/255 - 23
+)
+
+// B-tree page types
+const (
+	sqliteTableInterior = 0x05
+	sqliteTableLeaf     = 0x0d
+	sqliteIndexLeaf     = 0x0a
+)
+
+// A row's values are nil, int64, float64, string or []byte. A column that's an INTEGER PRIMARY KEY is the rowid, and
+// its value is nil
+type sqliteRow struct {
+	Rowid  int64
+	Values []interface{}
+}
+
+// An index of some of a table's columns. Those SQLite creates itself for PRIMARY KEY and UNIQUE constraints are named
+// sqlite_autoindex_<table>_<n>, numbered in the order the constraints appear, and don't have any SQL
+type sqliteIndex struct {
+	Name    string
+	SQL     string
+	Columns []int
+}
+
+type sqliteTable struct {
+	Name    string
+	SQL     string
+	Rows    []sqliteRow // In rowid order
+	Indexes []sqliteIndex
+}
+
+// A SQLite database. ApplicationId and UserVersion are in its header, e.g. to say it's a GeoPackage
+type sqliteDatabase struct {
+	ApplicationId uint32
+	UserVersion   uint32
+	Tables        []sqliteTable
+}
+
+type sqliteWriter struct {
+	pages [][]byte // Page 1 is pages[0]
+}
+
+func (w *sqliteWriter) allocate() int {
+	w.pages = append(w.pages, make([]byte, sqlitePageSize))
+	return len(w.pages)
+}
+
+func (w *sqliteWriter) page(n int) []byte {
+	return w.pages[n-1]
+}
+
+// Page 1 starts with the database header, and its b-tree comes after it
+func sqliteHeaderOffset(page int) int {
+	if page == 1 {
+		return 100
+	}
+	return 0
+}
+
+// SQLite's big-endian variable length integer. The 9th byte, if there is one, has 8 bits
+func sqliteVarint(v uint64) []byte {
+	if v <= 0x7f {
+		return []byte{byte(v)}
+	}
+	if v > 0x00ffffffffffffff {
+		b := make([]byte, 9)
+		b[8] = byte(v)
+		v >>= 8
+		for i := 7; i >= 0; i-- {
+			b[i] = byte(v&0x7f) | 0x80
+			v >>= 7
+		}
+		return b
+	}
+
+	groups := []byte{}
+	for v > 0 {
+		groups = append(groups, byte(v&0x7f))
+		v >>= 7
+	}
+	b := make([]byte, len(groups))
+	for i := range groups {
+		b[i] = groups[len(groups)-1-i] | 0x80
+	}
+	b[len(b)-1] &= 0x7f
+	return b
+}
+
+// The serial type of an integer, and its big-endian bytes
+func sqliteInteger(v int64) (uint64, []byte) {
+	switch {
+	case v == 0:
+		return 8, nil
+	case v == 1:
+		return 9, nil
+	}
+
+	sizes := []struct {
+		serialType uint64
+		bytes      uint
+	}{{1, 1}, {2, 2}, {3, 3}, {4, 4}, {5, 6}, {6, 8}}
+	for _, s := range sizes {
+		bits := s.bytes * 8
+		if s.bytes == 8 || (v >= -(1<<(bits-1)) && v < 1<<(bits-1)) {
+			b := make([]byte, 8)
+			binary.BigEndian.PutUint64(b, uint64(v))
+			return s.serialType, b[8-s.bytes:]
+		}
+	}
+	return 0, nil
+}
+
+// Encodes values in SQLite's record format: a header of their serial types, then their bodies
+func sqliteRecord(values []interface{}) ([]byte, error) {
+	types, body := []byte{}, []byte{}
+	for _, v := range values {
+		var serialType uint64
+		switch v := v.(type) {
+		case nil:
+			serialType = 0
+		case int64:
+			var b []byte
+			serialType, b = sqliteInteger(v)
+			body = append(body, b...)
+		case float64:
+			serialType = 7
+			b := make([]byte, 8)
+			binary.BigEndian.PutUint64(b, math.Float64bits(v))
+			body = append(body, b...)
+		case string:
+			serialType = uint64(len(v))*2 + 13
+			body = append(body, v...)
+		case []byte:
+			serialType = uint64(len(v))*2 + 12
+			body = append(body, v...)
+		default:
+			return nil, fmt.Errorf("Can't store a %T in SQLite", v)
+		}
+		types = append(types, sqliteVarint(serialType)...)
+	}
+
+	// The header's size includes the varint it's written in
+	size := len(types) + 1
+	for len(sqliteVarint(uint64(size)))+len(types) != size {
+		size = len(sqliteVarint(uint64(size))) + len(types)
+	}
+
+	record := append(sqliteVarint(uint64(size)), types...)
+	return append(record, body...), nil
+}
+
+// Compares values the way SQLite orders them in indexes: NULLs, then numbers, then text, then blobs
+func sqliteCompare(a, b interface{}) int {
+	class := func(v interface{}) int {
+		switch v.(type) {
+		case nil:
+			return 0
+		case int64, float64:
+			return 1
+		case string:
+			return 2
+		}
+		return 3
+	}
+	number := func(v interface{}) float64 {
+		if i, ok := v.(int64); ok {
+			return float64(i)
+		}
+		return v.(float64)
+	}
+
+	ca, cb := class(a), class(b)
+	if ca != cb {
+		return ca - cb
+	}
+	switch ca {
+	case 1:
+		na, nb := number(a), number(b)
+		if na < nb {
+			return -1
+		} else if na > nb {
+			return 1
+		}
+		return 0
+	case 2:
+		return bytes.Compare([]byte(a.(string)), []byte(b.(string)))
+	case 3:
+		return bytes.Compare(a.([]byte), b.([]byte))
+	}
+	return 0
+}
+
+// A b-tree cell with a payload, spilling onto overflow pages when it's too big
+func (w *sqliteWriter) cell(prefix, payload []byte, maxLocal int) []byte {
+	cell := append([]byte{}, prefix...)
+	if len(payload) <= maxLocal {
+		return append(cell, payload...)
+	}
+
+	usable := sqlitePageSize - 4
+	local := sqliteMinLocal + (len(payload)-sqliteMinLocal)%usable
+	if local > maxLocal {
+		local = sqliteMinLocal
+	}
+	cell = append(cell, payload[:local]...)
+
+	rest := payload[local:]
+	first := w.allocate()
+	cell = append(cell, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(cell[len(cell)-4:], uint32(first))
+	for n := first; len(rest) > 0; {
+		page := w.page(n)
+		size := copy(page[4:], rest)
+		rest = rest[size:]
+		if len(rest) > 0 {
+			next := w.allocate()
+			binary.BigEndian.PutUint32(page[:4], uint32(next))
+			n = next
+		}
+	}
+	return cell
+}
+
+// Writes cells to a b-tree page, filling it from the end
+func (w *sqliteWriter) writePage(n int, pageType byte, cells [][]byte, rightmost int) {
+	page := w.page(n)
+	offset := sqliteHeaderOffset(n)
+	headerSize := 8
+	if pageType == sqliteTableInterior {
+		headerSize = 12
+		binary.BigEndian.PutUint32(page[offset+8:], uint32(rightmost))
+	}
+
+	content := sqlitePageSize
+	for i, c := range cells {
+		content -= len(c)
+		copy(page[content:], c)
+		binary.BigEndian.PutUint16(page[offset+headerSize+i*2:], uint16(content))
+	}
+
+	page[offset] = pageType
+	binary.BigEndian.PutUint16(page[offset+3:], uint16(len(cells)))
+	binary.BigEndian.PutUint16(page[offset+5:], uint16(content))
+}
+
+// Whether cells fit on a page along with a header of headerSize
+func sqliteCellsFit(page int, cells [][]byte, headerSize int) bool {
+	size := sqliteHeaderOffset(page) + headerSize
+	for _, c := range cells {
+		size += 2 + len(c)
+	}
+	return size <= sqlitePageSize
+}
+
+// Splits cells into groups that each fit on a page. There's always more than one group, as the groups are children
+// of a page above them
+func sqlitePackCells(cells [][]byte, headerSize int) [][][]byte {
+	groups := [][][]byte{}
+	group := [][]byte{}
+	for _, c := range cells {
+		if len(group) > 0 && !sqliteCellsFit(0, append(group, c), headerSize) {
+			groups = append(groups, group)
+			group = [][]byte{}
+		}
+		group = append(group, c)
+	}
+	groups = append(groups, group)
+
+	if len(groups) == 1 && len(group) > 1 {
+		return [][][]byte{group[:len(group)/2], group[len(group)/2:]}
+	}
+	return groups
+}
+
+// Writes a table's b-tree, returning its root page. root is 0 to allocate one
+func (w *sqliteWriter) writeTable(rows []sqliteRow, root int) (int, error) {
+	if root == 0 {
+		root = w.allocate()
+	}
+
+	cells := [][]byte{}
+	for _, r := range rows {
+		record, err := sqliteRecord(r.Values)
+		if err != nil {
+			return 0, err
+		}
+		prefix := append(sqliteVarint(uint64(len(record))), sqliteVarint(uint64(r.Rowid))...)
+		cells = append(cells, w.cell(prefix, record, sqliteTableMaxLocal))
+	}
+	if sqliteCellsFit(root, cells, 8) {
+		w.writePage(root, sqliteTableLeaf, cells, 0)
+		return root, nil
+	}
+
+	// Too many for one page, so the leaves go below interior pages keyed by the largest rowid in each child
+	type child struct {
+		page     int
+		maxRowid int64
+	}
+	children := []child{}
+	i := 0
+	for _, group := range sqlitePackCells(cells, 8) {
+		n := w.allocate()
+		w.writePage(n, sqliteTableLeaf, group, 0)
+		i += len(group)
+		children = append(children, child{n, rows[i-1].Rowid})
+	}
+
+	interiorCell := func(c child) []byte {
+		cell := make([]byte, 4)
+		binary.BigEndian.PutUint32(cell, uint32(c.page))
+		return append(cell, sqliteVarint(uint64(c.maxRowid))...)
+	}
+	for {
+		// The last child is the page's rightmost pointer rather than a cell
+		cells = [][]byte{}
+		for _, c := range children[:len(children)-1] {
+			cells = append(cells, interiorCell(c))
+		}
+		if sqliteCellsFit(root, cells, 12) {
+			w.writePage(root, sqliteTableInterior, cells, children[len(children)-1].page)
+			return root, nil
+		}
+
+		parents := []child{}
+		i = 0
+		for _, group := range sqlitePackCells(append(cells, interiorCell(children[len(children)-1])), 12) {
+			n := w.allocate()
+			last := children[i+len(group)-1]
+			w.writePage(n, sqliteTableInterior, group[:len(group)-1], last.page)
+			i += len(group)
+			parents = append(parents, child{n, last.maxRowid})
+		}
+		children = parents
+	}
+}
+
+// Writes an index of a table's rows, returning its root page. Indexes are only written for small tables, on one page
+func (w *sqliteWriter) writeIndex(t sqliteTable, index sqliteIndex) (int, error) {
+	keys := [][]interface{}{}
+	for _, r := range t.Rows {
+		key := []interface{}{}
+		for _, c := range index.Columns {
+			key = append(key, r.Values[c])
+		}
+		keys = append(keys, append(key, r.Rowid))
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		for c := range keys[i] {
+			if d := sqliteCompare(keys[i][c], keys[j][c]); d != 0 {
+				return d < 0
+			}
+		}
+		return false
+	})
+
+	cells := [][]byte{}
+	for _, key := range keys {
+		record, err := sqliteRecord(key)
+		if err != nil {
+			return 0, err
+		}
+		if len(record) > sqliteIndexMaxLocal {
+			return 0, fmt.Errorf("%s's keys are too long to index", t.Name)
+		}
+		cells = append(cells, append(sqliteVarint(uint64(len(record))), record...))
+	}
+
+	root := w.allocate()
+	if !sqliteCellsFit(root, cells, 8) {
+		return 0, fmt.Errorf("%s has too many rows to index", t.Name)
+	}
+	w.writePage(root, sqliteIndexLeaf, cells, 0)
+	return root, nil
+}
+
+// Writes the database's header to page 1
+func (w *sqliteWriter) writeHeader(database sqliteDatabase) {
+	h := w.page(1)[:100]
+	copy(h, "SQLite format 3\x00")
+	binary.BigEndian.PutUint16(h[16:], sqlitePageSize)
+	h[18], h[19] = 1, 1                                      // Rollback journal
+	h[21], h[22], h[23] = 64, 32, 32                         // Payload fractions, which must be these
+	binary.BigEndian.PutUint32(h[24:], 1)                    // Change counter
+	binary.BigEndian.PutUint32(h[28:], uint32(len(w.pages))) // Size in pages
+	binary.BigEndian.PutUint32(h[40:], 1)                    // Schema cookie
+	binary.BigEndian.PutUint32(h[44:], 4)                    // Schema format
+	binary.BigEndian.PutUint32(h[56:], 1)                    // UTF-8
+	binary.BigEndian.PutUint32(h[60:], database.UserVersion)
+	binary.BigEndian.PutUint32(h[68:], database.ApplicationId)
+	binary.BigEndian.PutUint32(h[92:], 1)       // The size is valid for this change counter
+	binary.BigEndian.PutUint32(h[96:], 3031001) // Written as if by SQLite 3.31.1
+}
+
+// Writes a SQLite database file
+func writeSQLite(out io.Writer, database sqliteDatabase) error {
+	w := &sqliteWriter{}
+	// Page 1 is the root of sqlite_master, which is written once the other tables' roots are known
+	w.allocate()
+
+	schema := []sqliteRow{}
+	for _, t := range database.Tables {
+		root, err := w.writeTable(t.Rows, 0)
+		if err != nil {
+			return err
+		}
+		schema = append(schema, sqliteRow{int64(len(schema) + 1), []interface{}{"table", t.Name, t.Name, int64(root), t.SQL}})
+
+		for _, index := range t.Indexes {
+			root, err = w.writeIndex(t, index)
+			if err != nil {
+				return err
+			}
+			var sql interface{}
+			if index.SQL != "" {
+				sql = index.SQL
+			}
+			schema = append(schema, sqliteRow{int64(len(schema) + 1), []interface{}{"index", index.Name, t.Name, int64(root), sql}})
+		}
+	}
+
+	_, err := w.writeTable(schema, 1)
+	if err != nil {
+		return err
+	}
+	w.writeHeader(database)
+
+	for _, page := range w.pages {
+		if _, err = out.Write(page); err != nil {
+			return err
+		}
+	}
+	return nil
+}
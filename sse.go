@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How often the stream looks for new events
+const sseInterval = 2 * time.Second
+
+// How often a comment's sent so proxies don't close an idle stream
+const sseKeepAliveInterval = 15 * time.Second
+
+// Writes an event with its payload as a server-sent event. The event id lets clients resume with Last-Event-ID
+func writeSSE(w io.Writer, e IncidentEvent, payload []byte) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Id, e.Type, payload)
+	return err
+}
+
+// Where a stream starts: after the Last-Event-ID a reconnecting client sends, or since, or from now
+func sseCursor(r *http.Request) (int, error) {
+	if v := strings.TrimSpace(r.Header.Get("Last-Event-ID")); v != "" {
+		return strconv.Atoi(v)
+	}
+	if v := r.URL.Query().Get("since"); v != "" {
+		return strconv.Atoi(v)
+	}
+	return GetLatestEventId()
+}
+
+// GET /events/stream?since=<id>&type=<type,...>&incident=<rfs_id>
+// Events as server-sent events as they're recorded, each with the event and a summary of its report like webhooks.
+// Reconnecting clients resume after the Last-Event-ID they send, so they don't miss anything
+func handleEventStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("Streaming isn't supported"))
+		return
+	}
+
+	q := EventQuery{Limit: 500}
+	var err error
+	if q.Since, err = sseCursor(r); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if q.RFSId, err = queryInt(r, "incident", 0); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if t := r.URL.Query().Get("type"); t != "" {
+		q.Types = strings.Split(t, ",")
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	// Tells EventSource how long to wait before reconnecting
+	fmt.Fprintf(w, "retry: %d\n\n", sseInterval/time.Millisecond)
+	flusher.Flush()
+
+	poll := time.NewTicker(sseInterval)
+	defer poll.Stop()
+	keepAlive := time.NewTicker(sseKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		events, err := GetIncidentEvents(q)
+		if err != nil {
+			// The client will reconnect with the last id it received
+			fmt.Fprintf(w, ": error %v\n\n", err)
+			flusher.Flush()
+			return
+		}
+
+		for _, e := range events {
+			p, err := GetEventPayload(e)
+			if err != nil {
+				fmt.Fprintf(w, ": error %v\n\n", err)
+				flusher.Flush()
+				return
+			}
+			payload, err := json.Marshal(p)
+			if err != nil {
+				return
+			}
+			if err = writeSSE(w, e, payload); err != nil {
+				return
+			}
+			q.Since = e.Id
+		}
+		if len(events) > 0 {
+			flusher.Flush()
+		}
+		// There's more to catch up on
+		if len(events) == q.Limit {
+			continue
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err = fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-poll.C:
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteSSE(t *testing.T) {
+	var b bytes.Buffer
+	err := writeSSE(&b, IncidentEvent{Id: 42, Type: eventAlertLevelEscalated}, []byte(`{"event":{}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "id: 42\nevent: alert_level_escalated\ndata: {\"event\":{}}\n\n"
+	if b.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, b.String())
+	}
+}
+
+func TestSSECursor(t *testing.T) {
+	r := httptest.NewRequest("GET", "/events/stream?since=10", nil)
+	r.Header.Set("Last-Event-ID", "42")
+	if id, err := sseCursor(r); err != nil || id != 42 {
+		t.Errorf("Expected to resume after Last-Event-ID 42, got %d %v", id, err)
+	}
+
+	r = httptest.NewRequest("GET", "/events/stream?since=10", nil)
+	if id, err := sseCursor(r); err != nil || id != 10 {
+		t.Errorf("Expected to start after since 10, got %d %v", id, err)
+	}
+
+	r = httptest.NewRequest("GET", "/events/stream", nil)
+	r.Header.Set("Last-Event-ID", "nonsense")
+	if _, err := sseCursor(r); err == nil {
+		t.Error("Expected an error for a nonsense Last-Event-ID")
+	}
+}
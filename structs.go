@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"github.com/paulmach/go.geojson"
 	"regexp"
@@ -49,43 +50,96 @@ func (i *Incident) Import() error {
 	r.IncidentUUID = i.UUID          // Update this on the report
 
 	// See if we have this report already
-	_, err = GetReportUUIDForHash(r.Hash)
+	_, err = GetReportUUIDForHashes(r.Hash, r.LegacyHash)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			// The error isn't that we don't have a record
 			return err
 		}
 		// We don't have this report
-		err = r.Insert()
+		err = r.insertWithEvents()
 		if err != nil {
 			return err
 		}
+		i.Reports[len(i.Reports)-1] = r // Now with its UUID, so we know it was inserted
 		// Possibly set this report as the latest
 		err = r.SetPubdateAsIncidentCurrentFromUpper()
 		if err != nil {
 			return err
 		}
+		// And how its perimeter's grown
+		_, err = r.RecordGrowth()
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// Inserts a new report, what's changed since the previous one, and the events for them in one transaction, so the
+// outbox has a message for every report
+func (r *Report) insertWithEvents() error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = r.Insert(tx)
+	if err != nil {
+		return err
+	}
+	// Let anyone following events know about the new report
+	e := IncidentEvent{IncidentUUID: r.IncidentUUID, ReportUUID: r.UUID, Type: eventReportInserted, OccurredAt: r.Pubdate}
+	err = e.Insert(tx)
+	if err != nil {
+		return err
+	}
+	// Keep track of what's different from the previous report
+	changes, err := r.RecordChanges(tx)
+	if err != nil {
+		return err
+	}
+	_, err = RecordTransitions(tx, changes, *r)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
 // Sets the incident's current column to true if it isn't already
 func (i *Incident) SetCurrent() error {
-	stmt, err := db.Prepare(`UPDATE incidents SET current = true, updated_at = (NOW() AT TIME ZONE 'UTC') WHERE uuid = $1 AND current = false`)
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`UPDATE incidents SET current = true, updated_at = (NOW() AT TIME ZONE 'UTC') WHERE uuid = $1 AND current = false`)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(i.UUID)
+	res, err := stmt.Exec(i.UUID)
 	if err != nil {
 		return err
 	}
 
 	i.Current = true
 
-	return nil
+	// It was resolved, but it's back in the feed
+	if n, _ := res.RowsAffected(); n > 0 {
+		e := IncidentEvent{IncidentUUID: i.UUID, Type: eventIncidentReopened, OccurredAt: time.Now()}
+		err = e.Insert(tx)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
 }
 
 // Inserts the incident into the database
@@ -93,7 +147,13 @@ func (i *Incident) Insert() error {
 	if i.UUID != "" {
 		return fmt.Errorf("Attempting to insert incident that already has a UUID, %s", i.UUID)
 	}
-	stmt, err := db.Prepare(`INSERT INTO incidents(rfs_id, current_from) VALUES($1, $2) RETURNING uuid`)
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT INTO incidents(rfs_id, current_from) VALUES($1, $2) RETURNING uuid`)
 	if err != nil {
 		return err
 	}
@@ -104,10 +164,24 @@ func (i *Incident) Insert() error {
 	firstSeenStr := i.FirstSeen.UTC().Format(time.RFC3339)
 	currentRange := fmt.Sprintf("[%s,%s]", firstSeenStr, firstSeenStr)
 
-	err = stmt.QueryRow(i.RFSId, currentRange).Scan(&i.UUID)
+	var uuid string
+	err = stmt.QueryRow(i.RFSId, currentRange).Scan(&uuid)
 	if err != nil {
 		return err
 	}
+
+	// Let anyone following events know about the new incident
+	e := IncidentEvent{IncidentUUID: uuid, Type: eventIncidentCreated, OccurredAt: i.FirstSeen}
+	err = e.Insert(tx)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	i.UUID = uuid
 	return nil
 }
 
@@ -115,6 +189,7 @@ type Report struct {
 	UUID              string
 	IncidentUUID      string
 	Hash              string
+	LegacyHash        string // Hash from before hashes were versioned, so reports with one can be found and upgraded
 	Guid              string
 	Title             string
 	Link              string
@@ -131,7 +206,9 @@ type Report struct {
 	Size              string
 	ResponsibleAgency string
 	Extra             string
-	Points            string // Just the 1st point... maybe we add support for multiple points at some point
+	Properties        map[string]interface{} // Every property on the feed's feature, as received
+	Details           map[string]string      // Every KEY: value pair parsed from the description
+	Points            string                 // Just the 1st point... maybe we add support for multiple points at some point
 	Geometry          *geojson.Geometry
 	CreatedAt         time.Time
 	UpdatedAt         time.Time
@@ -185,7 +262,7 @@ func (r *Report) parsedDescription() (map[string]string, error) {
 }
 
 // Inserts the report into the database
-func (r *Report) Insert() error {
+func (r *Report) Insert(q dbQueryer) error {
 	if r.UUID != "" {
 		return fmt.Errorf("Attempting to insert report that already has a UUID, %s", r.UUID)
 	}
@@ -196,22 +273,115 @@ func (r *Report) Insert() error {
 		return err
 	}
 
-	stmt, err := db.Prepare(`INSERT INTO
-    reports(incident_uuid, hash, guid, title, link, category, pubdate, description, updated, alert_level, location, council_area, status, fire_type, fire, size, responsible_agency, extra, geometry)
-    VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, ST_SetSRID(ST_GeomFromGeoJSON($19), 4326))
+	// Everything we received goes into jsonb columns, so new fields can be promoted to columns later
+	props, err := json.Marshal(r.Properties)
+	if err != nil {
+		return err
+	}
+	details, err := json.Marshal(r.Details)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := q.Prepare(`INSERT INTO
+    reports(incident_uuid, hash, guid, title, link, category, pubdate, description, updated, alert_level, location, council_area, status, fire_type, fire, size, responsible_agency, extra, geometry, properties, details)
+    VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, ST_SetSRID(ST_GeomFromGeoJSON($19), 4326), $20::jsonb, $21::jsonb)
     RETURNING uuid`)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	err = stmt.QueryRow(r.IncidentUUID, r.Hash, r.Guid, r.Title, r.Link, r.Category, r.Pubdate.UTC().Format(time.RFC3339), r.Description, r.Updated.UTC().Format(time.RFC3339), r.AlertLevel, r.Location, r.CouncilArea, r.Status, r.FireType, r.Fire, r.Size, r.ResponsibleAgency, r.Extra, geom).Scan(&r.UUID)
+	err = stmt.QueryRow(r.IncidentUUID, r.Hash, r.Guid, r.Title, r.Link, r.Category, r.Pubdate.UTC().Format(time.RFC3339), r.Description, r.Updated.UTC().Format(time.RFC3339), r.AlertLevel, r.Location, r.CouncilArea, r.Status, r.FireType, r.Fire, r.Size, r.ResponsibleAgency, r.Extra, geom, string(props), string(details)).Scan(&r.UUID)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// Updates the columns derived from the feed, leaving the UUID, incident and hash alone
+func (r *Report) Update() error {
+	if r.UUID == "" {
+		return fmt.Errorf("Attempting to update report that doesn't have a UUID")
+	}
+
+	geom, err := r.Geometry.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	props, err := json.Marshal(r.Properties)
+	if err != nil {
+		return err
+	}
+	details, err := json.Marshal(r.Details)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := db.Prepare(`UPDATE reports
+    SET guid = $2, title = $3, link = $4, category = $5, pubdate = $6, description = $7, updated = $8, alert_level = $9, location = $10, council_area = $11, status = $12, fire_type = $13, fire = $14, size = $15, responsible_agency = $16, extra = $17, geometry = ST_SetSRID(ST_GeomFromGeoJSON($18), 4326), properties = $19::jsonb, details = $20::jsonb, updated_at = (NOW() AT TIME ZONE 'UTC')
+    WHERE uuid = $1`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(r.UUID, r.Guid, r.Title, r.Link, r.Category, r.Pubdate.UTC().Format(time.RFC3339), r.Description, r.Updated.UTC().Format(time.RFC3339), r.AlertLevel, r.Location, r.CouncilArea, r.Status, r.FireType, r.Fire, r.Size, r.ResponsibleAgency, r.Extra, geom, string(props), string(details))
+	return err
+}
+
+// Columns selected when loading reports, in the order scanReport expects them
+const reportColumns = `reports.uuid, reports.incident_uuid, reports.hash, reports.guid, reports.title, COALESCE(reports.link, ''), COALESCE(reports.category, ''),
+  reports.pubdate, COALESCE(reports.description, ''), reports.updated, COALESCE(reports.alert_level, ''), COALESCE(reports.location, ''),
+  COALESCE(reports.council_area, ''), COALESCE(reports.status, ''), COALESCE(reports.fire_type, ''), reports.fire, COALESCE(reports.size, ''),
+  COALESCE(reports.responsible_agency, ''), COALESCE(reports.extra, ''), COALESCE(reports.properties, '{}'), COALESCE(reports.details, '{}'),
+  COALESCE(ST_AsGeoJSON(reports.geometry), ''), reports.created_at, reports.updated_at`
+
+// Either a *sql.Row or *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Scans a row of reportColumns into a report
+func scanReport(row rowScanner) (Report, error) {
+	r := Report{}
+	var props, details []byte
+	var geom string
+
+	err := row.Scan(&r.UUID, &r.IncidentUUID, &r.Hash, &r.Guid, &r.Title, &r.Link, &r.Category, &r.Pubdate, &r.Description, &r.Updated, &r.AlertLevel, &r.Location, &r.CouncilArea, &r.Status, &r.FireType, &r.Fire, &r.Size, &r.ResponsibleAgency, &r.Extra, &props, &details, &geom, &r.CreatedAt, &r.UpdatedAt)
+	if err != nil {
+		return r, err
+	}
+
+	err = json.Unmarshal(props, &r.Properties)
+	if err != nil {
+		return r, err
+	}
+	err = json.Unmarshal(details, &r.Details)
+	if err != nil {
+		return r, err
+	}
+	if geom != "" {
+		r.Geometry, err = geojson.UnmarshalGeometry([]byte(geom))
+		if err != nil {
+			return r, err
+		}
+	}
+
+	return r, nil
+}
+
+// Fetches a report by its UUID
+func GetReport(uuid string) (Report, error) {
+	stmt, err := db.Prepare(`SELECT ` + reportColumns + ` FROM reports WHERE uuid = $1`)
+	if err != nil {
+		return Report{}, err
+	}
+	defer stmt.Close()
+
+	return scanReport(stmt.QueryRow(uuid))
+}
+
 // If this is the latest report for an incident, update the incident's current_from column with this report's pubdate
 func (r *Report) SetPubdateAsIncidentCurrentFromUpper() error {
 	// Update the incident's current_from upper bound with this pubdate if it's greater than the current upper bound
@@ -228,3 +398,18 @@ func (r *Report) SetPubdateAsIncidentCurrentFromUpper() error {
 	}
 	return nil
 }
+
+// Sets the incident's current_from to span the pubdates of all its reports
+func SetIncidentCurrentFromReports(incidentUUID string) error {
+	stmt, err := db.Prepare(`UPDATE incidents
+    SET current_from = tstzrange(r.first, r.last, '[]')
+    FROM (SELECT MIN(pubdate) AS first, MAX(pubdate) AS last FROM reports WHERE incident_uuid = $1) r
+    WHERE uuid = $1 AND r.first IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(incidentUUID)
+	return err
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tiles beyond this zoom aren't any more detailed
+const tileMaxZoom = 22
+
+// How often the cache checks whether an import has changed anything
+const tileVersionCheckInterval = 10 * time.Second
+
+// The cache is emptied rather than growing past this many tiles
+const tileCacheMaxTiles = 10000
+
+// Caches tiles until an import changes the data they were built from
+type tileCache struct {
+	sync.Mutex
+	version string
+	checked time.Time
+	tiles   map[string][]byte
+}
+
+var tiles = &tileCache{tiles: make(map[string][]byte)}
+
+// Fetches a tile, building it if it isn't cached. at is zero for current incidents
+func (c *tileCache) Get(z, x, y int, at time.Time) ([]byte, error) {
+	err := c.checkVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	key := fmt.Sprintf("%d/%d/%d", z, x, y)
+	if !at.IsZero() {
+		key += "@" + at.UTC().Format(time.RFC3339)
+	}
+
+	c.Lock()
+	tile, ok := c.tiles[key]
+	c.Unlock()
+	if ok {
+		return tile, nil
+	}
+
+	tile, err = GetTile(z, x, y, at)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	if len(c.tiles) >= tileCacheMaxTiles {
+		c.tiles = make(map[string][]byte)
+	}
+	c.tiles[key] = tile
+	c.Unlock()
+
+	return tile, nil
+}
+
+// Empties the cache if the data's changed since it was last checked. Imports usually happen in another process
+func (c *tileCache) checkVersion() error {
+	c.Lock()
+	due := time.Since(c.checked) >= tileVersionCheckInterval
+	c.Unlock()
+	if !due {
+		return nil
+	}
+
+	version, err := GetTilesVersion()
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	if version != c.version {
+		c.tiles = make(map[string][]byte)
+		c.version = version
+	}
+	c.checked = time.Now()
+	c.Unlock()
+
+	return nil
+}
+
+// Changes whenever a report is inserted or changed in place, e.g. by reprocessing, or an incident's created, resolved or
+// reopened. Inserts and incidents' changes are recorded as events, in the same transaction. Both are read from indexes
+func GetTilesVersion() (string, error) {
+	var updated time.Time
+	var eventId int
+	err := db.QueryRow(`SELECT COALESCE((SELECT MAX(updated_at) FROM reports), 'epoch'),
+      COALESCE((SELECT MAX(id) FROM incident_events), 0)`).Scan(&updated, &eventId)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/%d", updated.UTC().Format(time.RFC3339Nano), eventId), nil
+}
+
+// Builds a Mapbox Vector Tile of the incidents current at a time, or now when it's zero, with their points in an
+// incidents layer and their polygons in a perimeters layer
+func GetTile(z, x, y int, at time.Time) ([]byte, error) {
+	query, args := reportsAtQuery(at)
+	n := len(args)
+	args = append(args, z, x, y)
+
+	stmt, err := db.Prepare(fmt.Sprintf(`WITH asof AS (`+query+`),
+    bounds AS (SELECT ST_TileEnvelope($%d, $%d, $%d) AS tile)
+    SELECT
+      COALESCE((SELECT ST_AsMVT(p, 'incidents') FROM (
+        SELECT ST_AsMVTGeom(ST_Transform(ST_CollectionExtract(asof.geometry, 1), 3857), bounds.tile) AS geom,
+          asof.rfs_id, asof.title, asof.alert_level, asof.status, asof.fire_type, asof.fire, asof.size, asof.pubdate::text
+        FROM asof, bounds
+        WHERE asof.geometry && ST_Transform(bounds.tile, 4326)
+      ) p WHERE geom IS NOT NULL), ''::bytea)
+      ||
+      COALESCE((SELECT ST_AsMVT(p, 'perimeters') FROM (
+        SELECT ST_AsMVTGeom(ST_Transform(ST_CollectionExtract(asof.geometry, 3), 3857), bounds.tile) AS geom,
+          asof.rfs_id, asof.title, asof.alert_level, asof.status
+        FROM asof, bounds
+        WHERE asof.geometry && ST_Transform(bounds.tile, 4326)
+      ) p WHERE geom IS NOT NULL), ''::bytea)`, n+1, n+2, n+3))
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	var tile []byte
+	err = stmt.QueryRow(args...).Scan(&tile)
+	return tile, err
+}
+
+// Parses a tile's path, e.g. /tiles/6/58/38.mvt
+func parseTilePath(path string) (int, int, int, error) {
+	parts := strings.Split(strings.TrimPrefix(path, "/tiles/"), "/")
+	if len(parts) != 3 || !strings.HasSuffix(parts[2], ".mvt") {
+		return 0, 0, 0, fmt.Errorf("Expected a tile as /tiles/{z}/{x}/{y}.mvt, got %s", path)
+	}
+	parts[2] = strings.TrimSuffix(parts[2], ".mvt")
+
+	zxy := make([]int, 3)
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("Expected a tile as /tiles/{z}/{x}/{y}.mvt, got %s", path)
+		}
+		zxy[i] = n
+	}
+
+	z, x, y := zxy[0], zxy[1], zxy[2]
+	if z < 0 || z > tileMaxZoom || x < 0 || y < 0 || x >= 1<<uint(z) || y >= 1<<uint(z) {
+		return 0, 0, 0, fmt.Errorf("There isn't a tile %d/%d/%d", z, x, y)
+	}
+	return z, x, y, nil
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseTilePath(t *testing.T) {
+	z, x, y, err := parseTilePath("/tiles/6/58/38.mvt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if z != 6 || x != 58 || y != 38 {
+		t.Errorf("Expected 6/58/38, got %d/%d/%d", z, x, y)
+	}
+
+	for _, path := range []string{"/tiles/6/58/38", "/tiles/6/58.mvt", "/tiles/a/58/38.mvt", "/tiles/2/4/0.mvt", "/tiles/23/0/0.mvt", "/tiles/-1/0/0.mvt"} {
+		if _, _, _, err := parseTilePath(path); err == nil {
+			t.Errorf("Expected an error parsing %s", path)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/paulmach/go.geojson"
+	"io"
+	"time"
+)
+
+// Timeline formats
+const (
+	timelineGeoJSON = "geojson"
+	timelineCZML    = "czml"
+)
+
+// Colours of each alert level on animated maps, as RGBA
+var alertLevelColours = map[string][]int{
+	"Emergency Warning": {228, 26, 28, 255},
+	"Watch and Act":     {255, 127, 0, 255},
+	"Advice":            {255, 221, 0, 255},
+}
+var defaultAlertLevelColour = []int{55, 126, 184, 255}
+
+// A report with when it was the incident's latest
+type TimelineEntry struct {
+	RFSId  int
+	Report Report
+	Start  time.Time
+	End    time.Time
+}
+
+// When a report stopped being its incident's latest: when the next report was published, or the incident was
+// resolved, whichever came first. Reports of current incidents last until the end of the timeline. Incidents
+// resolved before resolutions were recorded as events end with their last report, as they do in asof
+func timelineEnd(r Report, next, resolved *time.Time, current bool, to time.Time) time.Time {
+	if next != nil && (resolved == nil || next.Before(*resolved)) {
+		return *next
+	}
+	if resolved != nil {
+		return *resolved
+	}
+	if current && to.After(r.Pubdate) {
+		return to
+	}
+	return r.Pubdate
+}
+
+// Fetches every report published between two times, with when each was its incident's latest
+func GetTimeline(from, to time.Time) ([]TimelineEntry, error) {
+	entries := []TimelineEntry{}
+
+	// The next report is found among all of the incident's reports, not just those in the range
+	rows, err := db.Query(`WITH timeline AS (
+      SELECT *, lead(pubdate) OVER (PARTITION BY incident_uuid ORDER BY pubdate, created_at) AS next_pubdate FROM reports
+    )
+    SELECT `+reportColumns+`, i.rfs_id, i.current, reports.next_pubdate,
+      (SELECT MIN(e.occurred_at) FROM incident_events e WHERE e.incident_uuid = reports.incident_uuid AND e.type = $3 AND e.occurred_at > reports.pubdate)
+    FROM timeline reports
+    JOIN incidents i ON i.uuid = reports.incident_uuid
+    WHERE reports.pubdate >= $1 AND reports.pubdate <= $2
+    ORDER BY reports.pubdate, reports.created_at`, from.UTC().Format(time.RFC3339), to.UTC().Format(time.RFC3339), eventIncidentResolved)
+	if err != nil {
+		return entries, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e := TimelineEntry{}
+		var current bool
+		var next, resolved *time.Time // NULL when there isn't one
+		e.Report, err = scanReport(extraColumns{rows, []interface{}{&e.RFSId, &current, &next, &resolved}})
+		if err != nil {
+			return entries, err
+		}
+		e.Start = e.Report.Pubdate
+		e.End = timelineEnd(e.Report, next, resolved, current, to)
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
+
+// The timeline as features with start and end properties, and both in a times array for time slider plugins
+func timelineFeatureCollection(entries []TimelineEntry) *geojson.FeatureCollection {
+	fc := geojson.NewFeatureCollection()
+	for _, e := range entries {
+		f := reportFeature(e.RFSId, e.Report)
+		start, end := e.Start.UTC().Format(time.RFC3339), e.End.UTC().Format(time.RFC3339)
+		f.SetProperty("start", start)
+		f.SetProperty("end", end)
+		f.SetProperty("times", []string{start, end})
+		fc.AddFeature(f)
+	}
+	return fc
+}
+
+// Splits a geometry into its points and polygons. Lines aren't drawn
+func geometryPointsAndPolygons(g *geojson.Geometry) ([][]float64, [][][][]float64) {
+	points := [][]float64{}
+	polygons := [][][][]float64{}
+	if g == nil {
+		return points, polygons
+	}
+
+	geoms := []*geojson.Geometry{g}
+	if g.IsCollection() {
+		geoms = flattenGeometries(g.Geometries)
+	}
+	for _, g := range geoms {
+		switch g.Type {
+		case geojson.GeometryPoint:
+			points = append(points, g.Point)
+		case geojson.GeometryMultiPoint:
+			points = append(points, g.MultiPoint...)
+		case geojson.GeometryPolygon:
+			polygons = append(polygons, g.Polygon)
+		case geojson.GeometryMultiPolygon:
+			polygons = append(polygons, g.MultiPolygon...)
+		}
+	}
+	return points, polygons
+}
+
+// Positions as CZML's flat list of longitude, latitude and height
+func cartographicDegrees(positions [][]float64) []float64 {
+	degrees := []float64{}
+	for _, p := range positions {
+		degrees = append(degrees, p[0], p[1], 0)
+	}
+	return degrees
+}
+
+func alertLevelColour(alertLevel string, alpha int) []int {
+	colour, ok := alertLevelColours[alertLevel]
+	if !ok {
+		colour = defaultAlertLevelColour
+	}
+	return []int{colour[0], colour[1], colour[2], alpha}
+}
+
+// The timeline as CZML packets, a document packet with the clock then a packet for each report's point and polygons
+func czmlPackets(entries []TimelineEntry, from, to time.Time) []map[string]interface{} {
+	interval := from.UTC().Format(time.RFC3339) + "/" + to.UTC().Format(time.RFC3339)
+	packets := []map[string]interface{}{{
+		"id":      "document",
+		"name":    "incidentworker timeline",
+		"version": "1.0",
+		"clock": map[string]interface{}{
+			"interval":    interval,
+			"currentTime": from.UTC().Format(time.RFC3339),
+			"multiplier":  3600,
+		},
+	}}
+
+	for _, e := range entries {
+		r := e.Report
+		availability := e.Start.UTC().Format(time.RFC3339) + "/" + e.End.UTC().Format(time.RFC3339)
+		description := fmt.Sprintf("%s<br />%s, %s, %s", r.Title, r.AlertLevel, r.Status, r.Size)
+		points, polygons := geometryPointsAndPolygons(r.Geometry)
+
+		for i, p := range points {
+			packets = append(packets, map[string]interface{}{
+				"id":           fmt.Sprintf("%s/point/%d", r.UUID, i),
+				"name":         r.Title,
+				"description":  description,
+				"availability": availability,
+				"position":     map[string]interface{}{"cartographicDegrees": cartographicDegrees([][]float64{p})},
+				"point": map[string]interface{}{
+					"pixelSize": 8,
+					"color":     map[string]interface{}{"rgba": alertLevelColour(r.AlertLevel, 255)},
+				},
+			})
+		}
+
+		for i, rings := range polygons {
+			if len(rings) == 0 {
+				continue
+			}
+			polygon := map[string]interface{}{
+				"positions": map[string]interface{}{"cartographicDegrees": cartographicDegrees(rings[0])},
+				"material": map[string]interface{}{
+					"solidColor": map[string]interface{}{"color": map[string]interface{}{"rgba": alertLevelColour(r.AlertLevel, 128)}},
+				},
+			}
+			if len(rings) > 1 {
+				holes := [][]float64{}
+				for _, hole := range rings[1:] {
+					holes = append(holes, cartographicDegrees(hole))
+				}
+				polygon["holes"] = map[string]interface{}{"cartographicDegrees": holes}
+			}
+			packets = append(packets, map[string]interface{}{
+				"id":           fmt.Sprintf("%s/polygon/%d", r.UUID, i),
+				"name":         r.Title,
+				"description":  description,
+				"availability": availability,
+				"polygon":      polygon,
+			})
+		}
+	}
+
+	return packets
+}
+
+// Writes the reports published between two times as a timeline, in GeoJSON or CZML
+func WriteTimeline(w io.Writer, from, to time.Time, format string) error {
+	if format != timelineGeoJSON && format != timelineCZML {
+		return fmt.Errorf("Unknown timeline format %s, it should be %s or %s", format, timelineGeoJSON, timelineCZML)
+	}
+
+	entries, err := GetTimeline(from, to)
+	if err != nil {
+		return err
+	}
+
+	if format == timelineCZML {
+		return json.NewEncoder(w).Encode(czmlPackets(entries, from, to))
+	}
+	return json.NewEncoder(w).Encode(timelineFeatureCollection(entries))
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"github.com/paulmach/go.geojson"
+	"testing"
+	"time"
+)
+
+func TestTimelineEnd(t *testing.T) {
+	at := func(hour int) time.Time { return time.Date(2015, 12, 1, hour, 0, 0, 0, time.UTC) }
+	ptr := func(t time.Time) *time.Time { return &t }
+	r := Report{Pubdate: at(10)}
+	to := at(20)
+
+	cases := []struct {
+		name           string
+		next, resolved *time.Time
+		current        bool
+		expected       time.Time
+	}{
+		{"next report", ptr(at(12)), nil, true, at(12)},
+		{"resolved before the next report", ptr(at(15)), ptr(at(13)), false, at(13)},
+		{"next report before being resolved", ptr(at(12)), ptr(at(13)), false, at(12)},
+		{"resolved", nil, ptr(at(14)), false, at(14)},
+		{"still current", nil, nil, true, to},
+		{"resolved before events", nil, nil, false, at(10)},
+	}
+
+	for _, c := range cases {
+		if got := timelineEnd(r, c.next, c.resolved, c.current, to); !got.Equal(c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, got)
+		}
+	}
+}
+
+func TestCZMLPackets(t *testing.T) {
+	from, to := time.Date(2015, 12, 1, 0, 0, 0, 0, time.UTC), time.Date(2015, 12, 2, 0, 0, 0, 0, time.UTC)
+	polygon := [][]float64{{150, -33}, {151, -33}, {151, -34}, {150, -33}}
+	r := Report{
+		UUID:       "b",
+		Title:      "Wambelong",
+		AlertLevel: "Emergency Warning",
+		Geometry: geojson.NewCollectionGeometry(
+			geojson.NewPointGeometry([]float64{150.5, -33.5}),
+			geojson.NewPolygonGeometry([][][]float64{polygon}),
+		),
+	}
+	entries := []TimelineEntry{{RFSId: 123456, Report: r, Start: from.Add(time.Hour), End: from.Add(2 * time.Hour)}}
+
+	packets := czmlPackets(entries, from, to)
+	if len(packets) != 3 {
+		t.Fatalf("Expected a document, point and polygon packet, got %v", packets)
+	}
+	if packets[0]["id"] != "document" {
+		t.Errorf("Expected the document packet first, got %v", packets[0])
+	}
+	if packets[1]["id"] != "b/point/0" || packets[2]["id"] != "b/polygon/0" {
+		t.Errorf("Unexpected packet ids %v and %v", packets[1]["id"], packets[2]["id"])
+	}
+	if packets[2]["availability"] != "2015-12-01T01:00:00Z/2015-12-01T02:00:00Z" {
+		t.Errorf("Unexpected availability %v", packets[2]["availability"])
+	}
+	positions := packets[2]["polygon"].(map[string]interface{})["positions"].(map[string]interface{})["cartographicDegrees"].([]float64)
+	if len(positions) != len(polygon)*3 {
+		t.Errorf("Expected 3 values per position, got %v", positions)
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/franela/goreq"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Delivery statuses
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed" // Gave up after webhookMaxAttempts
+)
+
+// How many times a delivery's attempted before giving up on it
+const webhookMaxAttempts = 10
+
+// How often the worker's deliverer attempts the deliveries that are due
+const webhookDeliveryInterval = 5 * time.Second
+
+type Webhook struct {
+	Id           int
+	URL          string
+	Secret       string
+	EventTypes   []string // Empty for all
+	AlertLevels  []string // Empty for all
+	CouncilAreas []string // Empty for all
+	FireOnly     bool
+	Active       bool
+	LastEventId  int
+	CreatedAt    time.Time
+}
+
+type WebhookDelivery struct {
+	Id         int
+	WebhookId  int
+	EventId    int
+	EventType  string
+	Payload    []byte
+	Status     string
+	Attempts   int
+	URL        string // Of the webhook
+	Secret     string // Of the webhook
+	StatusCode int
+	Error      string
+}
+
+// Whether the webhook wants to hear about this event
+func (h *Webhook) Matches(p EventPayload) bool {
+	if len(h.EventTypes) > 0 && !containsFold(h.EventTypes, p.Event.Type) {
+		return false
+	}
+
+	// Without a report there's nothing to filter on, so only webhooks without report filters get it
+	if p.Report == nil {
+		return len(h.AlertLevels) == 0 && len(h.CouncilAreas) == 0 && !h.FireOnly
+	}
+
+	if len(h.AlertLevels) > 0 && !containsFold(h.AlertLevels, p.Report.AlertLevel) {
+		return false
+	}
+	if len(h.CouncilAreas) > 0 && !containsFold(h.CouncilAreas, p.Report.CouncilArea) {
+		return false
+	}
+	if h.FireOnly && !p.Report.Fire {
+		return false
+	}
+
+	return true
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(strings.TrimSpace(v), strings.TrimSpace(s)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Splits a comma separated list, dropping empty items
+func splitList(s string) []string {
+	list := []string{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// The value of the signature header, the hex HMAC-SHA256 of the body using the webhook's secret
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// How long to wait before the next attempt. Doubles from 30 seconds, up to 6 hours
+func webhookBackoff(attempts int) time.Duration {
+	backoff := 30 * time.Second
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= 6*time.Hour {
+			return 6 * time.Hour
+		}
+	}
+	return backoff
+}
+
+// Posts the delivery's payload to its webhook. Returns the response's status code
+func sendWebhook(d WebhookDelivery) (int, error) {
+	req := goreq.Request{
+		Method:      "POST",
+		Uri:         d.URL,
+		Body:        d.Payload,
+		ContentType: "application/json",
+		UserAgent:   "incidentworker",
+		Timeout:     10 * time.Second,
+	}
+	req.AddHeader("X-Incidentworker-Event", d.EventType)
+	req.AddHeader("X-Incidentworker-Delivery", strconv.Itoa(d.Id))
+	req.AddHeader("X-Incidentworker-Signature", webhookSignature(d.Secret, d.Payload))
+
+	res, err := req.Do()
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("Webhook responded with %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+// Queues deliveries of events recorded since each webhook last looked. Returns how many were queued
+func QueueWebhookDeliveries() (int, error) {
+	count := 0
+
+	hooks, err := GetWebhooks(true)
+	if err != nil {
+		return count, err
+	}
+
+	// Each event's payload is the same for every webhook
+	payloads := make(map[int][]byte)
+
+	for _, h := range hooks {
+		for {
+			events, err := GetIncidentEvents(EventQuery{Since: h.LastEventId, Limit: 500})
+			if err != nil {
+				return count, err
+			}
+			if len(events) == 0 {
+				break
+			}
+
+			for _, e := range events {
+				p, err := GetEventPayload(e)
+				if err != nil {
+					return count, err
+				}
+				if h.Matches(p) {
+					if payloads[e.Id] == nil {
+						payloads[e.Id], err = json.Marshal(p)
+						if err != nil {
+							return count, err
+						}
+					}
+					err = QueueWebhookDelivery(h.Id, e.Id, payloads[e.Id])
+					if err != nil {
+						return count, err
+					}
+					count++
+				}
+			}
+
+			h.LastEventId = events[len(events)-1].Id
+			err = h.SetLastEventId()
+			if err != nil {
+				return count, err
+			}
+		}
+	}
+
+	return count, nil
+}
+
+// Attempts the deliveries that are due. Returns how many were delivered and how many failed this time
+func DeliverWebhooks() (int, int, error) {
+	delivered, failed := 0, 0
+
+	deliveries, err := GetDueWebhookDeliveries(100)
+	if err != nil {
+		return delivered, failed, err
+	}
+
+	for _, d := range deliveries {
+		d.Attempts++
+		d.StatusCode, err = sendWebhook(d)
+		if err != nil {
+			failed++
+			d.Error = err.Error()
+			d.Status = deliveryPending
+			if d.Attempts >= webhookMaxAttempts {
+				d.Status = deliveryFailed
+			}
+			log.Printf("Webhook delivery %d to %s failed (attempt %d) %v\n", d.Id, d.URL, d.Attempts, err)
+		} else {
+			delivered++
+			d.Error = ""
+			d.Status = deliveryDelivered
+		}
+
+		err = d.SaveAttempt()
+		if err != nil {
+			return delivered, failed, err
+		}
+	}
+
+	return delivered, failed, nil
+}
+
+// Queues webhook deliveries after an import. Problems are logged, they shouldn't stop imports
+func queueWebhooks() {
+	queued, err := QueueWebhookDeliveries()
+	if err != nil {
+		fmt.Printf("\nError queueing webhook deliveries %v\n", err)
+	} else if queued > 0 {
+		log.Printf("Webhooks: %d queued\n", queued)
+	}
+}
+
+// Attempts webhook deliveries until there's nothing due. Problems are logged
+func deliverWebhooks() {
+	for {
+		delivered, failed, err := DeliverWebhooks()
+		if err != nil {
+			fmt.Printf("\nError delivering webhooks %v\n", err)
+			return
+		}
+		if delivered > 0 || failed > 0 {
+			log.Printf("Webhooks: %d delivered, %d failed\n", delivered, failed)
+		}
+		if delivered == 0 {
+			return
+		}
+	}
+}
+
+// Delivers webhooks at an interval, for running alongside imports so slow endpoints don't hold them up
+func RunWebhookDeliverer(interval time.Duration) {
+	for range time.Tick(interval) {
+		deliverWebhooks()
+	}
+}
+
+// Inserts the webhook. It'll receive events recorded from now on
+func (h *Webhook) Insert() error {
+	stmt, err := db.Prepare(`INSERT INTO webhooks(url, secret, event_types, alert_levels, council_areas, fire_only, last_event_id)
+    VALUES($1, $2, $3, $4, $5, $6, (SELECT COALESCE(MAX(id), 0) FROM incident_events))
+    RETURNING id, last_event_id, active, created_at`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	return stmt.QueryRow(h.URL, h.Secret, strings.Join(h.EventTypes, ","), strings.Join(h.AlertLevels, ","), strings.Join(h.CouncilAreas, ","), h.FireOnly).Scan(&h.Id, &h.LastEventId, &h.Active, &h.CreatedAt)
+}
+
+func DeleteWebhook(id int) error {
+	stmt, err := db.Prepare(`DELETE FROM webhooks WHERE id = $1`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("No webhook with id %d", id)
+	}
+	return nil
+}
+
+func (h *Webhook) SetLastEventId() error {
+	stmt, err := db.Prepare(`UPDATE webhooks SET last_event_id = $2, updated_at = (NOW() AT TIME ZONE 'UTC') WHERE id = $1`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(h.Id, h.LastEventId)
+	return err
+}
+
+func GetWebhooks(activeOnly bool) ([]Webhook, error) {
+	hooks := []Webhook{}
+
+	rows, err := db.Query(`SELECT id, url, secret, event_types, alert_levels, council_areas, fire_only, active, last_event_id, created_at
+    FROM webhooks WHERE active = true OR $1 = false ORDER BY id`, activeOnly)
+	if err != nil {
+		return hooks, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		h := Webhook{}
+		var eventTypes, alertLevels, councilAreas string
+		err = rows.Scan(&h.Id, &h.URL, &h.Secret, &eventTypes, &alertLevels, &councilAreas, &h.FireOnly, &h.Active, &h.LastEventId, &h.CreatedAt)
+		if err != nil {
+			return hooks, err
+		}
+		h.EventTypes = splitList(eventTypes)
+		h.AlertLevels = splitList(alertLevels)
+		h.CouncilAreas = splitList(councilAreas)
+		hooks = append(hooks, h)
+	}
+
+	return hooks, rows.Err()
+}
+
+// Queues a payload for a webhook. An event's only queued once per webhook
+func QueueWebhookDelivery(webhookId, eventId int, payload []byte) error {
+	stmt, err := db.Prepare(`INSERT INTO webhook_deliveries(webhook_id, event_id, payload) VALUES($1, $2, $3::jsonb)
+    ON CONFLICT (webhook_id, event_id) DO NOTHING`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(webhookId, eventId, string(payload))
+	return err
+}
+
+// Fetches pending deliveries that are due an attempt, oldest first
+func GetDueWebhookDeliveries(limit int) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+
+	rows, err := db.Query(`SELECT d.id, d.webhook_id, d.event_id, e.type, d.payload, d.status, d.attempts, w.url, w.secret
+    FROM webhook_deliveries d
+    JOIN webhooks w ON w.id = d.webhook_id
+    JOIN incident_events e ON e.id = d.event_id
+    WHERE d.status = $1 AND d.next_attempt_at <= NOW() AND w.active = true
+    ORDER BY d.id
+    LIMIT $2`, deliveryPending, limit)
+	if err != nil {
+		return deliveries, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		d := WebhookDelivery{}
+		err = rows.Scan(&d.Id, &d.WebhookId, &d.EventId, &d.EventType, &d.Payload, &d.Status, &d.Attempts, &d.URL, &d.Secret)
+		if err != nil {
+			return deliveries, err
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// Records the outcome of an attempt, scheduling the next one if it's still pending
+func (d *WebhookDelivery) SaveAttempt() error {
+	stmt, err := db.Prepare(`UPDATE webhook_deliveries
+    SET status = $2, attempts = $3, last_status_code = NULLIF($4, 0), last_error = NULLIF($5, ''),
+      next_attempt_at = $6,
+      delivered_at = CASE WHEN $2 = 'delivered' THEN (NOW() AT TIME ZONE 'UTC') ELSE NULL END
+    WHERE id = $1`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	next := time.Now().Add(webhookBackoff(d.Attempts))
+	_, err = stmt.Exec(d.Id, d.Status, d.Attempts, d.StatusCode, d.Error, next.UTC().Format(time.RFC3339))
+	return err
+}
+
+// Writes webhooks for a human
+func PrintWebhooks(w io.Writer, hooks []Webhook) {
+	for _, h := range hooks {
+		fmt.Fprintf(w, "%d  %s  active: %t\n", h.Id, h.URL, h.Active)
+		fmt.Fprintf(w, "  events: %s  alert levels: %s  council areas: %s  fire only: %t\n",
+			listOrAll(h.EventTypes), listOrAll(h.AlertLevels), listOrAll(h.CouncilAreas), h.FireOnly)
+	}
+}
+
+func listOrAll(list []string) string {
+	if len(list) == 0 {
+		return "all"
+	}
+	return strings.Join(list, ", ")
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookMatches(t *testing.T) {
+	p := EventPayload{
+		Event:  IncidentEvent{Type: eventAlertLevelEscalated},
+		Report: &ReportSummary{AlertLevel: "Emergency Warning", CouncilArea: "Blue Mountains", Fire: true},
+	}
+
+	matching := []Webhook{
+		{},
+		{EventTypes: []string{eventAlertLevelEscalated}},
+		{AlertLevels: []string{"emergency warning", "Watch and Act"}},
+		{CouncilAreas: []string{"Blue Mountains"}, FireOnly: true},
+	}
+	for _, h := range matching {
+		if !h.Matches(p) {
+			t.Errorf("Expected %+v to match", h)
+		}
+	}
+
+	notMatching := []Webhook{
+		{EventTypes: []string{eventIncidentCreated}},
+		{AlertLevels: []string{"Advice"}},
+		{CouncilAreas: []string{"Tumut"}},
+	}
+	for _, h := range notMatching {
+		if h.Matches(p) {
+			t.Errorf("Expected %+v not to match", h)
+		}
+	}
+
+	p.Report.Fire = false
+	h := Webhook{FireOnly: true}
+	if h.Matches(p) {
+		t.Error("Expected a fire only webhook not to match a report that isn't a fire")
+	}
+
+	p.Report = nil
+	if h.Matches(p) {
+		t.Error("Expected a webhook with report filters not to match an event without a report")
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	if webhookBackoff(1) != 30*time.Second {
+		t.Errorf("Expected the first backoff to be 30s, got %v", webhookBackoff(1))
+	}
+	if webhookBackoff(3) != 2*time.Minute {
+		t.Errorf("Expected the third backoff to be 2m, got %v", webhookBackoff(3))
+	}
+	if webhookBackoff(20) != 6*time.Hour {
+		t.Errorf("Expected backoff to be capped at 6h, got %v", webhookBackoff(20))
+	}
+}
+
+func TestSendWebhook(t *testing.T) {
+	payload := []byte(`{"event":{"type":"incident_created"}}`)
+	secret := "s3cret"
+
+	var received *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	code, err := sendWebhook(WebhookDelivery{Id: 7, EventType: eventIncidentCreated, Payload: payload, URL: server.URL, Secret: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", code)
+	}
+	if string(body) != string(payload) {
+		t.Errorf("Expected payload %s, got %s", payload, body)
+	}
+	if received.Header.Get("X-Incidentworker-Signature") != webhookSignature(secret, payload) {
+		t.Errorf("Unexpected signature %s", received.Header.Get("X-Incidentworker-Signature"))
+	}
+	if received.Header.Get("X-Incidentworker-Event") != eventIncidentCreated || received.Header.Get("X-Incidentworker-Delivery") != "7" {
+		t.Errorf("Unexpected headers %v", received.Header)
+	}
+}
+
+func TestSendWebhookFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	code, err := sendWebhook(WebhookDelivery{Payload: []byte(`{}`), URL: server.URL, Secret: "s3cret"})
+	if err == nil {
+		t.Error("Expected an error from a 500 response")
+	}
+	if code != http.StatusInternalServerError {
+		t.Errorf("Expected status 500, got %d", code)
+	}
+}